@@ -29,6 +29,9 @@ class SerialInterface
     // Drive initialization command
     void cmd_initialize();
 
+    // Optional commands available
+    void cmd_capabilities();
+
 public:
     // Constructor
     SerialInterface(Floppy *floppy, byte *buf);
@@ -12,9 +12,15 @@
 #define CMD_READ_BLOCKS 'B'
 #define CMD_HANDSHAKE 'H'
 #define CMD_INITIALIZE 'I'
+#define CMD_CAPABILITIES 'C'
 #define CMD_ERROR 'E'
+#define CMD_ERROR_DATA 'D'
 #define CMD_OK 'O'
 
+// Flags of the optional commands available. Writing (0x01) is not
+// implemented, so the host doesn't send write commands
+#define CAPABILITIES 0x00
+
 byte read_byte()
 {
     // Wait for data to be available
@@ -61,6 +67,9 @@ void SerialInterface::tick()
         case CMD_INITIALIZE:
             cmd_initialize();
             break;
+        case CMD_CAPABILITIES:
+            cmd_capabilities();
+            break;
         }
     }
 }
@@ -85,8 +94,15 @@ void SerialInterface::cmd_read_sector()
     // Perform read
     FloppyError ec = floppy->read_sector(buf, cylinder, head, sector);
 
+    // Data was read but the CRC doesn't match, send it anyway: the host
+    // may be able to piece the sector together from several reads
+    if (ec == FloppyError::CRC)
+    {
+        Serial.write(CMD_ERROR_DATA);
+        Serial.write(buf + 1, SECTOR_SIZE);
+    }
     // If there was an error
-    if (ec != FloppyError::OK)
+    else if (ec != FloppyError::OK)
     {
         Serial.write(CMD_ERROR);
     }
@@ -168,4 +184,12 @@ void SerialInterface::cmd_handshake()
     // Respond to handshake
     Serial.write(CMD_HANDSHAKE);
     Serial.flush();
+}
+
+void SerialInterface::cmd_capabilities()
+{
+    // Tell host which optional commands are available
+    Serial.write(CMD_CAPABILITIES);
+    Serial.write(CAPABILITIES);
+    Serial.flush();
 }
\ No newline at end of file
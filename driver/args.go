@@ -3,6 +3,9 @@ package main
 import (
 	"fmt"
 	"os"
+	"strconv"
+
+	"floppy_arduino/proto"
 )
 
 // Arguments
@@ -10,11 +13,23 @@ const ARG_DEVICE string = "--device"
 const ARG_DEVICE_SHORT string = "-d"
 const ARG_RETRIES string = "--retries"
 const ARG_RETRIES_SHORT string = "-r"
+const ARG_FORMAT string = "--format"
+const ARG_FORMAT_SHORT string = "-f"
+const ARG_CACHE string = "--cache"
+const ARG_CACHE_SHORT string = "-c"
+const ARG_NO_PREFETCH string = "--no-prefetch"
+const ARG_PRELOAD string = "--preload"
+const ARG_PRELOAD_SHORT string = "-p"
+const ARG_WRITE string = "--write"
+const ARG_WRITE_SHORT string = "-w"
+const ARG_LISTEN string = "--listen"
+const ARG_LISTEN_SHORT string = "-l"
+const ARG_EXPORT string = "--export"
 const ARG_HELP string = "--help"
 const ARG_HELP_SHORT string = "-h"
 
 // Messages
-const MSG_HELP string = "Usage: driver [OPTIONS] NBD_DEVICE\nOptions: \n \t-d --device: Serial port of Arduino\n \t-r --retires: Number of read retries\n \t-h --help: Display this message"
+const MSG_HELP string = "Usage: driver [OPTIONS] NBD_DEVICE\n       driver [OPTIONS] --listen ADDR\nOptions: \n \t-d --device: Serial port of Arduino\n \t-r --retires: Number of read retries\n \t-f --format: Disk format (360K, 720K, 1.2M, 1.44M, 2.88M), default auto: detect from the disk\n \t-c --cache: Size of sector cache in sectors (default: whole disk), 0 disables it\n \t--no-prefetch: Don't read the rest of the track on cache misses\n \t-p --preload: Read the whole disk in memory and serve it from there\n \t-w --write: Enable writes (needs firmware with write support)\n \t-l --listen: Serve over NBD on a TCP address (host:port) or unix:/path instead of a local nbd device\n \t--export: Export name when listening (default: floppy)\n \t-h --help: Display this message"
 const MSG_NBD_DEVICE_MISSING string = "driver: missing nbd device"
 const MSG_OPT_VALUE_MISSING string = "driver: missing option value"
 const MSG_OPT_VALUE_INVALID string = "driver: invalid option value"
@@ -23,6 +38,9 @@ const MSG_TRY_HELP string = "Try 'driver --help' for more information"
 
 // Deafaults
 const DEFAULT_MAX_RETRIES uint = 5
+const DEFAULT_EXPORT string = "floppy"
+
+const FORMAT_AUTO string = "auto"
 
 type OptionalString struct {
 	value     string
@@ -39,9 +57,21 @@ type OptionalUint struct {
 	has_value bool
 }
 
+type OptionalGeometry struct {
+	value     proto.Geometry
+	has_value bool
+}
+
 type Config struct {
 	device      OptionalString
 	max_retries OptionalUint
+	format      OptionalGeometry
+	cache_size  OptionalUint
+	no_prefetch bool
+	preload     bool
+	write       bool
+	listen      OptionalString
+	export      OptionalString
 	nbd_device  OptionalString
 }
 
@@ -82,6 +112,120 @@ func parse_args() (Config, ConfigResult) {
 				return conf, ConfigERR
 			}
 
+		} else if args[i] == ARG_RETRIES || args[i] == ARG_RETRIES_SHORT {
+			// --retries or -r
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+
+				value, err := strconv.ParseUint(args[i], 10, 32)
+
+				if err == nil {
+					conf.max_retries.value = uint(value)
+					conf.max_retries.has_value = true
+				} else {
+					fmt.Println(MSG_OPT_VALUE_INVALID)
+					fmt.Println(MSG_TRY_HELP)
+					return conf, ConfigERR
+				}
+
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_FORMAT || args[i] == ARG_FORMAT_SHORT {
+			// --format or -f
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+
+				value, err := proto.ParseFormat(args[i])
+
+				if args[i] == FORMAT_AUTO {
+					conf.format.has_value = false
+				} else if err == nil {
+					conf.format.value = value
+					conf.format.has_value = true
+				} else {
+					fmt.Println(MSG_OPT_VALUE_INVALID)
+					fmt.Println(MSG_TRY_HELP)
+					return conf, ConfigERR
+				}
+
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_CACHE || args[i] == ARG_CACHE_SHORT {
+			// --cache or -c
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+
+				value, err := strconv.ParseUint(args[i], 10, 32)
+
+				if err == nil {
+					conf.cache_size.value = uint(value)
+					conf.cache_size.has_value = true
+				} else {
+					fmt.Println(MSG_OPT_VALUE_INVALID)
+					fmt.Println(MSG_TRY_HELP)
+					return conf, ConfigERR
+				}
+
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_NO_PREFETCH {
+			// --no-prefetch
+
+			conf.no_prefetch = true
+		} else if args[i] == ARG_PRELOAD || args[i] == ARG_PRELOAD_SHORT {
+			// --preload or -p
+
+			conf.preload = true
+		} else if args[i] == ARG_WRITE || args[i] == ARG_WRITE_SHORT {
+			// --write or -w
+
+			conf.write = true
+		} else if args[i] == ARG_LISTEN || args[i] == ARG_LISTEN_SHORT {
+			// --listen or -l
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+				conf.listen.value = args[i]
+				conf.listen.has_value = true
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_EXPORT {
+			// --export
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+				conf.export.value = args[i]
+				conf.export.has_value = true
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
 		} else {
 			conf.nbd_device.value = args[i]
 			conf.nbd_device.has_value = true
@@ -93,9 +237,13 @@ func parse_args() (Config, ConfigResult) {
 		conf.max_retries.value = DEFAULT_MAX_RETRIES
 		conf.max_retries.has_value = true
 	}
+	if !conf.export.has_value {
+		conf.export.value = DEFAULT_EXPORT
+		conf.export.has_value = true
+	}
 
 	// Check required parameters
-	if !conf.nbd_device.has_value {
+	if !conf.nbd_device.has_value && !conf.listen.has_value {
 		fmt.Println(MSG_NBD_DEVICE_MISSING)
 		fmt.Println(MSG_TRY_HELP)
 		return conf, ConfigERR
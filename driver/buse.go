@@ -3,11 +3,12 @@ package main
 import (
 	"encoding/binary"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"syscall"
 	"unsafe"
+
+	"floppy_arduino/proto"
 )
 
 func ioctl(fd, op, arg uintptr) {
@@ -17,71 +18,60 @@ func ioctl(fd, op, arg uintptr) {
 	}
 }
 
-func opDeviceRead(driver BuseInterface, fp *os.File, chunk []byte, request *nbdRequest, reply *nbdReply) error {
+func opDeviceRead(driver BuseInterface, chunk []byte, request *nbdRequest, reply *nbdReply) error {
 	if err := driver.ReadAt(chunk, uint(request.From)); err != nil {
 		log.Println("buseDriver.ReadAt returned an error:", err)
-		// Reply with an EPERM
-		reply.Error = 5
-	}
-	buf := writeNbdReply(reply)
-	if _, err := fp.Write(buf); err != nil {
-		log.Println("Write error, when sending reply header:", err)
-	}
-	if _, err := fp.Write(chunk); err != nil {
-		log.Println("Write error, when sending data chunk:", err)
+		// Reply with an EIO
+		reply.Error = NBD_EIO
 	}
 	return nil
 }
 
-func opDeviceWrite(driver BuseInterface, fp *os.File, chunk []byte, request *nbdRequest, reply *nbdReply) error {
-	if _, err := io.ReadFull(fp, chunk); err != nil {
-		return fmt.Errorf("Fatal error, cannot read request packet: %s", err)
-	}
+func opDeviceWrite(driver BuseInterface, chunk []byte, request *nbdRequest, reply *nbdReply) error {
 	if err := driver.WriteAt(chunk, uint(request.From)); err != nil {
 		log.Println("buseDriver.WriteAt returned an error:", err)
 		reply.Error = 1
 	}
-	buf := writeNbdReply(reply)
-	if _, err := fp.Write(buf); err != nil {
-		log.Println("Write error, when sending reply header:", err)
-	}
 	return nil
 }
 
-func opDeviceDisconnect(driver BuseInterface, fp *os.File, chunk []byte, request *nbdRequest, reply *nbdReply) error {
+func opDeviceDisconnect(driver BuseInterface, chunk []byte, request *nbdRequest, reply *nbdReply) error {
 	log.Println("Calling buseDriver.Disconnect()")
 	driver.Disconnect()
 	return fmt.Errorf("Received a disconnect")
 }
 
-func opDeviceFlush(driver BuseInterface, fp *os.File, chunk []byte, request *nbdRequest, reply *nbdReply) error {
+func opDeviceFlush(driver BuseInterface, chunk []byte, request *nbdRequest, reply *nbdReply) error {
 	if err := driver.Flush(); err != nil {
 		log.Println("buseDriver.Flush returned an error:", err)
 		reply.Error = 1
 	}
-	buf := writeNbdReply(reply)
-	if _, err := fp.Write(buf); err != nil {
-		log.Println("Write error, when sending reply header:", err)
-	}
 	return nil
 }
 
-func opDeviceTrim(driver BuseInterface, fp *os.File, chunk []byte, request *nbdRequest, reply *nbdReply) error {
+func opDeviceTrim(driver BuseInterface, chunk []byte, request *nbdRequest, reply *nbdReply) error {
 	if err := driver.Trim(uint(request.From), uint(request.Length)); err != nil {
 		log.Println("buseDriver.Flush returned an error:", err)
 		reply.Error = 1
 	}
-	buf := writeNbdReply(reply)
-	if _, err := fp.Write(buf); err != nil {
-		log.Println("Write error, when sending reply header:", err)
-	}
 	return nil
 }
 
+// Request handlers for READ, WRITE, DISC, FLUSH, TRIM
+func defaultOps() [5]nbdOp {
+	var op [5]nbdOp
+	op[NBD_CMD_READ] = opDeviceRead
+	op[NBD_CMD_WRITE] = opDeviceWrite
+	op[NBD_CMD_DISC] = opDeviceDisconnect
+	op[NBD_CMD_FLUSH] = opDeviceFlush
+	op[NBD_CMD_TRIM] = opDeviceTrim
+	return op
+}
+
 func (bd *BuseDevice) startNBDClient() {
 	ioctl(bd.deviceFp.Fd(), NBD_SET_SOCK, uintptr(bd.socketPair[1]))
 	// The call below may fail on some systems (if flags unset), could be ignored
-	ioctl(bd.deviceFp.Fd(), NBD_SET_FLAGS, NBD_FLAG_SEND_TRIM)
+	ioctl(bd.deviceFp.Fd(), NBD_SET_FLAGS, bd.driver.Capabilities().nbdFlags())
 	// The following call will block until the client disconnects
 	log.Println("Starting NBD client...")
 	go ioctl(bd.deviceFp.Fd(), NBD_DO_IT, 0)
@@ -131,38 +121,15 @@ func (bd *BuseDevice) Connect() error {
 		return fmt.Errorf("Cannot reach the device %s: %s", bd.device, err)
 	}
 	tmp.Close()
-	// Start handling requests
-	request := nbdRequest{}
-	reply := nbdReply{Magic: NBD_REPLY_MAGIC}
 	fp := os.NewFile(uintptr(bd.socketPair[0]), "unix")
-	// NOTE: a struct in go has 4 extra bytes...
-	buf := make([]byte, unsafe.Sizeof(request))
-	for true {
-		if _, err := fp.Read(buf[0:28]); err != nil {
-			return fmt.Errorf("NBD client stopped: %s", err)
-		}
-		readNbdRequest(buf, &request)
-		fmt.Printf("DEBUG %#v\n", request)
-		if request.Magic != NBD_REQUEST_MAGIC {
-			return fmt.Errorf("Fatal error: received packet with wrong Magic number")
-		}
-		reply.Handle = request.Handle
-		chunk := make([]byte, request.Length)
-		reply.Error = 0
-		// Dispatches READ, WRITE, DISC, FLUSH, TRIM to the corresponding implementation
-		if request.Type < NBD_CMD_READ || request.Type > NBD_CMD_TRIM {
-			log.Println("Received unknown request:", request.Type)
-			continue
-		}
-		if err := bd.op[request.Type](bd.driver, fp, chunk, &request, &reply); err != nil {
-			return err
-		}
-	}
-	return nil
+	queue := newHardwareQueue(bd.driver, bd.op, bd.geometry)
+	defer queue.Close()
+	return handleRequests(queue, fp, bd.size)
 }
 
-func CreateDevice(device string, size uint, buseDriver BuseInterface) (*BuseDevice, error) {
-	buseDevice := &BuseDevice{size: size, device: device, driver: buseDriver}
+func CreateDevice(device string, geometry proto.Geometry, buseDriver BuseInterface) (*BuseDevice, error) {
+	size := geometry.Size()
+	buseDevice := &BuseDevice{size: size, geometry: geometry, device: device, driver: buseDriver}
 	sockPair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
 	if err != nil {
 		return nil, fmt.Errorf("Call to socketpair failed: %s", err)
@@ -177,11 +144,7 @@ func CreateDevice(device string, size uint, buseDriver BuseInterface) (*BuseDevi
 	ioctl(buseDevice.deviceFp.Fd(), NBD_CLEAR_QUE, 0)
 	ioctl(buseDevice.deviceFp.Fd(), NBD_CLEAR_SOCK, 0)
 	buseDevice.socketPair = sockPair
-	buseDevice.op[NBD_CMD_READ] = opDeviceRead
-	buseDevice.op[NBD_CMD_WRITE] = opDeviceWrite
-	buseDevice.op[NBD_CMD_DISC] = opDeviceDisconnect
-	buseDevice.op[NBD_CMD_FLUSH] = opDeviceFlush
-	buseDevice.op[NBD_CMD_TRIM] = opDeviceTrim
+	buseDevice.op = defaultOps()
 	buseDevice.disconnect = make(chan int, 5)
 	return buseDevice, nil
 }
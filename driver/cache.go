@@ -0,0 +1,212 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"sync"
+
+	"floppy_arduino/proto"
+)
+
+// CacheStats counts sectors served by a SectorCache
+type CacheStats struct {
+	Hits       uint // Sectors served from the cache
+	Misses     uint // Sectors read from the backend on request
+	Prefetched uint // Sectors read ahead from the rest of the track
+	Evictions  uint // Sectors dropped to make room
+}
+
+type cacheEntry struct {
+	lba  uint
+	data []byte
+}
+
+// SectorCache is an LRU sector cache in front of another BuseInterface.
+// On a miss it reads the rest of the track, since the head is already there.
+// Writes go straight through to the backend.
+type SectorCache struct {
+	backend  BuseInterface
+	size     uint
+	prefetch bool
+	geometry proto.Geometry
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[uint]*list.Element
+	stats   CacheStats
+}
+
+// NewSectorCache creates a cache holding up to size sectors of a disk
+// with the given geometry
+func NewSectorCache(backend BuseInterface, size uint, prefetch bool, geometry proto.Geometry) *SectorCache {
+	return &SectorCache{
+		backend:  backend,
+		size:     size,
+		prefetch: prefetch,
+		geometry: geometry,
+		lru:      list.New(),
+		entries:  make(map[uint]*list.Element),
+	}
+}
+
+// Stats returns the hit/miss counters
+func (c *SectorCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+// Invalidate drops every cached sector, e.g. after the disk was changed
+func (c *SectorCache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Init()
+	clear(c.entries)
+}
+
+// First block after the track lba is on
+func (c *SectorCache) track_end(lba uint) uint {
+	sectors := uint(c.geometry.Sectors)
+	return min(lba-lba%sectors+sectors, c.geometry.Blocks())
+}
+
+func (c *SectorCache) get(lba uint) ([]byte, bool) {
+	elem, ok := c.entries[lba]
+	if !ok {
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).data, true
+}
+
+func (c *SectorCache) put(lba uint, data []byte) {
+	if c.size == 0 {
+		return
+	}
+
+	if elem, ok := c.entries[lba]; ok {
+		copy(elem.Value.(*cacheEntry).data, data)
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	// Make room
+	for uint(c.lru.Len()) >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).lba)
+		c.stats.Evictions++
+	}
+
+	entry := &cacheEntry{lba: lba, data: make([]byte, SECTOR_SIZE)}
+	copy(entry.data, data)
+	c.entries[lba] = c.lru.PushFront(entry)
+}
+
+func (c *SectorCache) ReadAt(p []byte, off uint) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	first := off / SECTOR_SIZE
+	last := first + uint(len(p))/SECTOR_SIZE
+
+	for lba := first; lba < last; {
+
+		// Hit
+		if data, ok := c.get(lba); ok {
+			copy(p[(lba-first)*SECTOR_SIZE:], data)
+			c.stats.Hits++
+			lba++
+			continue
+		}
+
+		// Miss: find the run of missing sectors in the request
+		end := lba + 1
+		for end < last {
+			if _, ok := c.entries[end]; ok {
+				break
+			}
+			end++
+		}
+
+		// Read up to the end of the track as well
+		fetch_end := end
+		if c.prefetch {
+			fetch_end = max(end, c.track_end(lba))
+		}
+
+		buf := make([]byte, (fetch_end-lba)*SECTOR_SIZE)
+		err := c.backend.ReadAt(buf, lba*SECTOR_SIZE)
+
+		// The rest of the track may be unreadable, retry with only what
+		// was asked for
+		if err != nil && fetch_end > end {
+			fetch_end = end
+			buf = buf[:(fetch_end-lba)*SECTOR_SIZE]
+			err = c.backend.ReadAt(buf, lba*SECTOR_SIZE)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		for i := lba; i < fetch_end; i++ {
+			c.put(i, buf[(i-lba)*SECTOR_SIZE:(i-lba+1)*SECTOR_SIZE])
+		}
+
+		copy(p[(lba-first)*SECTOR_SIZE:], buf[:(end-lba)*SECTOR_SIZE])
+		c.stats.Misses += end - lba
+		c.stats.Prefetched += fetch_end - end
+
+		lba = end
+	}
+
+	return nil
+}
+
+func (c *SectorCache) WriteAt(p []byte, off uint) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	first := off / SECTOR_SIZE
+	last := first + uint(len(p))/SECTOR_SIZE
+
+	err := c.backend.WriteAt(p, off)
+
+	for lba := first; lba < last; lba++ {
+		if err != nil {
+			// Contents on disk are unknown
+			if elem, ok := c.entries[lba]; ok {
+				c.lru.Remove(elem)
+				delete(c.entries, lba)
+			}
+			continue
+		}
+
+		c.put(lba, p[(lba-first)*SECTOR_SIZE:(lba-first+1)*SECTOR_SIZE])
+	}
+
+	return err
+}
+
+func (c *SectorCache) Disconnect() {
+	stats := c.Stats()
+	log.Printf("[SectorCache] %d hits, %d misses, %d prefetched, %d evictions\n", stats.Hits, stats.Misses, stats.Prefetched, stats.Evictions)
+
+	c.backend.Disconnect()
+}
+
+func (c *SectorCache) Flush() error {
+	return c.backend.Flush()
+}
+
+func (c *SectorCache) Trim(off, length uint) error {
+	return c.backend.Trim(off, length)
+}
+
+func (c *SectorCache) Capabilities() BuseCapabilities {
+	return c.backend.Capabilities()
+}
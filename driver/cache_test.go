@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+// Backend serving an in-memory image, counting sectors read
+type memoryBackend struct {
+	image      []byte
+	reads      uint
+	read_calls uint
+	bad_lba    int
+}
+
+func (m *memoryBackend) ReadAt(p []byte, off uint) error {
+	m.read_calls++
+	first := int(off / SECTOR_SIZE)
+	if m.bad_lba >= first && m.bad_lba < first+len(p)/int(SECTOR_SIZE) {
+		return errors.New("read error")
+	}
+	m.reads += uint(len(p)) / SECTOR_SIZE
+	copy(p, m.image[off:])
+	return nil
+}
+
+func (m *memoryBackend) WriteAt(p []byte, off uint) error {
+	copy(m.image[off:], p)
+	return nil
+}
+
+func (m *memoryBackend) Disconnect()                    {}
+func (m *memoryBackend) Flush() error                   { return nil }
+func (m *memoryBackend) Trim(off, length uint) error    { return nil }
+func (m *memoryBackend) Capabilities() BuseCapabilities { return BuseCapabilities{} }
+
+func TestSectorCachePrefetch(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	backend := &memoryBackend{image: bytes.Clone(image), bad_lba: -1}
+	cache := NewSectorCache(backend, 100, true, proto.FORMAT_1440K)
+
+	p := make([]byte, 1024)
+
+	// Miss on sectors 3-4 reads the rest of track 0
+	if err := cache.ReadAt(p, 512*3); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, image[512*3:512*5]) {
+		t.Error("data differs from backend")
+	}
+	if backend.reads != 15 {
+		t.Errorf("backend read %d sectors, want 15", backend.reads)
+	}
+
+	// Rest of the track comes from the cache
+	if err := cache.ReadAt(p, 512*16); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, image[512*16:512*18]) {
+		t.Error("data differs from backend")
+	}
+	if backend.reads != 15 {
+		t.Errorf("backend read %d sectors, want 15", backend.reads)
+	}
+
+	stats := cache.Stats()
+	if stats != (CacheStats{Hits: 2, Misses: 2, Prefetched: 13}) {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestSectorCacheBadPrefetch(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	backend := &memoryBackend{image: bytes.Clone(image), bad_lba: 10}
+	cache := NewSectorCache(backend, 100, true, proto.FORMAT_1440K)
+
+	p := make([]byte, 512)
+
+	if err := cache.ReadAt(p, 512*2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, image[512*2:512*3]) {
+		t.Error("data differs from backend")
+	}
+}
+
+func TestSectorCacheEviction(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	backend := &memoryBackend{image: bytes.Clone(image), bad_lba: -1}
+	cache := NewSectorCache(backend, 4, false, proto.FORMAT_1440K)
+
+	p := make([]byte, 512)
+
+	for _, lba := range []uint{1, 2, 3, 4, 1, 5, 2} {
+		if err := cache.ReadAt(p, 512*lba); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 2 was the least recently used when 5 was read
+	stats := cache.Stats()
+	if stats != (CacheStats{Hits: 1, Misses: 6, Evictions: 2}) {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestSectorCacheWriteInvalidate(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	backend := &memoryBackend{image: bytes.Clone(image), bad_lba: -1}
+	cache := NewSectorCache(backend, 100, true, proto.FORMAT_1440K)
+
+	p := make([]byte, 512)
+	data := bytes.Repeat([]byte{0xAA}, 512)
+
+	cache.ReadAt(p, 0)
+
+	// Write through updates the cached copy
+	if err := cache.WriteAt(data, 512*5); err != nil {
+		t.Fatal(err)
+	}
+	cache.ReadAt(p, 512*5)
+	if !bytes.Equal(p, data) || !bytes.Equal(backend.image[512*5:512*6], data) {
+		t.Error("write not visible")
+	}
+
+	// Disk changed behind our back
+	copy(backend.image[512*6:], data)
+	cache.Invalidate()
+	cache.ReadAt(p, 512*6)
+	if !bytes.Equal(p, data) {
+		t.Error("stale data after invalidation")
+	}
+}
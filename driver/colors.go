@@ -53,3 +53,7 @@ const (
 func PrtCol(msg string, color Color) {
 	fmt.Printf("%s%s%s", color, msg, ColorReset)
 }
+
+func FmtCol(msg string, color Color) string {
+	return fmt.Sprintf("%s%s%s", color, msg, ColorReset)
+}
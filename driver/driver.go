@@ -1,18 +1,21 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
 
-	"github.com/albenik/go-serial"
+	"floppy_arduino/proto"
 )
 
 type DeviceExample struct {
-	port    serial.Port
-	dataset []byte
+	client   *proto.Client
+	retries  uint
+	writable bool
 }
 
 func (d *DeviceExample) ReadAt(p []byte, off uint) error {
@@ -22,7 +25,7 @@ func (d *DeviceExample) ReadAt(p []byte, off uint) error {
 	blocks_to_read := uint(len(p) / int(SECTOR_SIZE))
 	start_block := off / SECTOR_SIZE
 
-	data, err := read_blocks(d.port, start_block, start_block+blocks_to_read-1, 5, false)
+	data, _, err := read_blocks(context.Background(), d.client, start_block, start_block+blocks_to_read-1, d.retries, false, nil)
 
 	if err != nil {
 		return errors.New("read error")
@@ -35,10 +38,20 @@ func (d *DeviceExample) ReadAt(p []byte, off uint) error {
 }
 
 func (d *DeviceExample) WriteAt(p []byte, off uint) error {
-	// copy(d.dataset[off:], p)
-	// log.Printf("[DeviceExample] WRITE offset:%d len:%d\n", off, len(p))
-	// return nil
-	return errors.New("write not supported")
+
+	log.Printf("[DeviceExample] WRITE offset:%d len:%d\n", off, len(p))
+
+	if !d.writable {
+		return errors.New("write not supported")
+	}
+
+	err := write_blocks(context.Background(), d.client, off/SECTOR_SIZE, p, d.retries)
+
+	if err != nil {
+		return fmt.Errorf("write error: %w", err)
+	}
+
+	return nil
 }
 
 func (d *DeviceExample) Disconnect() {
@@ -55,6 +68,12 @@ func (d *DeviceExample) Trim(off, length uint) error {
 	return nil
 }
 
+func (d *DeviceExample) Capabilities() BuseCapabilities {
+	// The firmware can't write formats other than its own
+	writable := d.writable && d.client.Geometry() == proto.FIRMWARE_GEOMETRY
+	return BuseCapabilities{ReadOnly: !writable, Flush: true}
+}
+
 func main() {
 	// Parse arguments
 	conf, conf_res := parse_args()
@@ -68,13 +87,14 @@ func main() {
 	}
 
 	var err error
-	var port serial.Port
-	var name string
+	var client *proto.Client
+
+	ctx := context.Background()
 
 	// Connection to arduino
 	if !conf.device.has_value {
 		fmt.Println("Trying to find Arduino...")
-		port, name, err = find_arduino()
+		client, err = proto.Find(ctx, proto.RESET_DELAY)
 		if err != nil {
 			PrtCol("Error: ", ColorRedHI)
 			fmt.Println("unable to find Arduino")
@@ -82,37 +102,158 @@ func main() {
 		}
 	} else {
 		fmt.Println("Connecting to Arduino...")
-		port, err = connect_and_handshake(conf.device.value)
+		client, err = proto.Open(ctx, conf.device.value, proto.RESET_DELAY)
 		if err != nil {
 			PrtCol("Error: ", ColorRedHI)
 			fmt.Printf("unable to connect to Arduino on port %s: %s\n", conf.device.value, err)
 			os.Exit(1)
 		}
-		name = conf.device.value
 	}
 
 	PrtCol("Connected ", ColorGreenHI)
-	fmt.Printf("on port %s\n", name)
+	fmt.Printf("on port %s\n", client.Name())
 
 	// Initialize drive
-	err = do_initialize(port)
+	err = client.Initialize(ctx)
 
 	if err != nil {
 		PrtCol("Error: ", ColorRedHI)
 		fmt.Println("drive initalization failed!")
-		port.Close()
+		client.Close()
 		os.Exit(2)
 	}
 
-	size := uint(512 * 2880) // 512M
+	// Disk format, detected unless given
+	if conf.format.has_value {
+		client.SetGeometry(conf.format.value)
+	} else {
+		geometry, from_bpb, err := client.DetectFormat(ctx)
+
+		if err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("unable to detect disk format: %s, try --format\n", err)
+			client.Close()
+			os.Exit(2)
+		}
+
+		client.SetGeometry(geometry)
+
+		if from_bpb {
+			fmt.Printf("Detected %s disk from boot sector\n", geometry)
+		} else {
+			fmt.Printf("Detected %s disk from sectors on track 0\n", geometry)
+		}
+	}
+
+	// Better to find out now than on the first write
+	if conf.write {
+		capabilities, err := client.Capabilities(ctx)
+
+		if err == nil && capabilities&proto.CAP_WRITE == 0 {
+			err = proto.ErrWriteUnsupported
+		}
+
+		if err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("unable to enable writes: %s\n", err)
+			client.Close()
+			os.Exit(1)
+		}
+	}
+
+	// Size of the nbd device follows the disk
+	geometry := client.Geometry()
+
+	fmt.Printf("Serving %d sectors\n", geometry.Blocks())
+
 	deviceExp := &DeviceExample{}
-	deviceExp.port = port
-	device, err := CreateDevice(conf.nbd_device.value, size, deviceExp)
+	deviceExp.client = client
+	deviceExp.retries = conf.max_retries.value
+	deviceExp.writable = conf.write
+
+	var backend BuseInterface = deviceExp
+
+	// Read whole disk in memory
+	if conf.preload {
+		fmt.Println("Preloading disk...")
+
+		preloaded, err := preload(ctx, deviceExp)
+
+		if err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("preload failed: %s\n", err)
+			client.Close()
+			os.Exit(3)
+		}
+
+		fmt.Printf("%d unreadable %s\n", preloaded.BadSectors(), FmtCol("sectors", ColorRedHI))
+
+		backend = preloaded
+	}
+
+	// Put sector cache in front of the drive
+	var cache *SectorCache
+	cache_size := geometry.Blocks()
+	if conf.cache_size.has_value {
+		cache_size = conf.cache_size.value
+	}
+	if cache_size > 0 && !conf.preload {
+		cache = NewSectorCache(deviceExp, cache_size, !conf.no_prefetch, geometry)
+		backend = cache
+	}
+
+	// SIGHUP drops cached sectors after a disk change
+	if cache != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				log.Println("SIGHUP, invalidating sector cache")
+				cache.Invalidate()
+			}
+		}()
+	}
+
+	// Serve over the network instead of a local nbd device
+	if conf.listen.has_value {
+		server := NewNbdServer(NbdExport{
+			Name:        conf.export.value,
+			Description: fmt.Sprintf("Floppy on %s", client.Name()),
+			Geometry:    geometry,
+			Driver:      backend,
+		})
+
+		if err := server.Listen(conf.listen.value); err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("unable to listen on %s: %s\n", conf.listen.value, err)
+			client.Close()
+			os.Exit(1)
+		}
+
+		PrtCol("Listening ", ColorGreenHI)
+		fmt.Printf("on %s, export \"%s\"\n", server.Addr(), conf.export.value)
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt)
+		go func() {
+			<-sig
+			fmt.Println("SIGINT, closing server...")
+			server.Close()
+		}()
+
+		if err := server.Serve(); err != nil {
+			log.Printf("NBD server stopped with error: %s", err)
+		}
+		client.Close()
+		return
+	}
+
+	device, err := CreateDevice(conf.nbd_device.value, geometry, backend)
 	if err != nil {
 		fmt.Printf("Cannot create device: %s\n", err)
 		os.Exit(1)
 	}
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
 	go func() {
 		if err := device.Connect(); err != nil {
@@ -121,10 +262,11 @@ func main() {
 			log.Println("Buse device stopped gracefully.")
 		}
 	}()
+
 	<-sig
 
 	// Received SIGTERM, cleanup
 	fmt.Println("SIGINT, disconnecting...")
 	device.Disconnect()
-	port.Close()
+	client.Close()
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+func TestReadAt(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	device := &DeviceExample{client: emulatortest.StartClient(t, image, proto.FORMAT_1440K, nil)}
+
+	tests := []struct {
+		off    uint
+		length uint
+	}{
+		{0, 512},
+		{0, 4096},
+		{512 * 17, 1024},
+		{512 * 1000, 512 * 7},
+		{512 * (proto.FORMAT_1440K.Blocks() - 4), 2048},
+	}
+
+	for _, test := range tests {
+		p := make([]byte, test.length)
+
+		if err := device.ReadAt(p, test.off); err != nil {
+			t.Errorf("ReadAt(%d, %d): %s", test.off, test.length, err)
+			continue
+		}
+
+		if !bytes.Equal(p, image[test.off:test.off+test.length]) {
+			t.Errorf("ReadAt(%d, %d): data differs from disk", test.off, test.length)
+		}
+	}
+}
+
+func TestReadAtFormat(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_720K)
+	device := &DeviceExample{client: emulatortest.StartClient(t, image, proto.FORMAT_720K, nil), writable: true}
+
+	// Crosses from track 0 head 1 to track 1
+	p := make([]byte, 512*6)
+
+	if err := device.ReadAt(p, 512*15); err != nil {
+		t.Fatalf("ReadAt: %s", err)
+	}
+	if !bytes.Equal(p, image[512*15:512*21]) {
+		t.Error("data differs from disk")
+	}
+
+	if err := device.WriteAt(p, 0); err == nil {
+		t.Error("expected write error on 720K disk")
+	}
+}
+
+func TestReadAtError(t *testing.T) {
+	lba := uint(20)
+	ec := emulator.CRC
+	profile := &emulator.Profile{
+		Sectors: []emulator.SectorFault{{LBA: &lba, Error: &ec}},
+	}
+	device := &DeviceExample{client: emulatortest.StartClient(t, emulatortest.RandomImage(proto.FORMAT_1440K), proto.FORMAT_1440K, profile)}
+
+	p := make([]byte, 4096)
+
+	if err := device.ReadAt(p, 512*16); err == nil {
+		t.Error("expected read error")
+	}
+	if err := device.ReadAt(p, 512*21); err != nil {
+		t.Errorf("ReadAt: %s", err)
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	device := &DeviceExample{client: emulatortest.StartClient(t, image, proto.FORMAT_1440K, nil), retries: 2, writable: true}
+
+	data := make([]byte, 512*7)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	if err := device.WriteAt(data, 512*34); err != nil {
+		t.Fatalf("WriteAt: %s", err)
+	}
+
+	// Written blocks and their neighbours
+	want := bytes.Clone(image[512*33 : 512*42])
+	copy(want[512:], data)
+
+	p := make([]byte, len(want))
+
+	if err := device.ReadAt(p, 512*33); err != nil {
+		t.Fatalf("ReadAt: %s", err)
+	}
+	if !bytes.Equal(p, want) {
+		t.Error("data read back differs from data written")
+	}
+}
+
+func TestWriteAtError(t *testing.T) {
+	lba := uint(36)
+	ec := emulator.SECTOR_NOT_FOUND
+	profile := &emulator.Profile{
+		Sectors: []emulator.SectorFault{{LBA: &lba, Error: &ec}},
+	}
+	client := emulatortest.StartClient(t, emulatortest.RandomImage(proto.FORMAT_1440K), proto.FORMAT_1440K, profile)
+
+	p := make([]byte, 1024)
+
+	device := &DeviceExample{client: client, retries: 1, writable: true}
+	if err := device.WriteAt(p, 512*35); err == nil {
+		t.Error("expected write error")
+	}
+
+	device = &DeviceExample{client: client}
+	if err := device.WriteAt(p, 0); err == nil {
+		t.Error("expected write error on read-only device")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	client := proto.NewClient(nil, "")
+	other_format := proto.NewClient(nil, "")
+	other_format.SetGeometry(proto.FORMAT_720K)
+
+	tests := []struct {
+		device DeviceExample
+		flags  uintptr
+	}{
+		{DeviceExample{client: client}, NBD_FLAG_HAS_FLAGS | NBD_FLAG_READ_ONLY | NBD_FLAG_SEND_FLUSH},
+		{DeviceExample{client: client, writable: true}, NBD_FLAG_HAS_FLAGS | NBD_FLAG_SEND_FLUSH},
+		{DeviceExample{client: other_format, writable: true}, NBD_FLAG_HAS_FLAGS | NBD_FLAG_READ_ONLY | NBD_FLAG_SEND_FLUSH},
+	}
+
+	for _, test := range tests {
+		if flags := test.device.Capabilities().nbdFlags(); flags != test.flags {
+			t.Errorf("writable=%t, format %s: flags = %#x, want %#x", test.device.writable, test.device.client.Geometry().Name, flags, test.flags)
+		}
+	}
+
+	write_protected := BuseCapabilities{WriteProtected: true, Trim: true}
+	if flags := write_protected.nbdFlags(); flags != NBD_FLAG_HAS_FLAGS|NBD_FLAG_READ_ONLY|NBD_FLAG_SEND_TRIM {
+		t.Errorf("write protected: flags = %#x", flags)
+	}
+}
+
+func TestPreload(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	lba := uint(100)
+	ec := emulator.CRC
+	profile := &emulator.Profile{
+		Sectors: []emulator.SectorFault{{LBA: &lba, Error: &ec}},
+	}
+	backend := &DeviceExample{client: emulatortest.StartClient(t, image, proto.FORMAT_1440K, profile), retries: 1, writable: true}
+
+	device, err := preload(context.Background(), backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if device.BadSectors() != 1 {
+		t.Errorf("%d bad sectors, want 1", device.BadSectors())
+	}
+
+	p := make([]byte, 4096)
+
+	if err := device.ReadAt(p, 512*98); err == nil {
+		t.Error("expected read error")
+	}
+	if err := device.ReadAt(p, 512*101); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, image[512*101:512*109]) {
+		t.Error("data differs from disk")
+	}
+
+	// Overwritten sector is good again
+	if err := device.WriteAt(p[:512], 512*100); err != nil {
+		t.Fatal(err)
+	}
+	if device.BadSectors() != 0 {
+		t.Errorf("%d bad sectors, want 0", device.BadSectors())
+	}
+}
@@ -2,11 +2,17 @@ module floppy_arduino/driver
 
 go 1.21.5
 
-require github.com/albenik/go-serial v1.2.0
+require (
+	floppy_arduino/proto v0.0.0
+	golang.org/x/term v0.15.0
+)
 
 require (
+	github.com/albenik/go-serial v1.2.0 // indirect
 	github.com/creack/goselect v0.1.0 // indirect
 	go.uber.org/atomic v1.4.0 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
-	golang.org/x/sys v0.0.0-20190712062909-fae7ac547cb7 // indirect
+	golang.org/x/sys v0.15.0 // indirect
 )
+
+replace floppy_arduino/proto => ../proto
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"floppy_arduino/proto"
+)
+
+// NbdExport is a backend offered to remote clients under a name
+type NbdExport struct {
+	Name        string
+	Description string
+	Geometry    proto.Geometry
+	Driver      BuseInterface
+}
+
+// NbdServer serves exports over a socket using the NBD fixed newstyle
+// protocol, so that nbd-client or QEMU can attach from another machine.
+type NbdServer struct {
+	exports  []NbdExport
+	queues   map[*NbdExport]*hardwareQueue
+	listener net.Listener
+
+	mu       sync.Mutex
+	conns    map[net.Conn]bool
+	handlers sync.WaitGroup
+}
+
+var errAbort = errors.New("Client aborted negotiation")
+
+// NewNbdServer creates a server for the given exports.
+// The first one is used when a client asks for the default (empty) name.
+func NewNbdServer(exports ...NbdExport) *NbdServer {
+	s := &NbdServer{
+		exports: exports,
+		queues:  make(map[*NbdExport]*hardwareQueue),
+		conns:   make(map[net.Conn]bool),
+	}
+	// Clients of the same export share its hardware queue
+	for i := range s.exports {
+		s.queues[&s.exports[i]] = newHardwareQueue(s.exports[i].Driver, defaultOps(), s.exports[i].Geometry)
+	}
+	return s
+}
+
+// Listen opens the socket at addr: "unix:/path" for a Unix socket,
+// anything else is a TCP address, on port 10809 if none is given
+func (s *NbdServer) Listen(addr string) error {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network = "unix"
+		addr = path
+	} else if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(NBD_DEFAULT_PORT))
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	return nil
+}
+
+// Addr returns the address the server is listening on
+func (s *NbdServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts clients until the server is closed
+func (s *NbdServer) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.handlers.Add(1)
+		s.mu.Unlock()
+		go s.handleConn(conn)
+	}
+}
+
+// Close stops accepting clients, drops the connected ones and waits for
+// their requests to finish
+func (s *NbdServer) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.handlers.Wait()
+	for _, queue := range s.queues {
+		queue.Close()
+	}
+	return err
+}
+
+func (s *NbdServer) handleConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.handlers.Done()
+	}()
+	log.Println("NBD client connected from", conn.RemoteAddr())
+	export, err := s.negotiate(conn)
+	if err != nil {
+		log.Println("NBD negotiation failed:", err)
+		return
+	}
+	log.Printf("NBD client attached to export \"%s\"\n", export.Name)
+	if err := handleRequests(s.queues[export], conn, export.Geometry.Size()); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *NbdServer) findExport(name string) *NbdExport {
+	if name == "" && len(s.exports) > 0 {
+		return &s.exports[0]
+	}
+	for i := range s.exports {
+		if s.exports[i].Name == name {
+			return &s.exports[i]
+		}
+	}
+	return nil
+}
+
+// negotiate runs the handshake and option haggling phase and returns the
+// export the client chose to enter transmission with
+func (s *NbdServer) negotiate(fp io.ReadWriter) (*NbdExport, error) {
+	buf := make([]byte, 18)
+	binary.BigEndian.PutUint64(buf[0:8], NBD_INIT_MAGIC)
+	binary.BigEndian.PutUint64(buf[8:16], NBD_OPTS_MAGIC)
+	binary.BigEndian.PutUint16(buf[16:18], NBD_FLAG_FIXED_NEWSTYLE|NBD_FLAG_NO_ZEROES)
+	if _, err := fp.Write(buf); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(fp, buf[0:4]); err != nil {
+		return nil, err
+	}
+	clientFlags := binary.BigEndian.Uint32(buf[0:4])
+	if clientFlags&NBD_FLAG_C_FIXED_NEWSTYLE == 0 {
+		return nil, fmt.Errorf("Client does not support fixed newstyle negotiation")
+	}
+	noZeroes := clientFlags&NBD_FLAG_C_NO_ZEROES != 0
+
+	for {
+		// Option header: magic, option, length
+		if _, err := io.ReadFull(fp, buf[0:16]); err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint64(buf[0:8]) != NBD_OPTS_MAGIC {
+			return nil, fmt.Errorf("Fatal error: received option with wrong Magic number")
+		}
+		option := binary.BigEndian.Uint32(buf[8:12])
+		length := binary.BigEndian.Uint32(buf[12:16])
+		if length > NBD_MAX_OPTION_SIZE {
+			return nil, fmt.Errorf("Option %d too long: %d bytes", option, length)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(fp, data); err != nil {
+			return nil, err
+		}
+
+		switch option {
+		case NBD_OPT_EXPORT_NAME:
+			// No way to report an error here, just hang up
+			export := s.findExport(string(data))
+			if export == nil {
+				return nil, fmt.Errorf("Unknown export \"%s\"", data)
+			}
+			reply := make([]byte, 10, 10+124)
+			binary.BigEndian.PutUint64(reply[0:8], uint64(export.Geometry.Size()))
+			binary.BigEndian.PutUint16(reply[8:10], uint16(export.Driver.Capabilities().nbdFlags()))
+			if !noZeroes {
+				reply = reply[:10+124]
+			}
+			if _, err := fp.Write(reply); err != nil {
+				return nil, err
+			}
+			return export, nil
+
+		case NBD_OPT_ABORT:
+			writeOptionReply(fp, option, NBD_REP_ACK, nil)
+			return nil, errAbort
+
+		case NBD_OPT_LIST:
+			if length != 0 {
+				if err := writeOptionReply(fp, option, NBD_REP_ERR_INVALID, []byte("LIST takes no data")); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			for _, export := range s.exports {
+				entry := make([]byte, 4+len(export.Name))
+				binary.BigEndian.PutUint32(entry[0:4], uint32(len(export.Name)))
+				copy(entry[4:], export.Name)
+				if err := writeOptionReply(fp, option, NBD_REP_SERVER, entry); err != nil {
+					return nil, err
+				}
+			}
+			if err := writeOptionReply(fp, option, NBD_REP_ACK, nil); err != nil {
+				return nil, err
+			}
+
+		case NBD_OPT_INFO, NBD_OPT_GO:
+			export, err := s.optionInfo(fp, option, data)
+			if err != nil {
+				return nil, err
+			}
+			if export != nil && option == NBD_OPT_GO {
+				return export, nil
+			}
+
+		default:
+			if err := writeOptionReply(fp, option, NBD_REP_ERR_UNSUP, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// optionInfo answers NBD_OPT_INFO and NBD_OPT_GO. It returns the export
+// on success, or nil if an error reply was sent to the client.
+func (s *NbdServer) optionInfo(fp io.Writer, option uint32, data []byte) (*NbdExport, error) {
+	// Name length, name, number of info requests, info requests
+	if len(data) < 6 {
+		return nil, writeOptionReply(fp, option, NBD_REP_ERR_INVALID, []byte("option too short"))
+	}
+	nameLen := binary.BigEndian.Uint32(data[0:4])
+	if uint64(nameLen)+6 > uint64(len(data)) {
+		return nil, writeOptionReply(fp, option, NBD_REP_ERR_INVALID, []byte("bad name length"))
+	}
+	name := string(data[4 : 4+nameLen])
+	nInfo := binary.BigEndian.Uint16(data[4+nameLen : 6+nameLen])
+	infos := data[6+nameLen:]
+	if len(infos) != 2*int(nInfo) {
+		return nil, writeOptionReply(fp, option, NBD_REP_ERR_INVALID, []byte("bad number of info requests"))
+	}
+
+	export := s.findExport(name)
+	if export == nil {
+		return nil, writeOptionReply(fp, option, NBD_REP_ERR_UNKNOWN, []byte(fmt.Sprintf("unknown export \"%s\"", name)))
+	}
+
+	// Clients that don't ask for the block size still get it, as requests
+	// must be whole sectors
+	blockSize := false
+
+	for i := 0; i < len(infos); i += 2 {
+		var info []byte
+		switch binary.BigEndian.Uint16(infos[i:]) {
+		case NBD_INFO_NAME:
+			info = binary.BigEndian.AppendUint16(nil, NBD_INFO_NAME)
+			info = append(info, export.Name...)
+		case NBD_INFO_DESCRIPTION:
+			info = binary.BigEndian.AppendUint16(nil, NBD_INFO_DESCRIPTION)
+			info = append(info, export.Description...)
+		case NBD_INFO_BLOCK_SIZE:
+			info = blockSizeInfo(export)
+			blockSize = true
+		default:
+			continue
+		}
+		if err := writeOptionReply(fp, option, NBD_REP_INFO, info); err != nil {
+			return nil, err
+		}
+	}
+
+	if !blockSize {
+		if err := writeOptionReply(fp, option, NBD_REP_INFO, blockSizeInfo(export)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Size and transmission flags are always sent
+	info := binary.BigEndian.AppendUint16(nil, NBD_INFO_EXPORT)
+	info = binary.BigEndian.AppendUint64(info, uint64(export.Geometry.Size()))
+	info = binary.BigEndian.AppendUint16(info, uint16(export.Driver.Capabilities().nbdFlags()))
+	if err := writeOptionReply(fp, option, NBD_REP_INFO, info); err != nil {
+		return nil, err
+	}
+	if err := writeOptionReply(fp, option, NBD_REP_ACK, nil); err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// Minimum, preferred and maximum block size
+func blockSizeInfo(export *NbdExport) []byte {
+	info := binary.BigEndian.AppendUint16(nil, NBD_INFO_BLOCK_SIZE)
+	info = binary.BigEndian.AppendUint32(info, uint32(SECTOR_SIZE))
+	info = binary.BigEndian.AppendUint32(info, uint32(SECTOR_SIZE))
+	return binary.BigEndian.AppendUint32(info, uint32(export.Geometry.Size()))
+}
+
+func writeOptionReply(fp io.Writer, option uint32, replyType uint32, data []byte) error {
+	buf := make([]byte, 20, 20+len(data))
+	binary.BigEndian.PutUint64(buf[0:8], NBD_REP_MAGIC)
+	binary.BigEndian.PutUint32(buf[8:12], option)
+	binary.BigEndian.PutUint32(buf[12:16], replyType)
+	binary.BigEndian.PutUint32(buf[16:20], uint32(len(data)))
+	_, err := fp.Write(append(buf, data...))
+	return err
+}
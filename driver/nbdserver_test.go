@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"testing"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+// Start a server on a loopback port and connect to it
+func start_nbd_server(t *testing.T, exports ...NbdExport) net.Conn {
+	t.Helper()
+
+	server := NewNbdServer(exports...)
+	if err := server.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// Handshake
+	buf := make([]byte, 18)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint64(buf[0:8]) != NBD_INIT_MAGIC || binary.BigEndian.Uint64(buf[8:16]) != NBD_OPTS_MAGIC {
+		t.Fatalf("bad handshake %x", buf)
+	}
+	if binary.BigEndian.Uint16(buf[16:18]) != NBD_FLAG_FIXED_NEWSTYLE|NBD_FLAG_NO_ZEROES {
+		t.Fatalf("bad handshake flags %x", buf[16:18])
+	}
+	conn.Write(binary.BigEndian.AppendUint32(nil, NBD_FLAG_C_FIXED_NEWSTYLE|NBD_FLAG_C_NO_ZEROES))
+
+	return conn
+}
+
+func send_option(conn net.Conn, option uint32, data []byte) {
+	buf := binary.BigEndian.AppendUint64(nil, NBD_OPTS_MAGIC)
+	buf = binary.BigEndian.AppendUint32(buf, option)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+	conn.Write(append(buf, data...))
+}
+
+// Read an option reply, returning its type and data
+func read_option_reply(t *testing.T, conn net.Conn, option uint32) (uint32, []byte) {
+	t.Helper()
+
+	buf := make([]byte, 20)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint64(buf[0:8]) != NBD_REP_MAGIC || binary.BigEndian.Uint32(buf[8:12]) != option {
+		t.Fatalf("bad option reply %x", buf)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(buf[16:20]))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	return binary.BigEndian.Uint32(buf[12:16]), data
+}
+
+// Data of an NBD_OPT_INFO or NBD_OPT_GO option
+func info_request(name string, infos ...uint16) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(name)))
+	buf = append(buf, name...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(infos)))
+	for _, info := range infos {
+		buf = binary.BigEndian.AppendUint16(buf, info)
+	}
+	return buf
+}
+
+// Send a transmission request, returning the reply error and data
+func send_request(t *testing.T, conn net.Conn, cmd uint32, from uint64, length uint32) (uint32, []byte) {
+	t.Helper()
+
+	buf := binary.BigEndian.AppendUint32(nil, NBD_REQUEST_MAGIC)
+	buf = binary.BigEndian.AppendUint32(buf, cmd)
+	buf = binary.BigEndian.AppendUint64(buf, 42)
+	buf = binary.BigEndian.AppendUint64(buf, from)
+	buf = binary.BigEndian.AppendUint32(buf, length)
+	conn.Write(buf)
+
+	reply := make([]byte, 16)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint32(reply[0:4]) != NBD_REPLY_MAGIC || binary.BigEndian.Uint64(reply[8:16]) != 42 {
+		t.Fatalf("bad reply %x", reply)
+	}
+	reply_error := binary.BigEndian.Uint32(reply[4:8])
+	if reply_error != 0 || cmd != NBD_CMD_READ {
+		return reply_error, nil
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	return 0, data
+}
+
+func TestNbdServerList(t *testing.T) {
+	backend := &memoryBackend{image: emulatortest.RandomImage(proto.FORMAT_1440K), bad_lba: -1}
+	conn := start_nbd_server(t,
+		NbdExport{Name: "floppy", Geometry: proto.FORMAT_1440K, Driver: backend},
+		NbdExport{Name: "other", Geometry: proto.FORMAT_1440K, Driver: backend},
+	)
+
+	send_option(conn, NBD_OPT_LIST, nil)
+
+	var names []string
+	for {
+		reply_type, data := read_option_reply(t, conn, NBD_OPT_LIST)
+		if reply_type == NBD_REP_ACK {
+			break
+		}
+		if reply_type != NBD_REP_SERVER {
+			t.Fatalf("reply type %#x", reply_type)
+		}
+		names = append(names, string(data[4:4+binary.BigEndian.Uint32(data)]))
+	}
+
+	if len(names) != 2 || names[0] != "floppy" || names[1] != "other" {
+		t.Errorf("exports = %q", names)
+	}
+
+	// Unsupported option
+	send_option(conn, 100, nil)
+	if reply_type, _ := read_option_reply(t, conn, 100); reply_type != NBD_REP_ERR_UNSUP {
+		t.Errorf("reply type %#x, want NBD_REP_ERR_UNSUP", reply_type)
+	}
+}
+
+func TestNbdServerGo(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	backend := &memoryBackend{image: bytes.Clone(image), bad_lba: 30}
+	size := proto.FORMAT_1440K.Size()
+	conn := start_nbd_server(t, NbdExport{Name: "floppy", Description: "test", Geometry: proto.FORMAT_1440K, Driver: backend})
+
+	// Unknown export
+	send_option(conn, NBD_OPT_INFO, info_request("nope"))
+	if reply_type, _ := read_option_reply(t, conn, NBD_OPT_INFO); reply_type != NBD_REP_ERR_UNKNOWN {
+		t.Errorf("reply type %#x, want NBD_REP_ERR_UNKNOWN", reply_type)
+	}
+
+	// Block size comes without asking
+	send_option(conn, NBD_OPT_INFO, info_request(""))
+	got_block_size := false
+	for {
+		reply_type, data := read_option_reply(t, conn, NBD_OPT_INFO)
+		if reply_type != NBD_REP_INFO {
+			break
+		}
+		if binary.BigEndian.Uint16(data) == NBD_INFO_BLOCK_SIZE {
+			got_block_size = binary.BigEndian.Uint32(data[2:6]) == uint32(SECTOR_SIZE)
+		}
+	}
+	if !got_block_size {
+		t.Error("no NBD_INFO_BLOCK_SIZE reply")
+	}
+
+	// Default export
+	send_option(conn, NBD_OPT_GO, info_request("", NBD_INFO_DESCRIPTION, NBD_INFO_BLOCK_SIZE))
+
+	got_export := false
+	for {
+		reply_type, data := read_option_reply(t, conn, NBD_OPT_GO)
+		if reply_type == NBD_REP_ACK {
+			break
+		}
+		if reply_type != NBD_REP_INFO {
+			t.Fatalf("reply type %#x", reply_type)
+		}
+		switch binary.BigEndian.Uint16(data) {
+		case NBD_INFO_EXPORT:
+			got_export = true
+			if binary.BigEndian.Uint64(data[2:10]) != uint64(size) {
+				t.Errorf("size = %d", binary.BigEndian.Uint64(data[2:10]))
+			}
+			if binary.BigEndian.Uint16(data[10:12]) != NBD_FLAG_HAS_FLAGS {
+				t.Errorf("flags = %#x", binary.BigEndian.Uint16(data[10:12]))
+			}
+		case NBD_INFO_DESCRIPTION:
+			if string(data[2:]) != "test" {
+				t.Errorf("description = %q", data[2:])
+			}
+		case NBD_INFO_BLOCK_SIZE:
+			if binary.BigEndian.Uint32(data[2:6]) != uint32(SECTOR_SIZE) {
+				t.Errorf("minimum block size = %d", binary.BigEndian.Uint32(data[2:6]))
+			}
+		}
+	}
+	if !got_export {
+		t.Error("no NBD_INFO_EXPORT reply")
+	}
+
+	// Transmission
+	if reply_error, data := send_request(t, conn, NBD_CMD_READ, 512*3, 1024); reply_error != 0 || !bytes.Equal(data, image[512*3:512*5]) {
+		t.Errorf("read: error %d", reply_error)
+	}
+	if reply_error, _ := send_request(t, conn, NBD_CMD_READ, 512*29, 1024); reply_error != NBD_EIO {
+		t.Errorf("read of bad sector: error %d, want EIO", reply_error)
+	}
+	if reply_error, _ := send_request(t, conn, NBD_CMD_READ, uint64(size), 512); reply_error != NBD_EINVAL {
+		t.Errorf("read past end: error %d, want EINVAL", reply_error)
+	}
+	if reply_error, _ := send_request(t, conn, NBD_CMD_READ, math.MaxUint64-511, 1024); reply_error != NBD_EINVAL {
+		t.Errorf("read wrapping around: error %d, want EINVAL", reply_error)
+	}
+	if reply_error, _ := send_request(t, conn, NBD_CMD_READ, 100, 512); reply_error != NBD_EINVAL {
+		t.Errorf("read off a sector boundary: error %d, want EINVAL", reply_error)
+	}
+	if reply_error, _ := send_request(t, conn, NBD_CMD_READ, 512, 100); reply_error != NBD_EINVAL {
+		t.Errorf("read of part of a sector: error %d, want EINVAL", reply_error)
+	}
+
+	// Connection still in sync after the errors
+	if reply_error, data := send_request(t, conn, NBD_CMD_READ, 0, 512); reply_error != 0 || !bytes.Equal(data, image[:512]) {
+		t.Errorf("read: error %d", reply_error)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"unsafe"
+
+	"floppy_arduino/proto"
+)
+
+// Requests waiting for the hardware worker
+const NBD_QUEUE_DEPTH = 64
+
+// Largest read built by joining adjacent read requests
+const MAX_COALESCED_READ uint32 = 128 * 1024
+
+// A request travelling from the socket reader, through the hardware
+// worker, to the reply writer of its connection
+type nbdPending struct {
+	request nbdRequest
+	reply   nbdReply
+	chunk   []byte
+	noReply bool
+	skipped uint
+	replies chan<- *nbdPending
+}
+
+// Request and reply buffers are reused, the kernel sends lots of them
+var chunkPool sync.Pool
+
+func getChunk(length uint32) []byte {
+	if chunk, ok := chunkPool.Get().([]byte); ok && uint32(cap(chunk)) >= length {
+		return chunk[:length]
+	}
+	return make([]byte, length)
+}
+
+func putChunk(chunk []byte) {
+	if cap(chunk) > 0 {
+		chunkPool.Put(chunk[:0])
+	}
+}
+
+// hardwareQueue owns a backend: a single worker goroutine runs every
+// request against it, so the serial port only ever sees one command at a
+// time however many requests and connections are in flight.
+// Waiting requests are ordered by the seek scheduler.
+type hardwareQueue struct {
+	driver   BuseInterface
+	op       [5]nbdOp
+	requests chan *nbdPending
+	done     chan struct{}
+	sched    seekScheduler
+}
+
+func newHardwareQueue(driver BuseInterface, op [5]nbdOp, geometry proto.Geometry) *hardwareQueue {
+	q := &hardwareQueue{
+		driver:   driver,
+		op:       op,
+		requests: make(chan *nbdPending, NBD_QUEUE_DEPTH),
+		done:     make(chan struct{}),
+		sched:    seekScheduler{geometry: geometry},
+	}
+	go q.run()
+	return q
+}
+
+// Close stops the worker once the queued requests are done.
+// No request may be queued afterwards.
+func (q *hardwareQueue) Close() {
+	close(q.requests)
+	<-q.done
+
+	stats := q.SeekStats()
+	log.Printf("[Scheduler] %d requests, %d cylinders stepped, %d in arrival order, %d saved\n", stats.Requests, stats.Cylinders, stats.FifoCylinders, stats.Saved())
+}
+
+// SeekStats returns the head movement counters of the scheduler
+func (q *hardwareQueue) SeekStats() SeekStats {
+	return q.sched.Stats()
+}
+
+func (q *hardwareQueue) run() {
+	defer close(q.done)
+	requests := q.requests
+	for {
+		// Wait for work
+		if q.sched.empty() {
+			p, ok := <-requests
+			if !ok {
+				return
+			}
+			q.sched.add(p)
+		}
+
+		// Take whatever else is waiting, the more the scheduler sees the
+		// better it does
+		for more := true; more; {
+			select {
+			case p, ok := <-requests:
+				if ok {
+					q.sched.add(p)
+				} else {
+					// Closed: finish what is pending, then stop
+					requests = nil
+					more = false
+				}
+			default:
+				more = false
+			}
+		}
+
+		if requests == nil && q.sched.empty() {
+			return
+		}
+		q.runNext()
+	}
+}
+
+// Run what the scheduler picks, joining runs of adjacent reads
+func (q *hardwareQueue) runNext() {
+	run := q.sched.next()
+	if len(run) > 1 {
+		q.readRun(run)
+	} else {
+		q.execute(run[0])
+	}
+}
+
+func (q *hardwareQueue) execute(p *nbdPending) {
+	if err := q.op[p.request.Type](q.driver, p.chunk, &p.request, &p.reply); err != nil {
+		log.Println(err)
+		p.noReply = true
+	}
+	p.replies <- p
+}
+
+// Serve adjacent reads with a single backend read
+func (q *hardwareQueue) readRun(run []*nbdPending) {
+	total := uint32(0)
+	for _, p := range run {
+		total += p.request.Length
+	}
+	buf := getChunk(total)
+	defer putChunk(buf)
+
+	// Some sector in the run is bad, find out which requests it hits
+	if err := q.driver.ReadAt(buf, uint(run[0].request.From)); err != nil {
+		for _, p := range run {
+			q.execute(p)
+		}
+		return
+	}
+
+	off := uint32(0)
+	for _, p := range run {
+		copy(p.chunk, buf[off:])
+		off += p.request.Length
+		p.replies <- p
+	}
+}
+
+// Send replies as the worker completes requests
+func writeReplies(fp io.Writer, replies <-chan *nbdPending, inFlight *sync.WaitGroup) {
+	for p := range replies {
+		if !p.noReply {
+			if _, err := fp.Write(writeNbdReply(&p.reply)); err != nil {
+				log.Println("Write error, when sending reply header:", err)
+			} else if p.request.Type == NBD_CMD_READ && p.reply.Error == 0 {
+				// No data follows an error reply
+				if _, err := fp.Write(p.chunk); err != nil {
+					log.Println("Write error, when sending data chunk:", err)
+				}
+			}
+		}
+		putChunk(p.chunk)
+		inFlight.Done()
+	}
+}
+
+// handleRequests serves transmission phase requests read from fp until the
+// client disconnects or an error occurs. Requests are passed to the
+// hardware queue without waiting for earlier ones to complete.
+func handleRequests(queue *hardwareQueue, fp io.ReadWriter, size uint) error {
+	replies := make(chan *nbdPending, NBD_QUEUE_DEPTH)
+	var inFlight sync.WaitGroup
+	writerDone := make(chan struct{})
+	go func() {
+		writeReplies(fp, replies, &inFlight)
+		close(writerDone)
+	}()
+
+	// Wait for outstanding replies before returning
+	defer func() {
+		inFlight.Wait()
+		close(replies)
+		<-writerDone
+	}()
+
+	// NOTE: a struct in go has 4 extra bytes...
+	buf := make([]byte, unsafe.Sizeof(nbdRequest{}))
+	for {
+		if _, err := io.ReadFull(fp, buf[0:28]); err != nil {
+			return fmt.Errorf("NBD client stopped: %s", err)
+		}
+		p := &nbdPending{replies: replies}
+		readNbdRequest(buf, &p.request)
+		if p.request.Magic != NBD_REQUEST_MAGIC {
+			return fmt.Errorf("Fatal error: received packet with wrong Magic number")
+		}
+		// Upper 16 bits are command flags
+		p.request.Type &= 0xffff
+		p.reply = nbdReply{Magic: NBD_REPLY_MAGIC, Handle: p.request.Handle}
+		inFlight.Add(1)
+
+		// Dispatches READ, WRITE, DISC, FLUSH, TRIM to the hardware queue
+		if p.request.Type < NBD_CMD_READ || p.request.Type > NBD_CMD_TRIM {
+			log.Println("Received unknown request:", p.request.Type)
+			p.reply.Error = NBD_EINVAL
+			replies <- p
+			continue
+		}
+
+		// Reject requests past the end of the device, written so that an
+		// offset near 2^64 can't overflow, or not on sector boundaries
+		from, length := p.request.From, uint64(p.request.Length)
+		if p.request.Type != NBD_CMD_DISC && p.request.Type != NBD_CMD_FLUSH && (from > uint64(size) || length > uint64(size)-from || from%uint64(SECTOR_SIZE) != 0 || length%uint64(SECTOR_SIZE) != 0) {
+			log.Printf("Invalid request: offset:%d len:%d\n", p.request.From, p.request.Length)
+			if p.request.Type == NBD_CMD_WRITE {
+				if _, err := io.CopyN(io.Discard, fp, int64(p.request.Length)); err != nil {
+					inFlight.Done()
+					return fmt.Errorf("Fatal error, cannot read request packet: %s", err)
+				}
+			}
+			p.reply.Error = NBD_EINVAL
+			replies <- p
+			continue
+		}
+
+		if p.request.Type == NBD_CMD_READ || p.request.Type == NBD_CMD_WRITE {
+			p.chunk = getChunk(p.request.Length)
+		}
+		if p.request.Type == NBD_CMD_WRITE {
+			if _, err := io.ReadFull(fp, p.chunk); err != nil {
+				putChunk(p.chunk)
+				inFlight.Done()
+				return fmt.Errorf("Fatal error, cannot read request packet: %s", err)
+			}
+		}
+
+		queue.requests <- p
+
+		// Nothing follows a disconnect
+		if p.request.Type == NBD_CMD_DISC {
+			return fmt.Errorf("Received a disconnect")
+		}
+	}
+}
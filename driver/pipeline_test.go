@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+func pending_request(cmd uint32, from uint64, length uint32, replies chan *nbdPending) *nbdPending {
+	p := &nbdPending{replies: replies}
+	p.request = nbdRequest{Magic: NBD_REQUEST_MAGIC, Type: cmd, Handle: from, From: from, Length: length}
+	p.reply = nbdReply{Magic: NBD_REPLY_MAGIC, Handle: from}
+	p.chunk = make([]byte, length)
+	return p
+}
+
+// Run requests until none are pending
+func (q *hardwareQueue) runBatch(batch []*nbdPending) {
+	for _, p := range batch {
+		q.sched.add(p)
+	}
+	for !q.sched.empty() {
+		q.runNext()
+	}
+}
+
+func TestHardwareQueueCoalesce(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	backend := &memoryBackend{image: bytes.Clone(image), bad_lba: -1}
+	queue := &hardwareQueue{driver: backend, op: defaultOps(), sched: seekScheduler{geometry: proto.FORMAT_1440K}}
+	replies := make(chan *nbdPending, 10)
+
+	// Three adjacent reads, a write, then a read adjacent to the last one
+	batch := []*nbdPending{
+		pending_request(NBD_CMD_READ, 512*10, 1024, replies),
+		pending_request(NBD_CMD_READ, 512*12, 512, replies),
+		pending_request(NBD_CMD_READ, 512*13, 2048, replies),
+		pending_request(NBD_CMD_WRITE, 512*100, 512, replies),
+		pending_request(NBD_CMD_READ, 512*17, 512, replies),
+	}
+	queue.runBatch(batch)
+
+	// The write splits the run
+	if backend.read_calls != 2 {
+		t.Errorf("%d backend reads, want 2", backend.read_calls)
+	}
+
+	for i := 0; i < len(batch); i++ {
+		p := <-replies
+		if p != batch[i] {
+			t.Fatalf("reply %d out of order", i)
+		}
+		if p.reply.Error != 0 {
+			t.Errorf("request %d: error %d", i, p.reply.Error)
+		}
+		if p.request.Type == NBD_CMD_READ && !bytes.Equal(p.chunk, image[p.request.From:p.request.From+uint64(p.request.Length)]) {
+			t.Errorf("request %d: data differs from backend", i)
+		}
+	}
+}
+
+func TestHardwareQueueCoalesceError(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	backend := &memoryBackend{image: bytes.Clone(image), bad_lba: 12}
+	queue := &hardwareQueue{driver: backend, op: defaultOps(), sched: seekScheduler{geometry: proto.FORMAT_1440K}}
+	replies := make(chan *nbdPending, 10)
+
+	batch := []*nbdPending{
+		pending_request(NBD_CMD_READ, 512*10, 1024, replies),
+		pending_request(NBD_CMD_READ, 512*12, 512, replies),
+		pending_request(NBD_CMD_READ, 512*13, 512, replies),
+	}
+	queue.runBatch(batch)
+
+	// Only the request with the bad sector fails
+	for i, want := range []uint32{0, NBD_EIO, 0} {
+		if p := <-replies; p.reply.Error != want {
+			t.Errorf("request %d: error %d, want %d", i, p.reply.Error, want)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// PreloadedDevice serves reads from a copy of the whole disk held in
+// memory. Writes go to the drive as well.
+type PreloadedDevice struct {
+	backend *DeviceExample
+
+	mu    sync.Mutex
+	image []byte
+	bad   []bool
+}
+
+// Read the whole disk into memory, showing a progress bar.
+// Unreadable sectors are recorded and fail when the kernel reads them.
+func preload(ctx context.Context, backend *DeviceExample) (*PreloadedDevice, error) {
+
+	n_blocks := backend.client.Geometry().Blocks()
+
+	update_progress_bar(0, n_blocks)
+
+	image, bad_blocks, err := read_blocks(ctx, backend.client, 0, n_blocks-1, backend.retries, true, update_progress_bar)
+
+	fmt.Println()
+
+	if err != nil {
+		return nil, err
+	}
+
+	bad := make([]bool, n_blocks)
+	for _, block := range bad_blocks {
+		bad[block] = true
+	}
+
+	return &PreloadedDevice{backend: backend, image: image, bad: bad}, nil
+}
+
+// Number of sectors that couldn't be read
+func (d *PreloadedDevice) BadSectors() uint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := uint(0)
+	for _, bad := range d.bad {
+		if bad {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *PreloadedDevice) ReadAt(p []byte, off uint) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	first := off / SECTOR_SIZE
+	last := first + uint(len(p))/SECTOR_SIZE
+
+	for block := first; block < last; block++ {
+		if d.bad[block] {
+			return fmt.Errorf("block %d unreadable during preload", block)
+		}
+	}
+
+	copy(p, d.image[off:])
+
+	return nil
+}
+
+func (d *PreloadedDevice) WriteAt(p []byte, off uint) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.backend.WriteAt(p, off); err != nil {
+		return err
+	}
+
+	// Written sectors are known good now
+	copy(d.image[off:], p)
+
+	first := off / SECTOR_SIZE
+	last := first + uint(len(p))/SECTOR_SIZE
+
+	for block := first; block < last; block++ {
+		d.bad[block] = false
+	}
+
+	return nil
+}
+
+func (d *PreloadedDevice) Disconnect() {
+	log.Println("[PreloadedDevice] DISCONNECT")
+}
+
+func (d *PreloadedDevice) Flush() error {
+	return nil
+}
+
+func (d *PreloadedDevice) Trim(off, length uint) error {
+	return nil
+}
+
+func (d *PreloadedDevice) Capabilities() BuseCapabilities {
+	return d.backend.Capabilities()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// Width used when stdout is not a terminal
+const DEFAULT_TERM_WIDTH uint = 80
+
+func get_term_width() uint {
+	width, _, err := term.GetSize(int(os.Stdout.Fd()))
+
+	if err != nil || width <= 0 {
+		return DEFAULT_TERM_WIDTH
+	}
+
+	return uint(width)
+}
+
+func print_return_size(msg string) uint {
+	fmt.Print(msg)
+	return uint(len(msg))
+}
+
+func draw_progress_bar(progress float32, width uint) string {
+	total := width - 2
+	set := uint(float32(total) * progress)
+	not_set := total - set
+
+	res := "["
+
+	for i := uint(0); i < set; i++ {
+		res += "#"
+	}
+	for i := uint(0); i < not_set; i++ {
+		res += " "
+	}
+
+	res += "]"
+
+	return res
+}
+
+func update_progress_bar(blocks_done uint, total_blocks uint) {
+
+	// Get terminal width
+	available_width := get_term_width()
+
+	// Go to beginning of line
+	fmt.Printf("\r")
+
+	// Print blocks read
+	available_width -= min(available_width, print_return_size(fmt.Sprintf("%9s blocks ", fmt.Sprintf("%d/%d", blocks_done, total_blocks))))
+
+	// No room left for the bar
+	if available_width < 2 {
+		return
+	}
+
+	// Draw progress bar
+	available_width -= print_return_size(draw_progress_bar(float32(blocks_done)/float32(total_blocks), available_width))
+}
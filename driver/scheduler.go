@@ -0,0 +1,186 @@
+package main
+
+import (
+	"sync"
+
+	"floppy_arduino/proto"
+)
+
+// Times a read may be passed over before it is served regardless of
+// where the head is
+const MAX_SEEK_SKIPS uint = 16
+
+// SeekStats compares head movement in scheduled order with what serving
+// requests in arrival order would have cost
+type SeekStats struct {
+	Requests      uint // Reads and writes served
+	Cylinders     uint // Cylinders stepped in scheduled order
+	FifoCylinders uint // Cylinders stepped in arrival order
+}
+
+// Saved returns the cylinders not stepped thanks to scheduling
+func (s SeekStats) Saved() int {
+	return int(s.FifoCylinders) - int(s.Cylinders)
+}
+
+// seekScheduler orders pending requests to limit head movement.
+// Reads queued since the last write, flush or trim are served C-LOOK
+// style: by ascending cylinder from the current head position, wrapping
+// around to the lowest one. Anything else is a barrier and runs in
+// arrival order.
+type seekScheduler struct {
+	geometry      proto.Geometry
+	pending       []*nbdPending
+	cylinder      byte
+	fifo_cylinder byte
+
+	mu    sync.Mutex
+	stats SeekStats
+}
+
+// Cylinders the first and last sector of a request are on
+func (s *seekScheduler) requestCylinders(request *nbdRequest) (byte, byte) {
+	first := uint(request.From / uint64(SECTOR_SIZE))
+	last := first
+	if request.Length > 0 {
+		last = uint((request.From + uint64(request.Length) - 1) / uint64(SECTOR_SIZE))
+	}
+	first_cylinder, _, _ := s.geometry.LBAToCHS(first)
+	last_cylinder, _, _ := s.geometry.LBAToCHS(last)
+	return first_cylinder, last_cylinder
+}
+
+func movesHead(request *nbdRequest) bool {
+	return request.Type == NBD_CMD_READ || request.Type == NBD_CMD_WRITE
+}
+
+// Cylinders stepped to go from the head position over a request
+func (s *seekScheduler) seekDistance(from byte, request *nbdRequest) (uint, byte) {
+	first, last := s.requestCylinders(request)
+	distance := uint(max(from, first) - min(from, first))
+	return distance + uint(last-first), last
+}
+
+func (s *seekScheduler) empty() bool {
+	return len(s.pending) == 0
+}
+
+func (s *seekScheduler) add(p *nbdPending) {
+	if movesHead(&p.request) {
+		distance, last := s.seekDistance(s.fifo_cylinder, &p.request)
+		s.fifo_cylinder = last
+
+		s.mu.Lock()
+		s.stats.FifoCylinders += distance
+		s.mu.Unlock()
+	}
+	s.pending = append(s.pending, p)
+}
+
+// Stats returns the seek counters
+func (s *seekScheduler) Stats() SeekStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stats
+}
+
+// next removes and returns what to run now: a barrier on its own, or a
+// run of adjacent reads
+func (s *seekScheduler) next() []*nbdPending {
+	if s.empty() {
+		return nil
+	}
+
+	// Reads ahead of the first barrier can be reordered
+	window := 0
+	for window < len(s.pending) && s.pending[window].request.Type == NBD_CMD_READ {
+		window++
+	}
+
+	run := []*nbdPending{s.pending[0]}
+	if window > 0 {
+		run = s.coalesce(s.pending[:window], s.pick(s.pending[:window]))
+	}
+
+	// Remove run from pending, everything else in the window was skipped
+	in_run := make(map[*nbdPending]bool)
+	for _, p := range run {
+		in_run[p] = true
+	}
+	pending := s.pending[:0]
+	for i, p := range s.pending {
+		if in_run[p] {
+			continue
+		}
+		if i < window {
+			p.skipped++
+		}
+		pending = append(pending, p)
+	}
+	clear(s.pending[len(pending):])
+	s.pending = pending
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range run {
+		if movesHead(&p.request) {
+			distance, last := s.seekDistance(s.cylinder, &p.request)
+			s.cylinder = last
+			s.stats.Cylinders += distance
+			s.stats.Requests++
+		}
+	}
+
+	return run
+}
+
+// Read to serve next from the window
+func (s *seekScheduler) pick(window []*nbdPending) int {
+	// Starvation bound, the oldest starved read goes first
+	for i, p := range window {
+		if p.skipped >= MAX_SEEK_SKIPS {
+			return i
+		}
+	}
+
+	ahead, behind := -1, -1
+	for i, p := range window {
+		cylinder, _ := s.requestCylinders(&p.request)
+		if cylinder >= s.cylinder {
+			if ahead < 0 || p.request.From < window[ahead].request.From {
+				ahead = i
+			}
+		} else if behind < 0 || p.request.From < window[behind].request.From {
+			behind = i
+		}
+	}
+
+	// Nothing left in this sweep, start again from the lowest cylinder
+	if ahead < 0 {
+		return behind
+	}
+	return ahead
+}
+
+// The chosen read followed by reads continuing where it ends
+func (s *seekScheduler) coalesce(window []*nbdPending, chosen int) []*nbdPending {
+	run := []*nbdPending{window[chosen]}
+	total := window[chosen].request.Length
+	end := window[chosen].request.From + uint64(total)
+
+	for found := true; found; {
+		found = false
+		for _, p := range window {
+			if p.request.From == end && p.request.Length > 0 && total+p.request.Length <= MAX_COALESCED_READ {
+				run = append(run, p)
+				total += p.request.Length
+				end += uint64(p.request.Length)
+				found = true
+				break
+			}
+		}
+	}
+
+	return run
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+
+	"floppy_arduino/proto"
+)
+
+// Read of the first sector of a cylinder
+func cylinder_read(cylinder uint) *nbdPending {
+	return pending_request(NBD_CMD_READ, uint64(cylinder*36*512), 512, nil)
+}
+
+func next_cylinder(t *testing.T, sched *seekScheduler) uint {
+	t.Helper()
+
+	run := sched.next()
+	if len(run) != 1 {
+		t.Fatalf("run of %d requests", len(run))
+	}
+	first, _ := sched.requestCylinders(&run[0].request)
+	return uint(first)
+}
+
+func TestSeekSchedulerOrder(t *testing.T) {
+	sched := seekScheduler{geometry: proto.FORMAT_1440K}
+
+	for _, cylinder := range []uint{40, 10, 60, 5} {
+		sched.add(cylinder_read(cylinder))
+	}
+	for _, want := range []uint{5, 10, 40} {
+		if got := next_cylinder(t, &sched); got != want {
+			t.Errorf("served cylinder %d, want %d", got, want)
+		}
+	}
+
+	// Head at 40, 30 waits for the sweep to wrap around
+	sched.add(cylinder_read(30))
+	sched.add(cylinder_read(70))
+	for _, want := range []uint{60, 70, 30} {
+		if got := next_cylinder(t, &sched); got != want {
+			t.Errorf("served cylinder %d, want %d", got, want)
+		}
+	}
+
+	// 40+30+50+55+25+40 in arrival order
+	// 5+5+30+20+10+40 scheduled
+	stats := sched.Stats()
+	if stats != (SeekStats{Requests: 6, Cylinders: 110, FifoCylinders: 240}) || stats.Saved() != 130 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestSeekSchedulerBarrier(t *testing.T) {
+	sched := seekScheduler{geometry: proto.FORMAT_1440K}
+
+	sched.add(cylinder_read(50))
+	sched.add(pending_request(NBD_CMD_WRITE, 0, 512, nil))
+	sched.add(cylinder_read(10))
+
+	// The read after the write stays after it
+	if got := next_cylinder(t, &sched); got != 50 {
+		t.Errorf("served cylinder %d, want 50", got)
+	}
+	if run := sched.next(); run[0].request.Type != NBD_CMD_WRITE {
+		t.Error("write not served second")
+	}
+	if got := next_cylinder(t, &sched); got != 10 {
+		t.Errorf("served cylinder %d, want 10", got)
+	}
+}
+
+func TestSeekSchedulerStarvation(t *testing.T) {
+	sched := seekScheduler{geometry: proto.FORMAT_1440K}
+
+	sched.add(cylinder_read(50))
+	next_cylinder(t, &sched)
+
+	// Behind the head, and new reads keep arriving ahead of it
+	sched.add(cylinder_read(0))
+	for i := uint(0); i < MAX_SEEK_SKIPS; i++ {
+		sched.add(cylinder_read(51 + i))
+		if got := next_cylinder(t, &sched); got != 51+i {
+			t.Fatalf("served cylinder %d, want %d", got, 51+i)
+		}
+	}
+
+	sched.add(cylinder_read(70))
+	if got := next_cylinder(t, &sched); got != 0 {
+		t.Errorf("served cylinder %d, want starved 0", got)
+	}
+}
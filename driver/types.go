@@ -2,6 +2,8 @@ package main
 
 import (
 	"os"
+
+	"floppy_arduino/proto"
 )
 
 // Rewrote type definitions for #defines and structs to workaround cgo
@@ -41,6 +43,56 @@ const (
 	NBD_REPLY_MAGIC   = 0x67446698
 )
 
+// Error values in replies
+const (
+	NBD_EPERM  = 1
+	NBD_EIO    = 5
+	NBD_EINVAL = 22
+)
+
+// Newstyle negotiation, as defined in the NBD protocol document
+const (
+	NBD_INIT_MAGIC      = 0x4e42444d41474943 // "NBDMAGIC"
+	NBD_OPTS_MAGIC      = 0x49484156454F5054 // "IHAVEOPT"
+	NBD_REP_MAGIC       = 0x3e889045565a9
+	NBD_DEFAULT_PORT    = 10809
+	NBD_MAX_OPTION_SIZE = 4096
+)
+
+const (
+	NBD_FLAG_FIXED_NEWSTYLE = (1 << 0)
+	NBD_FLAG_NO_ZEROES      = (1 << 1)
+)
+
+const (
+	NBD_FLAG_C_FIXED_NEWSTYLE = (1 << 0)
+	NBD_FLAG_C_NO_ZEROES      = (1 << 1)
+)
+
+const (
+	NBD_OPT_EXPORT_NAME = 1
+	NBD_OPT_ABORT       = 2
+	NBD_OPT_LIST        = 3
+	NBD_OPT_INFO        = 6
+	NBD_OPT_GO          = 7
+)
+
+const (
+	NBD_REP_ACK         = 1
+	NBD_REP_SERVER      = 2
+	NBD_REP_INFO        = 3
+	NBD_REP_ERR_UNSUP   = (1<<31 | 1)
+	NBD_REP_ERR_INVALID = (1<<31 | 3)
+	NBD_REP_ERR_UNKNOWN = (1<<31 | 6)
+)
+
+const (
+	NBD_INFO_EXPORT      = 0
+	NBD_INFO_NAME        = 1
+	NBD_INFO_DESCRIPTION = 2
+	NBD_INFO_BLOCK_SIZE  = 3
+)
+
 type nbdRequest struct {
 	Magic  uint32
 	Type   uint32
@@ -61,14 +113,43 @@ type BuseInterface interface {
 	Disconnect()
 	Flush() error
 	Trim(off uint, length uint) error
+	Capabilities() BuseCapabilities
+}
+
+// BuseCapabilities tells the kernel which requests a backend can serve
+type BuseCapabilities struct {
+	ReadOnly       bool // Backend cannot write
+	WriteProtected bool // Media has its write-protect tab set
+	Flush          bool
+	Trim           bool
 }
 
+// Flags to pass to NBD_SET_FLAGS
+func (c BuseCapabilities) nbdFlags() uintptr {
+	flags := uintptr(NBD_FLAG_HAS_FLAGS)
+	if c.ReadOnly || c.WriteProtected {
+		flags |= NBD_FLAG_READ_ONLY
+	}
+	if c.Flush {
+		flags |= NBD_FLAG_SEND_FLUSH
+	}
+	if c.Trim {
+		flags |= NBD_FLAG_SEND_TRIM
+	}
+	return flags
+}
+
+// Performs a request and fills in the reply error.
+// Returning an error ends the connection without a reply.
+type nbdOp func(driver BuseInterface, chunk []byte, request *nbdRequest, reply *nbdReply) error
+
 type BuseDevice struct {
 	size       uint
+	geometry   proto.Geometry
 	device     string
 	driver     BuseInterface
 	deviceFp   *os.File
 	socketPair [2]int
-	op         [5]func(driver BuseInterface, fp *os.File, chunk []byte, request *nbdRequest, reply *nbdReply) error
+	op         [5]nbdOp
 	disconnect chan int
 }
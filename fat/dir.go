@@ -0,0 +1,186 @@
+package fat
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Attributes of a directory entry
+const (
+	ATTR_READ_ONLY byte = 0x01
+	ATTR_HIDDEN    byte = 0x02
+	ATTR_SYSTEM    byte = 0x04
+	ATTR_VOLUME    byte = 0x08
+	ATTR_DIRECTORY byte = 0x10
+	ATTR_ARCHIVE   byte = 0x20
+	ATTR_LONG_NAME byte = 0x0F
+)
+
+// First byte of the name of a deleted directory entry, and of the entry
+// after the last one
+const DIR_DELETED byte = 0xE5
+const DIR_END byte = 0x00
+
+// Entry is a file or directory
+type Entry struct {
+	Name      string // Long name, or the short one if there is none
+	ShortName string // 8.3 name
+	Attr      byte
+	Modified  time.Time // Zero if not set
+	Cluster   uint32    // First cluster, 0 for empty files and the root
+	Size      uint32
+}
+
+func (e Entry) IsDir() bool {
+	return e.Attr&ATTR_DIRECTORY != 0
+}
+
+// 8.3 name of a directory entry, with a dot before the extension. A volume
+// label is all 11 characters.
+func short_name(raw []byte) string {
+
+	name := append([]byte{}, raw[0:8]...)
+	if name[0] == 0x05 {
+		// Stands for a name starting with 0xE5
+		name[0] = DIR_DELETED
+	}
+
+	if raw[11]&ATTR_VOLUME != 0 {
+		return strings.TrimRight(string(name)+string(raw[8:11]), " ")
+	}
+
+	base := strings.TrimRight(string(name), " ")
+	ext := strings.TrimRight(string(raw[8:11]), " ")
+
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+// Checksum of the 8.3 name a long name belongs to
+func short_name_checksum(raw []byte) byte {
+
+	sum := byte(0)
+	for _, c := range raw[0:11] {
+		sum = (sum>>1 | sum<<7) + c
+	}
+	return sum
+}
+
+// Date and time of a directory entry, in the FAT packed format
+func timestamp(date uint16, t uint16) time.Time {
+
+	if date == 0 {
+		return time.Time{}
+	}
+
+	return time.Date(1980+int(date>>9), time.Month(date>>5&0x0F), int(date&0x1F),
+		int(t>>11), int(t>>5&0x3F), int(t&0x1F)*2, 0, time.Local)
+}
+
+// ParseDirEntry decodes a short directory entry. Its Name is the short
+// name, long names are only put together when listing a directory.
+func ParseDirEntry(raw []byte) Entry {
+
+	entry := Entry{
+		ShortName: short_name(raw),
+		Attr:      raw[11],
+		Modified:  timestamp(binary.LittleEndian.Uint16(raw[24:]), binary.LittleEndian.Uint16(raw[22:])),
+		Cluster:   uint32(binary.LittleEndian.Uint16(raw[26:])),
+		Size:      binary.LittleEndian.Uint32(raw[28:]),
+	}
+	entry.Name = entry.ShortName
+
+	return entry
+}
+
+// Long name being read: its entries come before the short entry, the
+// last part first
+type long_name struct {
+	parts    [][]uint16
+	checksum byte
+}
+
+// Characters of a long name entry, up to the terminating 0
+func long_name_part(raw []byte) []uint16 {
+
+	var chars []uint16
+
+	for _, r := range [][2]int{{1, 11}, {14, 26}, {28, 32}} {
+		for i := r[0]; i < r[1]; i += 2 {
+			c := binary.LittleEndian.Uint16(raw[i:])
+			if c == 0 {
+				return chars
+			}
+			chars = append(chars, c)
+		}
+	}
+
+	return chars
+}
+
+// LongNamePart is the part of a long name held by a long name entry
+func LongNamePart(raw []byte) string {
+	return string(utf16.Decode(long_name_part(raw)))
+}
+
+// Add a directory entry. Returns the entry of a file or directory once
+// its short entry is reached.
+func (l *long_name) add(raw []byte) (Entry, bool) {
+
+	attr := raw[11]
+
+	if raw[0] == DIR_DELETED {
+		l.parts = nil
+		return Entry{}, false
+	}
+
+	if attr == ATTR_LONG_NAME {
+		seq := int(raw[0] & 0x1F)
+
+		// The last part starts a long name
+		if raw[0]&0x40 != 0 {
+			l.parts = make([][]uint16, seq)
+			l.checksum = raw[13]
+		}
+
+		if seq == 0 || seq > len(l.parts) || raw[13] != l.checksum {
+			l.parts = nil
+			return Entry{}, false
+		}
+
+		l.parts[seq-1] = long_name_part(raw)
+		return Entry{}, false
+	}
+
+	parts := l.parts
+	l.parts = nil
+
+	if attr&ATTR_VOLUME != 0 {
+		return Entry{}, false
+	}
+
+	entry := ParseDirEntry(raw)
+
+	if entry.Name == "." || entry.Name == ".." {
+		return Entry{}, false
+	}
+
+	// Use the long name if all its parts are there and it belongs to
+	// this entry
+	if len(parts) > 0 && l.checksum == short_name_checksum(raw) {
+		var chars []uint16
+		for _, part := range parts {
+			if part == nil {
+				return entry, true
+			}
+			chars = append(chars, part...)
+		}
+		entry.Name = string(utf16.Decode(chars))
+	}
+
+	return entry, true
+}
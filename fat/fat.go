@@ -0,0 +1,232 @@
+// Package fat reads FAT12 and FAT16 file systems one sector at a time, so
+// a few files can be taken from a disk without imaging all of it.
+package fat
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const SECTOR_SIZE uint = 512
+
+// Size of a directory entry
+const DIR_ENTRY_SIZE uint = 32
+
+// Disks with fewer clusters use 12 bit FAT entries
+const FAT12_MAX_CLUSTERS uint32 = 4085
+
+// Errors
+var (
+	ErrNotFAT   = errors.New("not a FAT file system")
+	ErrNotFound = errors.New("file not found")
+	ErrNotDir   = errors.New("not a directory")
+	ErrIsDir    = errors.New("is a directory")
+	ErrBadChain = errors.New("bad cluster chain")
+)
+
+// SectorReader reads a sector by LBA, from a drive or an image
+type SectorReader interface {
+	ReadSector(ctx context.Context, lba uint) ([]byte, error)
+}
+
+// ImageReader reads the sectors of a disk image
+type ImageReader struct {
+	r io.ReaderAt
+}
+
+func NewImageReader(r io.ReaderAt) *ImageReader {
+	return &ImageReader{r: r}
+}
+
+func (i *ImageReader) ReadSector(ctx context.Context, lba uint) ([]byte, error) {
+
+	data := make([]byte, SECTOR_SIZE)
+
+	if _, err := i.r.ReadAt(data, int64(lba*SECTOR_SIZE)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// BootSector holds the fields of a FAT boot sector
+type BootSector struct {
+	Jump              byte // First byte of the boot code
+	OEM               string
+	BytesPerSector    uint16
+	SectorsPerCluster byte
+	ReservedSectors   uint16
+	FATs              byte
+	RootEntries       uint16
+	TotalSectors      uint32
+	Media             byte
+	SectorsPerFAT     uint16
+	SectorsPerTrack   uint16
+	Heads             uint16
+	HiddenSectors     uint32
+
+	// Extended BPB, if the signature is 0x28 or 0x29
+	Drive             byte
+	ExtendedSignature byte // 0 without an extended BPB
+	Serial            uint32
+	Label             string // Only with a 0x29 signature
+	FSType            string
+
+	Signature uint16 // 0xAA55 on a bootable disk
+}
+
+// DecodeBootSector decodes the fields of a boot sector without checking
+// that they describe a file system
+func DecodeBootSector(sector []byte) (BootSector, error) {
+
+	if len(sector) < int(SECTOR_SIZE) {
+		return BootSector{}, fmt.Errorf("%w: boot sector too short", ErrNotFAT)
+	}
+
+	b := BootSector{
+		Jump:              sector[0],
+		OEM:               strings.TrimRight(string(sector[0x03:0x0B]), " \x00"),
+		BytesPerSector:    binary.LittleEndian.Uint16(sector[0x0B:]),
+		SectorsPerCluster: sector[0x0D],
+		ReservedSectors:   binary.LittleEndian.Uint16(sector[0x0E:]),
+		FATs:              sector[0x10],
+		RootEntries:       binary.LittleEndian.Uint16(sector[0x11:]),
+		TotalSectors:      uint32(binary.LittleEndian.Uint16(sector[0x13:])),
+		Media:             sector[0x15],
+		SectorsPerFAT:     binary.LittleEndian.Uint16(sector[0x16:]),
+		SectorsPerTrack:   binary.LittleEndian.Uint16(sector[0x18:]),
+		Heads:             binary.LittleEndian.Uint16(sector[0x1A:]),
+		HiddenSectors:     binary.LittleEndian.Uint32(sector[0x1C:]),
+		Signature:         binary.LittleEndian.Uint16(sector[0x1FE:]),
+	}
+
+	// Large disks store the total in the 32 bit field
+	if b.TotalSectors == 0 {
+		b.TotalSectors = binary.LittleEndian.Uint32(sector[0x20:])
+	}
+
+	if sector[0x26] == 0x28 || sector[0x26] == 0x29 {
+		b.Drive = sector[0x24]
+		b.ExtendedSignature = sector[0x26]
+		b.Serial = binary.LittleEndian.Uint32(sector[0x27:])
+
+		// The label and type only follow a 0x29 signature
+		if b.ExtendedSignature == 0x29 {
+			b.Label = strings.TrimRight(string(sector[0x2B:0x36]), " \x00")
+			b.FSType = strings.TrimRight(string(sector[0x36:0x3E]), " \x00")
+		}
+	}
+
+	return b, nil
+}
+
+// ParseBootSector decodes and sanity-checks a boot sector
+func ParseBootSector(sector []byte) (BootSector, error) {
+
+	b, err := DecodeBootSector(sector)
+	if err != nil {
+		return BootSector{}, err
+	}
+
+	switch {
+	case uint(b.BytesPerSector) != SECTOR_SIZE:
+		return BootSector{}, fmt.Errorf("%w: %d bytes per sector", ErrNotFAT, b.BytesPerSector)
+	case b.SectorsPerCluster == 0 || b.SectorsPerCluster&(b.SectorsPerCluster-1) != 0:
+		return BootSector{}, fmt.Errorf("%w: %d sectors per cluster", ErrNotFAT, b.SectorsPerCluster)
+	case b.ReservedSectors == 0:
+		return BootSector{}, fmt.Errorf("%w: no reserved sectors", ErrNotFAT)
+	case b.FATs == 0 || b.SectorsPerFAT == 0:
+		return BootSector{}, fmt.Errorf("%w: no FAT", ErrNotFAT)
+	case b.RootEntries == 0:
+		return BootSector{}, fmt.Errorf("%w: no root directory", ErrNotFAT)
+	case b.TotalSectors <= uint32(b.DataStart()):
+		return BootSector{}, fmt.Errorf("%w: %d total sectors", ErrNotFAT, b.TotalSectors)
+	}
+
+	// The FAT must have an entry for each cluster
+	if uint(b.Clusters()+2)*uint(b.FATBits())/8 > uint(b.SectorsPerFAT)*SECTOR_SIZE {
+		return BootSector{}, fmt.Errorf("%w: FAT too small for %d clusters", ErrNotFAT, b.Clusters())
+	}
+
+	return b, nil
+}
+
+// FATStart is the LBA of the first FAT
+func (b BootSector) FATStart() uint {
+	return uint(b.ReservedSectors)
+}
+
+// RootStart is the LBA of the root directory
+func (b BootSector) RootStart() uint {
+	return b.FATStart() + uint(b.FATs)*uint(b.SectorsPerFAT)
+}
+
+func (b BootSector) RootSectors() uint {
+	return (uint(b.RootEntries)*DIR_ENTRY_SIZE + SECTOR_SIZE - 1) / SECTOR_SIZE
+}
+
+// DataStart is the LBA of cluster 2, the first one
+func (b BootSector) DataStart() uint {
+	return b.RootStart() + b.RootSectors()
+}
+
+// Clusters is the number of clusters holding data
+func (b BootSector) Clusters() uint32 {
+	return (b.TotalSectors - uint32(b.DataStart())) / uint32(b.SectorsPerCluster)
+}
+
+// FATBits is the size of a FAT entry, 12 or 16
+func (b BootSector) FATBits() int {
+	if b.Clusters() < FAT12_MAX_CLUSTERS {
+		return 12
+	}
+	return 16
+}
+
+func (b BootSector) ClusterSize() uint {
+	return uint(b.SectorsPerCluster) * SECTOR_SIZE
+}
+
+// HasJump tells if the boot code starts with a jump, as on DOS disks
+func (b BootSector) HasJump() bool {
+	return b.Jump == 0xEB || b.Jump == 0xE9
+}
+
+// BadMark is the FAT entry of a cluster marked bad
+func (b BootSector) BadMark() uint32 {
+	return uint32(1)<<b.FATBits() - 9
+}
+
+// EndOfChain tells if a FAT entry ends a cluster chain
+func (b BootSector) EndOfChain(value uint32) bool {
+	return value >= uint32(1)<<b.FATBits()-8
+}
+
+// FATOffset is the offset in the FAT of the two bytes holding the entry
+// of cluster
+func (b BootSector) FATOffset(cluster uint32) uint {
+	return uint(cluster) * uint(b.FATBits()) / 8
+}
+
+// FATEntry decodes the entry of cluster from the two bytes at its
+// FATOffset
+func (b BootSector) FATEntry(cluster uint32, data []byte) uint32 {
+
+	value := uint32(binary.LittleEndian.Uint16(data))
+
+	if b.FATBits() == 12 {
+		if cluster%2 == 1 {
+			value >>= 4
+		}
+		value &= 0xFFF
+	}
+
+	return value
+}
@@ -0,0 +1,439 @@
+package fat_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"floppy_arduino/fat"
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+const SECTOR_SIZE = fat.SECTOR_SIZE
+
+// First sector of the data area of a 1.44M disk
+const DATA_START uint = 33
+
+// Blank 1.44M disk formatted by DOS
+func blank_image() []byte {
+	return emulatortest.FormatImage(proto.FORMAT_1440K, "BOOTLABEL", 0x1234ABCD)
+}
+
+// Set a FAT12 entry in both FATs
+func set_fat(img []byte, cluster int, value uint16) {
+	for _, start := range []uint{1, 10} {
+		i := start*SECTOR_SIZE + uint(cluster*3/2)
+		entry := binary.LittleEndian.Uint16(img[i:])
+
+		if cluster%2 == 1 {
+			entry = entry&0x000F | value<<4
+		} else {
+			entry = entry&0xF000 | value&0x0FFF
+		}
+
+		binary.LittleEndian.PutUint16(img[i:], entry)
+	}
+}
+
+// Chain clusters, the last one ending the file
+func set_chain(img []byte, clusters ...int) {
+	for i, cluster := range clusters {
+		if i == len(clusters)-1 {
+			set_fat(img, cluster, 0xFFF)
+		} else {
+			set_fat(img, cluster, uint16(clusters[i+1]))
+		}
+	}
+}
+
+func cluster_offset(cluster int) uint {
+	return (DATA_START + uint(cluster-2)) * SECTOR_SIZE
+}
+
+// Put data in clusters
+func write_clusters(img []byte, data []byte, clusters ...int) {
+	for i, cluster := range clusters {
+		copy(img[cluster_offset(cluster):], data[min(len(data), i*int(SECTOR_SIZE)):min(len(data), (i+1)*int(SECTOR_SIZE))])
+	}
+}
+
+// 2024-05-17 12:34:56
+const DATE uint16 = 44<<9 | 5<<5 | 17
+const TIME uint16 = 12<<11 | 34<<5 | 28
+
+func dir_entry(name string, attr byte, cluster uint16, size uint32) []byte {
+	raw := make([]byte, fat.DIR_ENTRY_SIZE)
+
+	copy(raw, name)
+	raw[11] = attr
+	binary.LittleEndian.PutUint16(raw[22:], TIME)
+	binary.LittleEndian.PutUint16(raw[24:], DATE)
+	binary.LittleEndian.PutUint16(raw[26:], cluster)
+	binary.LittleEndian.PutUint32(raw[28:], size)
+
+	return raw
+}
+
+// Long name entries of a short entry, last part first
+func long_name_entries(name string, short []byte) []byte {
+	sum := byte(0)
+	for _, c := range short[0:11] {
+		sum = (sum>>1 | sum<<7) + c
+	}
+
+	chars := []uint16{}
+	for _, c := range name {
+		chars = append(chars, uint16(c))
+	}
+	chars = append(chars, 0)
+	for len(chars)%13 != 0 {
+		chars = append(chars, 0xFFFF)
+	}
+
+	parts := len(chars) / 13
+	var entries []byte
+
+	for seq := parts; seq >= 1; seq-- {
+		raw := make([]byte, fat.DIR_ENTRY_SIZE)
+		raw[0] = byte(seq)
+		if seq == parts {
+			raw[0] |= 0x40
+		}
+		raw[11] = fat.ATTR_LONG_NAME
+		raw[13] = sum
+
+		offsets := []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+		for i, offset := range offsets {
+			binary.LittleEndian.PutUint16(raw[offset:], chars[(seq-1)*13+i])
+		}
+
+		entries = append(entries, raw...)
+	}
+
+	return entries
+}
+
+// Test disk:
+//
+//	TESTDISK (label)
+//	Long File Name.txt  1500 bytes in clusters 2, 3, 5
+//	README.TXT          10 bytes in cluster 4
+//	OLD.BAK             deleted
+//	DOCS/
+//	  A.TXT             empty
+//	  SUB/
+//	    B.BIN           600 bytes in clusters 8, 9
+var LONG_DATA = bytes.Repeat([]byte("0123456789"), 150)
+var README_DATA = []byte("Read me!\r\n")
+var B_DATA = bytes.Repeat([]byte{0xAA, 0x55}, 300)
+
+func test_image() []byte {
+	img := blank_image()
+
+	long := dir_entry("LONGFI~1TXT", fat.ATTR_ARCHIVE, 2, uint32(len(LONG_DATA)))
+
+	var root []byte
+	for _, raw := range [][]byte{
+		dir_entry("TESTDISK   ", fat.ATTR_VOLUME, 0, 0),
+		long_name_entries("Long File Name.txt", long),
+		long,
+		dir_entry("README  TXT", fat.ATTR_ARCHIVE, 4, uint32(len(README_DATA))),
+		dir_entry("\xE5LD     BAK", fat.ATTR_ARCHIVE, 10, 100),
+		dir_entry("DOCS       ", fat.ATTR_DIRECTORY, 6, 0),
+	} {
+		root = append(root, raw...)
+	}
+	copy(img[19*SECTOR_SIZE:], root)
+
+	set_chain(img, 2, 3, 5)
+	write_clusters(img, LONG_DATA, 2, 3, 5)
+	set_chain(img, 4)
+	write_clusters(img, README_DATA, 4)
+
+	var docs []byte
+	for _, raw := range [][]byte{
+		dir_entry(".          ", fat.ATTR_DIRECTORY, 6, 0),
+		dir_entry("..         ", fat.ATTR_DIRECTORY, 0, 0),
+		dir_entry("A       TXT", fat.ATTR_ARCHIVE, 0, 0),
+		dir_entry("SUB        ", fat.ATTR_DIRECTORY, 7, 0),
+	} {
+		docs = append(docs, raw...)
+	}
+	set_chain(img, 6)
+	write_clusters(img, docs, 6)
+
+	sub := append(dir_entry(".          ", fat.ATTR_DIRECTORY, 7, 0), dir_entry("B       BIN", fat.ATTR_ARCHIVE, 8, uint32(len(B_DATA)))...)
+	set_chain(img, 7)
+	write_clusters(img, sub, 7)
+
+	set_chain(img, 8, 9)
+	write_clusters(img, B_DATA, 8, 9)
+
+	return img
+}
+
+// Reader of an image that records the sectors read
+type counting_reader struct {
+	*fat.ImageReader
+	read []uint
+}
+
+func (c *counting_reader) ReadSector(ctx context.Context, lba uint) ([]byte, error) {
+	c.read = append(c.read, lba)
+	return c.ImageReader.ReadSector(ctx, lba)
+}
+
+func open(t *testing.T, img []byte) (*fat.FS, *counting_reader) {
+	t.Helper()
+
+	r := &counting_reader{ImageReader: fat.NewImageReader(bytes.NewReader(img))}
+
+	fs, err := fat.Open(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fs, r
+}
+
+func TestOpen(t *testing.T) {
+	fs, _ := open(t, test_image())
+
+	b := fs.Boot
+	if b.FATStart() != 1 || b.RootStart() != 19 || b.RootSectors() != 14 || b.DataStart() != DATA_START {
+		t.Errorf("FAT %d, root %d (%d sectors), data %d", b.FATStart(), b.RootStart(), b.RootSectors(), b.DataStart())
+	}
+	if b.Clusters() != 2847 || b.FATBits() != 12 || b.Serial != 0x1234ABCD || b.Label != "BOOTLABEL" {
+		t.Errorf("%d clusters, FAT%d, serial %08X, label %q", b.Clusters(), b.FATBits(), b.Serial, b.Label)
+	}
+
+	label, err := fs.Label(context.Background())
+	if err != nil || label != "TESTDISK" {
+		t.Errorf("label %q, %v", label, err)
+	}
+
+	if _, err := fat.Open(context.Background(), fat.NewImageReader(bytes.NewReader(make([]byte, 2880*SECTOR_SIZE)))); !errors.Is(err, fat.ErrNotFAT) {
+		t.Errorf("blank disk opened: %v", err)
+	}
+	if _, err := fat.Open(context.Background(), fat.NewImageReader(bytes.NewReader(nil))); err == nil {
+		t.Errorf("empty image opened")
+	}
+}
+
+func TestParseBootSector(t *testing.T) {
+	img := blank_image()
+
+	b, err := fat.ParseBootSector(img[:SECTOR_SIZE])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := fat.BootSector{
+		Jump: 0xEB, OEM: "MSDOS5.0", BytesPerSector: 512, SectorsPerCluster: 1, ReservedSectors: 1, FATs: 2,
+		RootEntries: 224, TotalSectors: 2880, Media: 0xF0, SectorsPerFAT: 9, SectorsPerTrack: 18, Heads: 2,
+		ExtendedSignature: 0x29, Serial: 0x1234ABCD, Label: "BOOTLABEL", FSType: "FAT12", Signature: 0xAA55,
+	}
+	if b != want || !b.HasJump() {
+		t.Errorf("boot sector %+v\nwant %+v", b, want)
+	}
+
+	// Each field a FAT can't do without
+	broken := map[string]func(boot []byte){
+		"3 sectors per cluster": func(boot []byte) { boot[0x0D] = 3 },
+		"no reserved sectors":   func(boot []byte) { binary.LittleEndian.PutUint16(boot[0x0E:], 0) },
+		"no FAT":                func(boot []byte) { boot[0x10] = 0 },
+		"no root entries":       func(boot []byte) { binary.LittleEndian.PutUint16(boot[0x11:], 0) },
+		"FAT too small":         func(boot []byte) { binary.LittleEndian.PutUint16(boot[0x16:], 1) },
+		"1024 byte sectors":     func(boot []byte) { binary.LittleEndian.PutUint16(boot[0x0B:], 1024) },
+	}
+
+	for name, breakage := range broken {
+		boot := blank_image()[:SECTOR_SIZE]
+		breakage(boot)
+
+		if _, err := fat.ParseBootSector(boot); !errors.Is(err, fat.ErrNotFAT) {
+			t.Errorf("%s: %v", name, err)
+		}
+
+		// Still decodes without the checks
+		if _, err := fat.DecodeBootSector(boot); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	// No label or type before a 0x28 signature
+	img[0x26] = 0x28
+	if b, _ := fat.DecodeBootSector(img); b.Serial != 0x1234ABCD || b.Label != "" || b.FSType != "" {
+		t.Errorf("0x28 signature: %+v", b)
+	}
+}
+
+func TestFATEntry(t *testing.T) {
+	img := test_image()
+	fs, _ := open(t, img)
+	b := fs.Boot
+
+	fat_copy := img[b.FATStart()*SECTOR_SIZE:]
+	entry := func(cluster uint32) uint32 {
+		return b.FATEntry(cluster, fat_copy[b.FATOffset(cluster):])
+	}
+
+	// Long File Name.txt is in 2, 3 and 5
+	if entry(2) != 3 || entry(3) != 5 || !b.EndOfChain(entry(5)) || entry(10) != 0 {
+		t.Errorf("entries %d %d %d %d", entry(2), entry(3), entry(5), entry(10))
+	}
+
+	set_fat(img, 11, 0xFF7)
+	if entry(11) != b.BadMark() || b.EndOfChain(b.BadMark()) {
+		t.Errorf("bad mark %#x, entry %#x", b.BadMark(), entry(11))
+	}
+}
+
+func TestParseDirEntry(t *testing.T) {
+	entry := fat.ParseDirEntry(dir_entry("README  TXT", fat.ATTR_ARCHIVE, 4, 10))
+
+	if entry.Name != "README.TXT" || entry.ShortName != "README.TXT" || entry.Cluster != 4 || entry.Size != 10 {
+		t.Errorf("entry %+v", entry)
+	}
+	if want := time.Date(2024, 5, 17, 12, 34, 56, 0, time.Local); !entry.Modified.Equal(want) {
+		t.Errorf("modified %v, want %v", entry.Modified, want)
+	}
+
+	// Volume labels have no dot
+	if label := fat.ParseDirEntry(dir_entry("MY DISK NAM", fat.ATTR_VOLUME, 0, 0)); label.ShortName != "MY DISK NAM" {
+		t.Errorf("label %q", label.ShortName)
+	}
+
+	long := long_name_entries("Long File Name.txt", dir_entry("LONGFI~1TXT", fat.ATTR_ARCHIVE, 2, 0))
+	if part := fat.LongNamePart(long[:fat.DIR_ENTRY_SIZE]); part != "e.txt" {
+		t.Errorf("last part %q", part)
+	}
+	if part := fat.LongNamePart(long[fat.DIR_ENTRY_SIZE:]); part != "Long File Nam" {
+		t.Errorf("first part %q", part)
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	fs, _ := open(t, test_image())
+	ctx := context.Background()
+
+	entries, err := fs.ReadDir(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	if want := []string{"Long File Name.txt", "README.TXT", "DOCS"}; !slices.Equal(names, want) {
+		t.Errorf("names %q, want %q", names, want)
+	}
+
+	if e := entries[0]; e.ShortName != "LONGFI~1.TXT" || e.Size != 1500 || e.Cluster != 2 || e.IsDir() {
+		t.Errorf("entry %+v", e)
+	}
+	if want := time.Date(2024, 5, 17, 12, 34, 56, 0, time.Local); !entries[1].Modified.Equal(want) {
+		t.Errorf("modified %s, want %s", entries[1].Modified, want)
+	}
+
+	// Paths in any case, with either separator
+	entries, err = fs.ReadDir(ctx, "docs\\Sub")
+	if err != nil || len(entries) != 1 || entries[0].Name != "B.BIN" {
+		t.Errorf("DOCS/SUB = %+v, %v", entries, err)
+	}
+
+	if _, err := fs.ReadDir(ctx, "/README.TXT"); !errors.Is(err, fat.ErrNotDir) {
+		t.Errorf("file listed: %v", err)
+	}
+	if _, err := fs.ReadDir(ctx, "/NOPE"); !errors.Is(err, fat.ErrNotFound) {
+		t.Errorf("missing directory listed: %v", err)
+	}
+	if _, err := fs.Stat(ctx, "/OLD.BAK"); !errors.Is(err, fat.ErrNotFound) {
+		t.Errorf("deleted file found: %v", err)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	fs, _ := open(t, test_image())
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		want []byte
+	}{
+		{"/long file name.TXT", LONG_DATA},
+		{"LONGFI~1.TXT", LONG_DATA},
+		{"/README.TXT", README_DATA},
+		{"/DOCS/A.TXT", nil},
+		{"/DOCS/SUB/B.BIN", B_DATA},
+	}
+
+	for _, test := range tests {
+		data, err := fs.ReadFile(ctx, test.name)
+		if err != nil || !bytes.Equal(data, test.want) {
+			t.Errorf("%s: %d bytes, %v", test.name, len(data), err)
+		}
+	}
+
+	if _, err := fs.ReadFile(ctx, "/DOCS"); !errors.Is(err, fat.ErrIsDir) {
+		t.Errorf("directory read: %v", err)
+	}
+}
+
+func TestSectorsRead(t *testing.T) {
+	fs, r := open(t, test_image())
+
+	if _, err := fs.ReadFile(context.Background(), "/DOCS/SUB/B.BIN"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Boot sector, root directory, FAT, DOCS, SUB, then the two clusters
+	// of B.BIN. The FAT sector is only read once.
+	data := func(cluster int) uint { return DATA_START + uint(cluster-2) }
+	want := []uint{0, 19, 1, data(6), data(7), data(8), data(9)}
+
+	if !slices.Equal(r.read, want) {
+		t.Errorf("sectors read %v, want %v", r.read, want)
+	}
+}
+
+func TestBadChain(t *testing.T) {
+	img := test_image()
+	ctx := context.Background()
+
+	// README.TXT loops on itself, B.BIN goes to a free cluster
+	set_fat(img, 4, 4)
+	set_fat(img, 8, 0)
+	binary.LittleEndian.PutUint32(img[19*SECTOR_SIZE+4*fat.DIR_ENTRY_SIZE+28:], 1000)
+
+	fs, _ := open(t, img)
+
+	if _, err := fs.ReadFile(ctx, "/README.TXT"); !errors.Is(err, fat.ErrBadChain) {
+		t.Errorf("README.TXT: %v", err)
+	}
+	if _, err := fs.ReadFile(ctx, "/DOCS/SUB/B.BIN"); !errors.Is(err, fat.ErrBadChain) {
+		t.Errorf("B.BIN: %v", err)
+	}
+
+	// The middle cluster of the long file is marked bad
+	set_fat(img, 3, 0xFF7)
+	fs, _ = open(t, img)
+
+	if _, err := fs.ReadFile(ctx, "/Long File Name.txt"); !errors.Is(err, fat.ErrBadChain) || !strings.Contains(err.Error(), "cluster 3 is marked bad") {
+		t.Errorf("long file: %v", err)
+	}
+
+	set_fat(img, 6, 6)
+	fs, _ = open(t, img)
+
+	if _, err := fs.ReadDir(ctx, "/DOCS"); !errors.Is(err, fat.ErrBadChain) {
+		t.Errorf("DOCS: %v", err)
+	}
+}
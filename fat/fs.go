@@ -0,0 +1,327 @@
+package fat
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// FS is a FAT file system read through a SectorReader. Only the sectors
+// needed are read: the boot sector when opening, then the FAT sectors of
+// the cluster chains followed and the clusters of the directories and
+// files read. FAT sectors are kept once read.
+type FS struct {
+	r    SectorReader
+	Boot BootSector
+
+	fat map[uint][]byte // FAT sectors by LBA
+}
+
+// Open reads the boot sector of a FAT file system
+func Open(ctx context.Context, r SectorReader) (*FS, error) {
+
+	sector, err := r.ReadSector(ctx, 0)
+	if err != nil {
+		return nil, fmt.Errorf("boot sector: %w", err)
+	}
+
+	boot, err := ParseBootSector(sector)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FS{r: r, Boot: boot, fat: make(map[uint][]byte)}, nil
+}
+
+func (fs *FS) read_sector(ctx context.Context, lba uint) ([]byte, error) {
+
+	data, err := fs.r.ReadSector(ctx, lba)
+	if err != nil {
+		return nil, fmt.Errorf("sector %d: %w", lba, err)
+	}
+
+	return data, nil
+}
+
+// Byte of the first FAT, reading its sector if needed
+func (fs *FS) fat_byte(ctx context.Context, offset uint) (byte, error) {
+
+	lba := fs.Boot.FATStart() + offset/SECTOR_SIZE
+
+	sector, ok := fs.fat[lba]
+	if !ok {
+		var err error
+		if sector, err = fs.read_sector(ctx, lba); err != nil {
+			return 0, err
+		}
+		fs.fat[lba] = sector
+	}
+
+	return sector[offset%SECTOR_SIZE], nil
+}
+
+// FAT entry of a cluster. A FAT12 entry may straddle two sectors.
+func (fs *FS) fat_entry(ctx context.Context, cluster uint32) (uint32, error) {
+
+	offset := fs.Boot.FATOffset(cluster)
+
+	lo, err := fs.fat_byte(ctx, offset)
+	if err != nil {
+		return 0, err
+	}
+	hi, err := fs.fat_byte(ctx, offset+1)
+	if err != nil {
+		return 0, err
+	}
+
+	return fs.Boot.FATEntry(cluster, []byte{lo, hi}), nil
+}
+
+// Clusters of the chain from start, at most limit of them
+func (fs *FS) chain(ctx context.Context, start uint32, limit uint32) ([]uint32, error) {
+
+	var clusters []uint32
+	seen := make(map[uint32]bool)
+
+	last := fs.Boot.Clusters() + 1
+	cluster := start
+
+	for uint32(len(clusters)) < limit {
+		if cluster < 2 || cluster > last {
+			return nil, fmt.Errorf("%w: cluster %d after %d clusters from %d", ErrBadChain, cluster, len(clusters), start)
+		}
+		if seen[cluster] {
+			return nil, fmt.Errorf("%w: cluster %d twice in the chain from %d", ErrBadChain, cluster, start)
+		}
+		seen[cluster] = true
+
+		clusters = append(clusters, cluster)
+
+		next, err := fs.fat_entry(ctx, cluster)
+		if err != nil {
+			return nil, err
+		}
+
+		// Bad cluster marks are just below the end marks
+		if next == fs.Boot.BadMark() {
+			return nil, fmt.Errorf("%w: cluster %d is marked bad", ErrBadChain, cluster)
+		}
+		if fs.Boot.EndOfChain(next) {
+			break
+		}
+
+		cluster = next
+	}
+
+	return clusters, nil
+}
+
+// LBA of the first sector of a cluster
+func (fs *FS) cluster_lba(cluster uint32) uint {
+	return fs.Boot.DataStart() + uint(cluster-2)*uint(fs.Boot.SectorsPerCluster)
+}
+
+// Sectors of a directory, in order: the root directory area or the
+// clusters of a subdirectory. Sectors are read one at a time by the
+// caller, which stops at the end of the entries.
+func (fs *FS) dir_sectors(ctx context.Context, dir Entry) ([]uint, error) {
+
+	var sectors []uint
+
+	if dir.Cluster == 0 {
+		for i := uint(0); i < fs.Boot.RootSectors(); i++ {
+			sectors = append(sectors, fs.Boot.RootStart()+i)
+		}
+		return sectors, nil
+	}
+
+	clusters, err := fs.chain(ctx, dir.Cluster, fs.Boot.Clusters())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cluster := range clusters {
+		for i := uint(0); i < uint(fs.Boot.SectorsPerCluster); i++ {
+			sectors = append(sectors, fs.cluster_lba(cluster)+i)
+		}
+	}
+
+	return sectors, nil
+}
+
+// Entries of a directory, with volume labels, deleted entries and the .
+// and .. entries left out
+func (fs *FS) List(ctx context.Context, dir Entry) ([]Entry, error) {
+
+	if !dir.IsDir() {
+		return nil, fmt.Errorf("%s: %w", dir.Name, ErrNotDir)
+	}
+
+	sectors, err := fs.dir_sectors(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	var names long_name
+
+	for _, lba := range sectors {
+		data, err := fs.read_sector(ctx, lba)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := uint(0); i < SECTOR_SIZE; i += DIR_ENTRY_SIZE {
+			raw := data[i : i+DIR_ENTRY_SIZE]
+
+			if raw[0] == DIR_END {
+				return entries, nil
+			}
+
+			if entry, ok := names.add(raw); ok {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// Root is the entry of the root directory
+func (fs *FS) Root() Entry {
+	return Entry{Name: "/", Attr: ATTR_DIRECTORY}
+}
+
+// Stat finds the entry of a path, from the root directory. Names match
+// their long or short form, ignoring case.
+func (fs *FS) Stat(ctx context.Context, name string) (Entry, error) {
+
+	name = path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))
+	entry := fs.Root()
+
+	if name == "/" {
+		return entry, nil
+	}
+
+	for _, part := range strings.Split(name[1:], "/") {
+		entries, err := fs.List(ctx, entry)
+		if err != nil {
+			return Entry{}, err
+		}
+
+		found := false
+		for _, e := range entries {
+			if strings.EqualFold(e.Name, part) || strings.EqualFold(e.ShortName, part) {
+				entry, found = e, true
+				break
+			}
+		}
+
+		if !found {
+			return Entry{}, fmt.Errorf("%s: %w", name, ErrNotFound)
+		}
+	}
+
+	return entry, nil
+}
+
+// ReadDir lists the directory at a path
+func (fs *FS) ReadDir(ctx context.Context, name string) ([]Entry, error) {
+
+	dir, err := fs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.List(ctx, dir)
+}
+
+// Copy writes the content of a file to w, reading its clusters one by one
+func (fs *FS) Copy(ctx context.Context, w io.Writer, file Entry) error {
+
+	if file.IsDir() {
+		return fmt.Errorf("%s: %w", file.Name, ErrIsDir)
+	}
+	if file.Size == 0 {
+		return nil
+	}
+
+	size := fs.Boot.ClusterSize()
+	count := uint32((uint(file.Size) + size - 1) / size)
+
+	clusters, err := fs.chain(ctx, file.Cluster, count)
+	if err != nil {
+		return err
+	}
+	if uint32(len(clusters)) < count {
+		return fmt.Errorf("%w: %s has %d clusters for %d bytes", ErrBadChain, file.Name, len(clusters), file.Size)
+	}
+
+	left := uint(file.Size)
+
+	for _, cluster := range clusters {
+		for i := uint(0); i < uint(fs.Boot.SectorsPerCluster) && left > 0; i++ {
+			data, err := fs.read_sector(ctx, fs.cluster_lba(cluster)+i)
+			if err != nil {
+				return err
+			}
+
+			n := min(left, SECTOR_SIZE)
+			if _, err := w.Write(data[:n]); err != nil {
+				return err
+			}
+			left -= n
+		}
+	}
+
+	return nil
+}
+
+// ReadFile reads the file at a path
+func (fs *FS) ReadFile(ctx context.Context, name string) ([]byte, error) {
+
+	file, err := fs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var data bytes.Buffer
+	if err := fs.Copy(ctx, &data, file); err != nil {
+		return nil, err
+	}
+
+	return data.Bytes(), nil
+}
+
+// Label is the volume label of the root directory, or the one of the boot
+// sector
+func (fs *FS) Label(ctx context.Context) (string, error) {
+
+	sectors, err := fs.dir_sectors(ctx, fs.Root())
+	if err != nil {
+		return "", err
+	}
+
+	for _, lba := range sectors {
+		data, err := fs.read_sector(ctx, lba)
+		if err != nil {
+			return "", err
+		}
+
+		for i := uint(0); i < SECTOR_SIZE; i += DIR_ENTRY_SIZE {
+			raw := data[i : i+DIR_ENTRY_SIZE]
+
+			if raw[0] == DIR_END {
+				return fs.Boot.Label, nil
+			}
+			if raw[0] != DIR_DELETED && raw[11]&ATTR_LONG_NAME == ATTR_VOLUME {
+				return ParseDirEntry(raw).ShortName, nil
+			}
+		}
+	}
+
+	return fs.Boot.Label, nil
+}
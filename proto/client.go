@@ -0,0 +1,473 @@
+package proto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/albenik/go-serial"
+)
+
+// Client talks to the floppy controller over a serial port.
+// It is safe to use from multiple goroutines: commands are serialized.
+type Client struct {
+	port     serial.Port
+	name     string
+	mu       sync.Mutex
+	geometry Geometry
+
+	// CAP_* flags of the firmware, once asked
+	capabilities     byte
+	has_capabilities bool
+}
+
+// NewClient wraps an already open serial port
+func NewClient(port serial.Port, name string) *Client {
+	return &Client{port: port, name: name, geometry: FIRMWARE_GEOMETRY}
+}
+
+// Open opens the serial port called name, waits reset_delay for the
+// Arduino to reset and performs the handshake
+func Open(ctx context.Context, name string, reset_delay time.Duration) (*Client, error) {
+
+	mode := &serial.Mode{
+		BaudRate: BAUD_RATE,
+	}
+
+	// Try to open port
+	port, err := serial.Open(name, mode)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait for Arduino to reset
+	select {
+	case <-time.After(reset_delay):
+	case <-ctx.Done():
+		port.Close()
+		return nil, ctx.Err()
+	}
+
+	client := NewClient(port, name)
+
+	// Perform handshake on port
+	err = client.Handshake(ctx)
+
+	if err != nil {
+		port.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// Find tries to handshake on every available serial port and returns a
+// client for the first one that answers
+func Find(ctx context.Context, reset_delay time.Duration) (*Client, error) {
+
+	// Get serial ports list
+	port_names, err := serial.GetPortsList()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// If there are no ports available
+	if len(port_names) == 0 {
+		return nil, ErrNoPorts
+	}
+
+	// Repeat for each available port
+	for _, name := range port_names {
+
+		// Try to handhsake with device at this port
+		client, err := Open(ctx, name, reset_delay)
+
+		// If handshake succesful, use this port
+		if err == nil {
+			return client, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// Name returns the name of the serial port
+func (c *Client) Name() string {
+	return c.name
+}
+
+// Geometry returns the format of the disk in the drive
+func (c *Client) Geometry() Geometry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.geometry
+}
+
+// SetGeometry sets the format of the disk in the drive, which block
+// addresses are mapped with. Formats other than FIRMWARE_GEOMETRY are read
+// sector by sector, as the firmware's LBA commands assume its own layout.
+func (c *Client) SetGeometry(g Geometry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.geometry = g
+}
+
+// Close closes the serial port
+func (c *Client) Close() error {
+	return c.port.Close()
+}
+
+// Handshake checks that the device on the other end is the floppy controller
+func (c *Client) Handshake(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Clear any stuff still in input buffer
+	c.port.ResetInputBuffer()
+
+	// Send handshake
+	if err := write_byte(c.port, CMD_HANDSHAKE); err != nil {
+		return err
+	}
+
+	// Expect handshake back
+	res, err := read_byte(ctx, c.port, READ_TIMEOUT)
+
+	if err != nil {
+		return err
+	}
+
+	if res != CMD_HANDSHAKE {
+		return ErrInvalidHandshake
+	}
+
+	return nil
+}
+
+// Capabilities asks the firmware which optional commands it has, as
+// CAP_* flags. The answer is kept for later calls.
+func (c *Client) Capabilities(ctx context.Context) (byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.query_capabilities(ctx)
+}
+
+func (c *Client) query_capabilities(ctx context.Context) (byte, error) {
+
+	if c.has_capabilities {
+		return c.capabilities, nil
+	}
+
+	c.port.ResetInputBuffer()
+
+	if err := write_byte(c.port, CMD_CAPABILITIES); err != nil {
+		return 0, err
+	}
+
+	res, err := read_byte(ctx, c.port, READ_TIMEOUT)
+
+	// Older firmware ignores the command
+	if errors.Is(err, ErrTimeout) {
+		c.has_capabilities = true
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if res != CMD_CAPABILITIES {
+		return 0, ErrNoAck
+	}
+
+	flags, err := read_byte(ctx, c.port, READ_TIMEOUT)
+
+	if err != nil {
+		return 0, err
+	}
+
+	c.capabilities, c.has_capabilities = flags, true
+
+	return flags, nil
+}
+
+// Initialize makes the drive seek to track 0
+func (c *Client) Initialize(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.port.ResetInputBuffer()
+
+	// Send initialization command
+	if err := write_byte(c.port, CMD_INITIALIZE); err != nil {
+		return err
+	}
+
+	return c.read_result(ctx, ErrInitialization)
+}
+
+// ReadSector reads a single sector addressed by cylinder, head and sector.
+// If the sector is read but its CRC is wrong, the damaged data is returned
+// along with an error wrapping both ErrFloppyRead and ErrBadCRC.
+func (c *Client) ReadSector(ctx context.Context, cylinder byte, head byte, sector byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.read_sector(ctx, cylinder, head, sector)
+}
+
+func (c *Client) read_sector(ctx context.Context, cylinder byte, head byte, sector byte) ([]byte, error) {
+
+	c.port.ResetInputBuffer()
+
+	// Send read sector command
+	if err := write_bytes(c.port, []byte{CMD_READ_SECTOR, cylinder, head, sector}); err != nil {
+		return []byte{}, err
+	}
+
+	err := c.read_result(ctx, ErrFloppyRead)
+
+	if errors.Is(err, ErrBadCRC) {
+		data, read_err := read_bytes(ctx, c.port, SECTOR_SIZE, READ_TIMEOUT)
+		if read_err != nil {
+			return []byte{}, read_err
+		}
+		return data, err
+	}
+
+	if err != nil {
+		return []byte{}, err
+	}
+
+	// If result is OK, read data
+	return read_bytes(ctx, c.port, SECTOR_SIZE, READ_TIMEOUT)
+}
+
+// ReadBlocks reads amount consecutive blocks starting at LBA address
+func (c *Client) ReadBlocks(ctx context.Context, address uint16, amount byte) ([]byte, error) {
+
+	if amount == 0 || amount > READ_BLOCKS_MAX_AMOUNT {
+		return []byte{}, ErrInvalidAmount
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.geometry != FIRMWARE_GEOMETRY {
+		return c.read_blocks_chs(ctx, address, amount)
+	}
+
+	c.port.ResetInputBuffer()
+
+	// Send read block command
+	if err := write_byte(c.port, CMD_READ_BLOCKS); err != nil {
+		return []byte{}, err
+	}
+	if err := write_uint16(c.port, address); err != nil {
+		return []byte{}, err
+	}
+	if err := write_byte(c.port, amount); err != nil {
+		return []byte{}, err
+	}
+
+	if err := c.read_result(ctx, ErrFloppyRead); err != nil {
+		return []byte{}, err
+	}
+
+	// If result is OK, read data
+	return read_bytes(ctx, c.port, SECTOR_SIZE*uint(amount), READ_TIMEOUT)
+}
+
+// Read blocks one sector at a time, mapping addresses with the client's
+// geometry
+func (c *Client) read_blocks_chs(ctx context.Context, address uint16, amount byte) ([]byte, error) {
+
+	if uint(address)+uint(amount) > c.geometry.Blocks() {
+		return []byte{}, ErrOutOfRange
+	}
+
+	data := make([]byte, 0, SECTOR_SIZE*uint(amount))
+
+	for i := uint(0); i < uint(amount); i++ {
+		cylinder, head, sector := c.geometry.LBAToCHS(uint(address) + i)
+
+		block, err := c.read_sector(ctx, cylinder, head, sector)
+
+		if err != nil {
+			return []byte{}, err
+		}
+
+		data = append(data, block...)
+	}
+
+	return data, nil
+}
+
+// ReadBlocksRetries is like ReadBlocks but tries again up to retries
+// times on failure
+func (c *Client) ReadBlocksRetries(ctx context.Context, address uint16, amount byte, retries uint) ([]byte, error) {
+
+	var data []byte
+	var err error
+
+	// Always do at least 1 try
+	retries++
+
+	for retries > 0 {
+		data, err = c.ReadBlocks(ctx, address, amount)
+
+		if err == nil || ctx.Err() != nil {
+			return data, err
+		}
+
+		retries--
+	}
+
+	return data, err
+}
+
+// WriteBlocks writes data to consecutive blocks starting at LBA address.
+// data must hold between 1 and WRITE_BLOCKS_MAX_AMOUNT whole blocks.
+//
+// The command is followed by the payload and its CRC16, the controller
+// answers with ACK and then OK or ERROR. Firmware without CAP_WRITE would
+// take the payload for commands, so nothing is sent to it and
+// ErrWriteUnsupported is returned.
+func (c *Client) WriteBlocks(ctx context.Context, address uint16, data []byte) error {
+
+	amount := uint(len(data)) / SECTOR_SIZE
+
+	if amount == 0 || amount > uint(WRITE_BLOCKS_MAX_AMOUNT) || uint(len(data))%SECTOR_SIZE != 0 {
+		return ErrInvalidAmount
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The firmware can only write by LBA, with its own layout
+	if c.geometry != FIRMWARE_GEOMETRY {
+		return ErrGeometry
+	}
+
+	capabilities, err := c.query_capabilities(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if capabilities&CAP_WRITE == 0 {
+		return ErrWriteUnsupported
+	}
+
+	c.port.ResetInputBuffer()
+
+	// Send write blocks command
+	if err := write_byte(c.port, CMD_WRITE_BLOCKS); err != nil {
+		return err
+	}
+	if err := write_uint16(c.port, address); err != nil {
+		return err
+	}
+	if err := write_byte(c.port, byte(amount)); err != nil {
+		return err
+	}
+
+	// Send payload
+	if err := write_bytes(c.port, data); err != nil {
+		return err
+	}
+	if err := write_uint16(c.port, CRC16(data)); err != nil {
+		return err
+	}
+
+	return c.read_result(ctx, ErrFloppyWrite)
+}
+
+// WriteBlocksRetries is like WriteBlocks but reads the blocks back after
+// writing them, and tries again up to retries times if either step fails
+func (c *Client) WriteBlocksRetries(ctx context.Context, address uint16, data []byte, retries uint) error {
+
+	var err error
+
+	// Always do at least 1 try
+	retries++
+
+	for retries > 0 {
+		err = c.write_and_verify(ctx, address, data)
+
+		// Trying again won't make the firmware able to write
+		if err == nil || ctx.Err() != nil || errors.Is(err, ErrWriteUnsupported) {
+			return err
+		}
+
+		retries--
+	}
+
+	return err
+}
+
+func (c *Client) write_and_verify(ctx context.Context, address uint16, data []byte) error {
+
+	if err := c.WriteBlocks(ctx, address, data); err != nil {
+		return err
+	}
+
+	// Read data back
+	readback, err := c.ReadBlocks(ctx, address, byte(uint(len(data))/SECTOR_SIZE))
+
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(readback, data) {
+		return ErrWriteVerify
+	}
+
+	return nil
+}
+
+// Wait for the ACK and the result of the command just sent.
+// fail is returned if the controller reports an error
+func (c *Client) read_result(ctx context.Context, fail error) error {
+
+	// Expect ACK
+	res, err := read_byte(ctx, c.port, READ_TIMEOUT)
+
+	if err != nil {
+		return err
+	}
+
+	if res != CMD_ACK {
+		return ErrNoAck
+	}
+
+	// Read result
+	res, err = read_byte(ctx, c.port, READ_TIMEOUT_OP)
+
+	if err != nil {
+		return err
+	}
+
+	// Only a sector read sends data along with an error
+	if res == CMD_ERROR_DATA {
+		return fmt.Errorf("%w: %w", fail, ErrBadCRC)
+	}
+
+	if res != CMD_OK {
+		return fail
+	}
+
+	return nil
+}
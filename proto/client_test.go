@@ -0,0 +1,108 @@
+package proto_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+func TestReadSectorBadCRC(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+
+	lba := uint(40)
+	crc, not_found := emulator.CRC, emulator.SECTOR_NOT_FOUND
+	not_found_lba := uint(41)
+	profile := &emulator.Profile{
+		Sectors: []emulator.SectorFault{
+			{LBA: &lba, Error: &crc, CorruptBytes: 3},
+			{LBA: &not_found_lba, Error: &not_found},
+		},
+	}
+	client := emulatortest.StartClient(t, image, proto.FORMAT_1440K, profile)
+	ctx := context.Background()
+
+	want := image[lba*proto.SECTOR_SIZE : (lba+1)*proto.SECTOR_SIZE]
+	cylinder, head, sector := proto.FORMAT_1440K.LBAToCHS(lba)
+
+	// Damaged data comes along with the error
+	data, err := client.ReadSector(ctx, cylinder, head, sector)
+	if !errors.Is(err, proto.ErrBadCRC) || !errors.Is(err, proto.ErrFloppyRead) {
+		t.Fatalf("err = %v, want ErrBadCRC", err)
+	}
+	if uint(len(data)) != proto.SECTOR_SIZE {
+		t.Fatalf("got %d bytes", len(data))
+	}
+	differ := 0
+	for i := range data {
+		if data[i] != want[i] {
+			differ++
+		}
+	}
+	if differ == 0 || differ > 3 {
+		t.Errorf("%d bytes differ, want 1 to 3", differ)
+	}
+
+	// No data without a CRC error
+	cylinder, head, sector = proto.FORMAT_1440K.LBAToCHS(not_found_lba)
+	if data, err := client.ReadSector(ctx, cylinder, head, sector); !errors.Is(err, proto.ErrFloppyRead) || errors.Is(err, proto.ErrBadCRC) || len(data) != 0 {
+		t.Errorf("sector not found: %d bytes, err = %v", len(data), err)
+	}
+
+	// Block reads don't send data on errors, and the link is still in sync
+	if _, err := client.ReadBlocks(ctx, uint16(lba), 1); !errors.Is(err, proto.ErrFloppyRead) || errors.Is(err, proto.ErrBadCRC) {
+		t.Errorf("ReadBlocks err = %v", err)
+	}
+	if data, err := client.ReadBlocks(ctx, 0, 1); err != nil || !bytes.Equal(data, image[:proto.SECTOR_SIZE]) {
+		t.Errorf("ReadBlocks after errors: %v", err)
+	}
+}
+
+func TestWriteUnsupported(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	ctx := context.Background()
+
+	client := emulatortest.StartClient(t, image, proto.FORMAT_1440K, nil)
+	if capabilities, err := client.Capabilities(ctx); err != nil || capabilities&proto.CAP_WRITE == 0 {
+		t.Errorf("capabilities = %#x, %v", capabilities, err)
+	}
+
+	// Firmware without the write command is not sent the payload
+	client = emulatortest.StartClient(t, image, proto.FORMAT_1440K, &emulator.Profile{NoWrite: true})
+	if capabilities, err := client.Capabilities(ctx); err != nil || capabilities != 0 {
+		t.Errorf("capabilities without write = %#x, %v", capabilities, err)
+	}
+
+	data := bytes.Repeat([]byte{'R'}, int(proto.SECTOR_SIZE))
+	if err := client.WriteBlocksRetries(ctx, 0, data, 3); !errors.Is(err, proto.ErrWriteUnsupported) {
+		t.Errorf("WriteBlocks err = %v", err)
+	}
+	if read, err := client.ReadBlocks(ctx, 0, 1); err != nil || !bytes.Equal(read, image[:proto.SECTOR_SIZE]) {
+		t.Errorf("ReadBlocks after a refused write: %v", err)
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	tests := []struct {
+		err  error
+		kind string
+	}{
+		{fmt.Errorf("%w: %w", proto.ErrFloppyRead, proto.ErrBadCRC), proto.ERROR_KIND_CRC},
+		{proto.ErrFloppyRead, proto.ERROR_KIND_READ},
+		{fmt.Errorf("sector 5: %w", proto.ErrTimeout), proto.ERROR_KIND_TIMEOUT},
+		{proto.ErrNoAck, proto.ERROR_KIND_NO_ACK},
+		{io.ErrUnexpectedEOF, proto.ERROR_KIND_IO},
+	}
+
+	for _, test := range tests {
+		if kind := proto.ErrorKind(test.err); kind != test.kind {
+			t.Errorf("ErrorKind(%v) = %s, want %s", test.err, kind, test.kind)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package proto
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+)
+
+// Reads tried per sector while detecting the format
+const DETECT_RETRIES uint = 2
+
+// BPB holds the fields of a FAT BIOS Parameter Block that describe the
+// disk layout
+type BPB struct {
+	BytesPerSector  uint16
+	SectorsPerTrack uint16
+	Heads           uint16
+	TotalSectors    uint32
+	MediaDescriptor byte
+}
+
+// ParseBPB decodes and sanity-checks the BPB in a boot sector. Only the
+// fields giving the disk layout are read, package fat reads the file system.
+func ParseBPB(sector []byte) (BPB, error) {
+
+	if len(sector) < int(SECTOR_SIZE) {
+		return BPB{}, ErrNoBPB
+	}
+
+	bpb := BPB{
+		BytesPerSector:  binary.LittleEndian.Uint16(sector[0x0B:]),
+		SectorsPerTrack: binary.LittleEndian.Uint16(sector[0x18:]),
+		Heads:           binary.LittleEndian.Uint16(sector[0x1A:]),
+		TotalSectors:    uint32(binary.LittleEndian.Uint16(sector[0x13:])),
+		MediaDescriptor: sector[0x15],
+	}
+
+	// Large disks store the total in the 32 bit field
+	if bpb.TotalSectors == 0 {
+		bpb.TotalSectors = binary.LittleEndian.Uint32(sector[0x20:])
+	}
+
+	switch {
+	case sector[0] != 0xEB && sector[0] != 0xE9:
+		return BPB{}, fmt.Errorf("%w: no jump instruction", ErrNoBPB)
+	case uint(bpb.BytesPerSector) != SECTOR_SIZE:
+		return BPB{}, fmt.Errorf("%w: %d bytes per sector", ErrNoBPB, bpb.BytesPerSector)
+	case bpb.SectorsPerTrack == 0 || bpb.SectorsPerTrack > 63:
+		return BPB{}, fmt.Errorf("%w: %d sectors per track", ErrNoBPB, bpb.SectorsPerTrack)
+	case bpb.Heads == 0 || bpb.Heads > 2:
+		return BPB{}, fmt.Errorf("%w: %d heads", ErrNoBPB, bpb.Heads)
+	case bpb.MediaDescriptor != 0xF0 && bpb.MediaDescriptor < 0xF8:
+		return BPB{}, fmt.Errorf("%w: media descriptor %#x", ErrNoBPB, bpb.MediaDescriptor)
+	case bpb.TotalSectors == 0 || bpb.TotalSectors%(uint32(bpb.SectorsPerTrack)*uint32(bpb.Heads)) != 0:
+		return BPB{}, fmt.Errorf("%w: %d total sectors", ErrNoBPB, bpb.TotalSectors)
+	}
+
+	return bpb, nil
+}
+
+// Geometry returns the disk layout described by the BPB, one of FORMATS if
+// it matches
+func (b BPB) Geometry() (Geometry, error) {
+
+	tracks := b.TotalSectors / (uint32(b.SectorsPerTrack) * uint32(b.Heads))
+
+	if tracks == 0 || tracks > 255 {
+		return Geometry{}, fmt.Errorf("%w: %d tracks", ErrNoBPB, tracks)
+	}
+
+	g := Geometry{Tracks: byte(tracks), Heads: byte(b.Heads), Sectors: byte(b.SectorsPerTrack)}
+
+	for _, format := range FORMATS {
+		if format.Tracks == g.Tracks && format.Heads == g.Heads && format.Sectors == g.Sectors {
+			return format, nil
+		}
+	}
+
+	g.Name = fmt.Sprintf("%dK", g.Size()/1024)
+	return g, nil
+}
+
+func (c *Client) sector_readable(ctx context.Context, cylinder byte, head byte, sector byte) bool {
+	for i := uint(0); i <= DETECT_RETRIES; i++ {
+		if _, err := c.ReadSector(ctx, cylinder, head, sector); err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// DetectFormat finds out the format of the disk in the drive, which must be
+// initialized. The BPB in the boot sector is used if it is valid and
+// agrees with the disk, otherwise the highest readable sector on track 0
+// decides. The second value tells whether the BPB was used.
+func (c *Client) DetectFormat(ctx context.Context) (Geometry, bool, error) {
+
+	// Boot sector is at 0/0/1 whatever the format
+	boot, err := c.ReadSector(ctx, 0, 0, 1)
+
+	if err == nil {
+		bpb, err := ParseBPB(boot)
+
+		if err == nil {
+			g, err := bpb.Geometry()
+
+			// Last sector of the first track must exist
+			if err == nil && c.sector_readable(ctx, 0, 0, g.Sectors) {
+				return g, true, nil
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		return Geometry{}, false, ctx.Err()
+	}
+
+	// Probe from the largest format down
+	for i := len(FORMATS) - 1; i >= 0; i-- {
+		g := FORMATS[i]
+
+		// Told apart from 720K by the number of tracks
+		if g == FORMAT_360K {
+			continue
+		}
+
+		if !c.sector_readable(ctx, 0, 0, g.Sectors) {
+			continue
+		}
+
+		if g == FORMAT_720K && !c.sector_readable(ctx, FORMAT_720K.Tracks-1, 0, 1) {
+			return FORMAT_360K, false, nil
+		}
+
+		return g, false, nil
+	}
+
+	if ctx.Err() != nil {
+		return Geometry{}, false, ctx.Err()
+	}
+
+	return Geometry{}, false, ErrUnknownFormat
+}
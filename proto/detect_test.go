@@ -0,0 +1,81 @@
+package proto_test
+
+import (
+	"context"
+	"testing"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+// Boot sector of a disk of layout g formatted by DOS, with another media
+// descriptor
+func boot_sector(g proto.Geometry, media byte) []byte {
+	boot := emulatortest.FormatImage(g, "", 0)[:proto.SECTOR_SIZE]
+	boot[0x15] = media
+	return boot
+}
+
+func TestParseBPB(t *testing.T) {
+	bpb, err := proto.ParseBPB(boot_sector(proto.FORMAT_1440K, 0xF0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, err := bpb.Geometry(); err != nil || g != proto.FORMAT_1440K {
+		t.Errorf("Geometry() = %v, %v", g, err)
+	}
+
+	// DMF, not in the table
+	dmf := proto.Geometry{Tracks: 80, Heads: 2, Sectors: 21}
+	bpb, err = proto.ParseBPB(boot_sector(dmf, 0xF0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, err := bpb.Geometry(); err != nil || g.Name != "1680K" || g.Sectors != 21 {
+		t.Errorf("Geometry() = %v, %v", g, err)
+	}
+
+	bad_media := boot_sector(proto.FORMAT_720K, 0x12)
+	bad_heads := boot_sector(proto.Geometry{Tracks: 80, Heads: 4, Sectors: 9}, 0xF9)
+	no_jump := boot_sector(proto.FORMAT_720K, 0xF9)
+	no_jump[0] = 0
+
+	for name, sector := range map[string][]byte{"media": bad_media, "heads": bad_heads, "jump": no_jump, "empty": make([]byte, 512)} {
+		if _, err := proto.ParseBPB(sector); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   proto.Geometry
+		boot     []byte
+		from_bpb bool
+	}{
+		{"720K with BPB", proto.FORMAT_720K, boot_sector(proto.FORMAT_720K, 0xF9), true},
+		{"1.44M with BPB", proto.FORMAT_1440K, boot_sector(proto.FORMAT_1440K, 0xF0), true},
+		{"360K", proto.FORMAT_360K, nil, false},
+		{"720K", proto.FORMAT_720K, nil, false},
+		{"1.2M", proto.FORMAT_1200K, nil, false},
+		{"1.44M", proto.FORMAT_1440K, nil, false},
+		{"2.88M", proto.FORMAT_2880K, nil, false},
+		// BPB claims more sectors than the disk has
+		{"1.44M with wrong BPB", proto.FORMAT_1440K, boot_sector(proto.FORMAT_2880K, 0xF0), false},
+	}
+
+	for _, test := range tests {
+		client := emulatortest.StartClient(t, test.boot, test.format, nil)
+
+		format, from_bpb, err := client.DetectFormat(context.Background())
+
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if format != test.format || from_bpb != test.from_bpb {
+			t.Errorf("%s: detected %s (from BPB %t), want %s (from BPB %t)", test.name, format, from_bpb, test.format, test.from_bpb)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Package emulatortest starts emulated Arduinos and builds disk images for
+// tests.
+package emulatortest
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator"
+)
+
+// StartClient starts an emulated Arduino on a pty with a disk holding image
+// in the drive, and returns a client connected to it that uses format.
+// A nil image is a blank disk, a nil profile injects no faults. Both are
+// closed when the test ends.
+func StartClient(t testing.TB, image []byte, format proto.Geometry, profile *emulator.Profile) *proto.Client {
+	t.Helper()
+
+	floppy, err := emulator.NewFloppyFormat(image, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := floppy.SetProfile(profile); err != nil {
+		t.Fatal(err)
+	}
+
+	emu := emulator.New(floppy)
+	name, err := emu.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { emu.Close() })
+
+	ctx := context.Background()
+
+	client, err := proto.Open(ctx, name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	if err := client.Initialize(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetGeometry(format)
+
+	return client
+}
+
+// RandomImage is a disk image of format full of random bytes, the same on
+// every run
+func RandomImage(format proto.Geometry) []byte {
+	image := make([]byte, format.Size())
+	rand.New(rand.NewSource(1)).Read(image)
+	return image
+}
+
+// FormatImage is a disk image of format with an empty FAT12 file system,
+// laid out the way DOS formats a disk of that size. The label and serial
+// only go in the boot sector.
+func FormatImage(format proto.Geometry, label string, serial uint32) []byte {
+
+	image := make([]byte, format.Size())
+	total := format.Blocks()
+
+	// Sectors per cluster, root directory entries and media descriptor
+	cluster, root, media := uint(1), uint(224), byte(0xF0)
+	switch total {
+	case proto.FORMAT_360K.Blocks():
+		cluster, root, media = 2, 112, 0xFD
+	case proto.FORMAT_720K.Blocks():
+		cluster, root, media = 2, 112, 0xF9
+	case proto.FORMAT_1200K.Blocks():
+		media = 0xF9
+	case proto.FORMAT_2880K.Blocks():
+		cluster, root = 2, 240
+	}
+
+	// FAT12 entries are a byte and a half
+	root_sectors := root * 32 / proto.SECTOR_SIZE
+	clusters := (total - 1 - root_sectors) / cluster
+	fat := ((clusters+2)*3/2 + proto.SECTOR_SIZE - 1) / proto.SECTOR_SIZE
+
+	if label == "" {
+		label = "NO NAME"
+	}
+
+	copy(image, []byte{0xEB, 0x3C, 0x90})
+	copy(image[0x03:], "MSDOS5.0")
+	binary.LittleEndian.PutUint16(image[0x0B:], uint16(proto.SECTOR_SIZE))
+	image[0x0D] = byte(cluster)
+	binary.LittleEndian.PutUint16(image[0x0E:], 1)
+	image[0x10] = 2
+	binary.LittleEndian.PutUint16(image[0x11:], uint16(root))
+	binary.LittleEndian.PutUint16(image[0x13:], uint16(total))
+	image[0x15] = media
+	binary.LittleEndian.PutUint16(image[0x16:], uint16(fat))
+	binary.LittleEndian.PutUint16(image[0x18:], uint16(format.Sectors))
+	binary.LittleEndian.PutUint16(image[0x1A:], uint16(format.Heads))
+	image[0x26] = 0x29
+	binary.LittleEndian.PutUint32(image[0x27:], serial)
+	copy(image[0x2B:], fmt.Sprintf("%-11.11s%-8s", label, "FAT12"))
+	binary.LittleEndian.PutUint16(image[0x1FE:], 0xAA55)
+
+	// Clusters 0 and 1 of both FATs hold the media descriptor
+	for i := uint(0); i < 2; i++ {
+		copy(image[(1+i*fat)*proto.SECTOR_SIZE:], []byte{media, 0xFF, 0xFF})
+	}
+
+	return image
+}
@@ -0,0 +1,359 @@
+package emulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"floppy_arduino/proto"
+)
+
+// Profile describes the faults the emulated controller injects.
+//
+// Example:
+//
+//	{
+//	  "seed": 42,
+//	  "sectors": [
+//	    {"lba": 10, "error": "CRC"},
+//	    {"chs": [5, 1, 3], "error": "SECTOR_NOT_FOUND"},
+//	    {"lba": 20, "error": "CRC", "fail_count": 2},
+//	    {"lba": 30, "error": "CRC", "corrupt_bytes": 4},
+//	    {"lba": 40, "delay_ms": 300}
+//	  ],
+//	  "transient": {"probability": 0.01, "error": "CRC", "fail_count": 2},
+//	  "drop_bytes": {"probability": 0.005, "count": 64},
+//	  "delay_result": {"probability": 0.005, "delay_ms": 6000},
+//	  "rotation": {"rpm": 300, "interleave": 1}
+//	}
+type Profile struct {
+	// Seed of the random generator used for probabilistic faults
+	Seed int64 `json:"seed"`
+
+	// No disk in the drive: every read fails with NO_PULSE
+	EmptyDrive bool `json:"empty_drive"`
+
+	// Faults on specific sectors
+	Sectors []SectorFault `json:"sectors"`
+
+	// Random sectors fail for a few reads, then read fine
+	Transient *TransientFault `json:"transient"`
+
+	// Random payloads are sent with some bytes missing
+	DropBytes *DropFault `json:"drop_bytes"`
+
+	// Random ACKs and results are sent late
+	DelayAck    *DelayFault `json:"delay_ack"`
+	DelayResult *DelayFault `json:"delay_result"`
+
+	// Reads wait for the disk to turn
+	Rotation *RotationModel `json:"rotation"`
+
+	// Firmware without write support, from before CMD_CAPABILITIES: both
+	// it and CMD_WRITE_BLOCKS are ignored
+	NoWrite bool `json:"no_write"`
+}
+
+// SectorFault makes a sector addressed either by LBA or by CHS fail.
+// If FailCount is 0 the sector never reads, otherwise it fails FailCount
+// times and then reads fine.
+// With a CRC error, CorruptBytes random bytes of the data sent along are
+// wrong, different ones on every read, like a weak sector.
+// DelayMs makes every read of the sector that much slower, a fault with
+// only a delay reads fine.
+type SectorFault struct {
+	LBA          *uint        `json:"lba"`
+	CHS          *[3]byte     `json:"chs"`
+	Error        *FloppyError `json:"error"`
+	FailCount    uint         `json:"fail_count"`
+	CorruptBytes uint         `json:"corrupt_bytes"`
+	DelayMs      uint         `json:"delay_ms"`
+}
+
+type TransientFault struct {
+	Probability float64      `json:"probability"`
+	Error       *FloppyError `json:"error"`
+	FailCount   uint         `json:"fail_count"`
+}
+
+type DropFault struct {
+	Probability float64 `json:"probability"`
+	Count       uint    `json:"count"`
+}
+
+type DelayFault struct {
+	Probability float64 `json:"probability"`
+	DelayMs     uint    `json:"delay_ms"`
+}
+
+// LoadProfile reads a JSON fault profile
+func LoadProfile(path string) (*Profile, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Profile
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return &p, nil
+}
+
+func (e FloppyError) MarshalText() ([]byte, error) {
+	return []byte(e.String()), nil
+}
+
+func (e *FloppyError) UnmarshalText(text []byte) error {
+	for i, name := range floppy_error_names {
+		if name == string(text) {
+			*e = FloppyError(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown floppy error %q", text)
+}
+
+// Fault injection state
+type faults struct {
+	profile *Profile
+	rand    *rand.Rand
+
+	// Sector faults by LBA
+	sectors map[uint]*SectorFault
+
+	// Remaining failures of sectors that eventually read
+	pending map[uint]uint
+
+	rotation *rotation
+}
+
+func new_faults(p *Profile, disk proto.Geometry) (*faults, error) {
+
+	f := &faults{
+		profile: p,
+		rand:    rand.New(rand.NewSource(p.Seed)),
+		sectors: make(map[uint]*SectorFault),
+		pending: make(map[uint]uint),
+	}
+
+	for i := range p.Sectors {
+		s := &p.Sectors[i]
+
+		var lba uint
+		switch {
+		case s.LBA != nil && s.CHS == nil:
+			lba = *s.LBA
+		case s.CHS != nil && s.LBA == nil:
+			c, h, sec := s.CHS[0], s.CHS[1], s.CHS[2]
+			if !disk.Contains(c, h, sec) {
+				return nil, fmt.Errorf("sector fault %d: CHS %d/%d/%d out of range", i, c, h, sec)
+			}
+			lba = disk.CHSToLBA(c, h, sec)
+		default:
+			return nil, fmt.Errorf("sector fault %d: exactly one of lba and chs required", i)
+		}
+
+		if lba >= disk.Blocks() {
+			return nil, fmt.Errorf("sector fault %d: LBA %d out of range", i, lba)
+		}
+		if (s.Error == nil && s.DelayMs == 0) || (s.Error != nil && *s.Error == OK) {
+			return nil, fmt.Errorf("sector fault %d: missing error", i)
+		}
+
+		f.sectors[lba] = s
+		if s.FailCount > 0 && s.Error != nil {
+			f.pending[lba] = s.FailCount
+		}
+	}
+
+	if t := p.Transient; t != nil && (t.Error == nil || *t.Error == OK) {
+		return nil, fmt.Errorf("transient fault: missing error")
+	}
+
+	if p.Rotation != nil {
+		r, err := new_rotation(p.Rotation, disk.Sectors)
+		if err != nil {
+			return nil, err
+		}
+		f.rotation = r
+	}
+
+	return f, nil
+}
+
+func (f *faults) chance(p float64) bool {
+	return p > 0 && f.rand.Float64() < p
+}
+
+// Error to report when reading sector lba, or OK
+func (f *faults) sector_error(lba uint) FloppyError {
+	if f == nil {
+		return OK
+	}
+
+	if f.profile.EmptyDrive {
+		return NO_PULSE
+	}
+
+	s := f.sectors[lba]
+
+	// Sector still has failures left
+	if n, ok := f.pending[lba]; ok {
+		if n <= 1 {
+			delete(f.pending, lba)
+		} else {
+			f.pending[lba] = n - 1
+		}
+
+		if s != nil && s.Error != nil {
+			return *s.Error
+		}
+		return *f.profile.Transient.Error
+	}
+
+	// Persistent error
+	if s != nil && s.Error != nil && s.FailCount == 0 {
+		return *s.Error
+	}
+
+	// Sector goes bad for a while
+	if t := f.profile.Transient; t != nil && f.chance(t.Probability) {
+		if t.FailCount > 1 {
+			f.pending[lba] = t.FailCount - 1
+		}
+		return *t.Error
+	}
+
+	return OK
+}
+
+// Error to report when writing sector lba, or OK. Only faults that stop
+// the controller from finding the sector affect writes: bad data is
+// simply overwritten, which fixes the sector.
+func (f *faults) write_error(lba uint) FloppyError {
+	if f == nil {
+		return OK
+	}
+
+	if f.profile.EmptyDrive {
+		return NO_PULSE
+	}
+
+	s := f.sectors[lba]
+	if s == nil || s.Error == nil {
+		return OK
+	}
+
+	if *s.Error == CRC || *s.Error == INCORRECT_DATA_MARK {
+		delete(f.sectors, lba)
+		delete(f.pending, lba)
+		return OK
+	}
+
+	if s.FailCount == 0 {
+		return *s.Error
+	}
+
+	return OK
+}
+
+// Damage the data of sector lba read with a CRC error
+func (f *faults) corrupt(lba uint, data []byte) {
+	if f == nil {
+		return
+	}
+
+	s := f.sectors[lba]
+	if s == nil {
+		return
+	}
+
+	for i := uint(0); i < s.CorruptBytes; i++ {
+		data[f.rand.Intn(len(data))] ^= byte(1 + f.rand.Intn(255))
+	}
+}
+
+// Remove some bytes from the middle of data
+func (f *faults) drop_bytes(data []byte) []byte {
+	if f == nil || f.profile.DropBytes == nil || len(data) == 0 {
+		return data
+	}
+
+	d := f.profile.DropBytes
+	if !f.chance(d.Probability) {
+		return data
+	}
+
+	count := int(min(d.Count, uint(len(data))))
+	start := f.rand.Intn(len(data) - count + 1)
+
+	res := make([]byte, 0, len(data)-count)
+	res = append(res, data[:start]...)
+	res = append(res, data[start+count:]...)
+
+	return res
+}
+
+func (f *faults) delay(d *DelayFault) {
+	if d == nil || !f.chance(d.Probability) {
+		return
+	}
+
+	time.Sleep(time.Duration(d.DelayMs) * time.Millisecond)
+}
+
+// Wait for sector to come under the head
+func (f *faults) rotate(sector byte) {
+	if f != nil && f.rotation != nil {
+		f.rotation.wait(sector)
+	}
+}
+
+// Slow down reads of sector lba
+func (f *faults) sector_delay(lba uint) {
+	if f == nil {
+		return
+	}
+
+	if s := f.sectors[lba]; s != nil && s.DelayMs > 0 {
+		time.Sleep(time.Duration(s.DelayMs) * time.Millisecond)
+	}
+}
+
+func (f *faults) no_write() bool {
+	return f != nil && f.profile.NoWrite
+}
+
+func (f *faults) delay_ack() {
+	if f != nil {
+		f.delay(f.profile.DelayAck)
+	}
+}
+
+func (f *faults) delay_result() {
+	if f != nil {
+		f.delay(f.profile.DelayResult)
+	}
+}
+
+// SetProfile enables fault injection on the drive. A nil profile
+// disables it.
+func (fl *Floppy) SetProfile(p *Profile) error {
+	if p == nil {
+		fl.faults = nil
+		return nil
+	}
+
+	f, err := new_faults(p, fl.disk)
+	if err != nil {
+		return err
+	}
+
+	fl.faults = f
+	return nil
+}
@@ -0,0 +1,239 @@
+// Package emulator implements a software stand-in for the Arduino floppy
+// controller. It answers the serial protocol exactly like the firmware
+// does and serves sectors from a disk image held in memory.
+package emulator
+
+import (
+	"fmt"
+
+	"floppy_arduino/proto"
+)
+
+// Drive geometry, as configured in the firmware
+const TRACKS byte = 80
+const HEADS byte = 2
+const SECTORS byte = 18
+const SECTOR_SIZE uint = proto.SECTOR_SIZE
+
+const N_BLOCKS uint = uint(TRACKS) * uint(HEADS) * uint(SECTORS)
+
+// Floppy controller error codes, same values as the firmware
+type FloppyError byte
+
+const (
+	TRACK_OUT_OF_RANGE FloppyError = iota
+	TRACK0_NOT_FOUND
+	NOT_INITIALIZED
+	SEEK_ERROR
+	SECTOR_NOT_FOUND
+	INCORRECT_DATA_MARK
+	NO_PULSE
+	CRC
+	INVALID_AMOUNT
+	OK
+)
+
+var floppy_error_names = [...]string{
+	"TRACK_OUT_OF_RANGE",
+	"TRACK0_NOT_FOUND",
+	"NOT_INITIALIZED",
+	"SEEK_ERROR",
+	"SECTOR_NOT_FOUND",
+	"INCORRECT_DATA_MARK",
+	"NO_PULSE",
+	"CRC",
+	"INVALID_AMOUNT",
+	"OK",
+}
+
+func (e FloppyError) String() string {
+	if int(e) < len(floppy_error_names) {
+		return floppy_error_names[e]
+	}
+	return fmt.Sprintf("FloppyError(%d)", byte(e))
+}
+
+// Floppy emulates the drive and the firmware's Floppy class
+type Floppy struct {
+	image       []byte
+	disk        proto.Geometry
+	initialized bool
+	cur_track   byte
+	faults      *faults
+}
+
+// NewFloppy creates a drive with the given 1.44M disk image inserted.
+// Images shorter than a full disk are padded with zeroes.
+func NewFloppy(image []byte) (*Floppy, error) {
+	return NewFloppyFormat(image, proto.FORMAT_1440K)
+}
+
+// NewFloppyFormat is like NewFloppy for a disk of any format. The
+// emulated firmware still maps LBAs with its own geometry.
+func NewFloppyFormat(image []byte, disk proto.Geometry) (*Floppy, error) {
+
+	if disk.Tracks > TRACKS || disk.Heads > HEADS {
+		return nil, fmt.Errorf("format %s does not fit the drive", disk)
+	}
+
+	if uint(len(image)) > disk.Size() {
+		return nil, fmt.Errorf("image too large: %d bytes, max %d", len(image), disk.Size())
+	}
+
+	// Copy image so that the caller's buffer is never modified
+	buf := make([]byte, disk.Size())
+	copy(buf, image)
+
+	return &Floppy{image: buf, disk: disk}, nil
+}
+
+// Image returns the current contents of the disk
+func (f *Floppy) Image() []byte {
+	return f.image
+}
+
+// Format returns the geometry of the disk
+func (f *Floppy) Format() proto.Geometry {
+	return f.disk
+}
+
+// LBAtoCHS of the firmware
+func lba_to_chs(address uint16) (byte, byte, byte) {
+	cylinder := byte(address / (uint16(SECTORS) * uint16(HEADS)))
+	head := byte((address / uint16(SECTORS)) % uint16(HEADS))
+	sector := byte(address%uint16(SECTORS) + 1)
+
+	return cylinder, head, sector
+}
+
+// Go to track 0
+func (f *Floppy) initialize() FloppyError {
+	f.initialized = true
+	f.cur_track = 0
+
+	return OK
+}
+
+func (f *Floppy) seek(track byte) FloppyError {
+
+	// Check if drive initialized
+	if !f.initialized {
+		return NOT_INITIALIZED
+	}
+
+	// Check if track number is in range
+	if track >= TRACKS {
+		return TRACK_OUT_OF_RANGE
+	}
+
+	f.cur_track = track
+
+	return OK
+}
+
+func (f *Floppy) read_sector(buf []byte, cylinder byte, head byte, sector byte) FloppyError {
+
+	// Seek to track
+	if ec := f.seek(cylinder); ec != OK {
+		return ec
+	}
+
+	// The firmware never finds an address mark that doesn't exist
+	if !f.disk.Contains(cylinder, head, sector) {
+		return SECTOR_NOT_FOUND
+	}
+
+	lba := f.disk.CHSToLBA(cylinder, head, sector)
+
+	f.faults.rotate(sector)
+	f.faults.sector_delay(lba)
+
+	ec := f.faults.sector_error(lba)
+
+	// The firmware reads the data before checking its CRC
+	if ec != OK && ec != CRC {
+		return ec
+	}
+
+	start := lba * SECTOR_SIZE
+	copy(buf, f.image[start:start+SECTOR_SIZE])
+
+	if ec == CRC {
+		f.faults.corrupt(lba, buf)
+	}
+
+	return ec
+}
+
+func (f *Floppy) read_blocks(buf []byte, address uint16, amount byte) FloppyError {
+
+	// Check if read amount is valid
+	if amount == 0 || amount > proto.READ_BLOCKS_MAX_AMOUNT {
+		return INVALID_AMOUNT
+	}
+
+	// Check if address is in range
+	if uint(address)+uint(amount) > N_BLOCKS {
+		return TRACK_OUT_OF_RANGE
+	}
+
+	// Read all blocks
+	for i := byte(0); i < amount; i++ {
+		cylinder, head, sector := lba_to_chs(address + uint16(i))
+
+		start := uint(i) * SECTOR_SIZE
+		if ec := f.read_sector(buf[start:start+SECTOR_SIZE], cylinder, head, sector); ec != OK {
+			return ec
+		}
+	}
+
+	return OK
+}
+
+func (f *Floppy) write_sector(buf []byte, cylinder byte, head byte, sector byte) FloppyError {
+
+	// Seek to track
+	if ec := f.seek(cylinder); ec != OK {
+		return ec
+	}
+
+	if !f.disk.Contains(cylinder, head, sector) {
+		return SECTOR_NOT_FOUND
+	}
+
+	lba := f.disk.CHSToLBA(cylinder, head, sector)
+
+	if ec := f.faults.write_error(lba); ec != OK {
+		return ec
+	}
+
+	start := lba * SECTOR_SIZE
+	copy(f.image[start:start+SECTOR_SIZE], buf)
+
+	return OK
+}
+
+func (f *Floppy) write_blocks(buf []byte, address uint16, amount byte) FloppyError {
+
+	// Check if write amount is valid
+	if amount == 0 || amount > proto.WRITE_BLOCKS_MAX_AMOUNT {
+		return INVALID_AMOUNT
+	}
+
+	// Check if address is in range
+	if uint(address)+uint(amount) > N_BLOCKS {
+		return TRACK_OUT_OF_RANGE
+	}
+
+	// Write all blocks
+	for i := byte(0); i < amount; i++ {
+		cylinder, head, sector := lba_to_chs(address + uint16(i))
+
+		start := uint(i) * SECTOR_SIZE
+		if ec := f.write_sector(buf[start:start+SECTOR_SIZE], cylinder, head, sector); ec != OK {
+			return ec
+		}
+	}
+
+	return OK
+}
@@ -0,0 +1,138 @@
+package emulator
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Master side of a pseudo-terminal
+type pty struct {
+	master *os.File
+	name   string
+	closed atomic.Bool
+}
+
+func ioctl(fd, op, arg uintptr) error {
+	_, _, ep := syscall.Syscall(syscall.SYS_IOCTL, fd, op, arg)
+	if ep != 0 {
+		return ep
+	}
+	return nil
+}
+
+func open_pty() (*pty, error) {
+
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get slave number
+	var n uint32
+	if err := ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("TIOCGPTN: %s", err)
+	}
+
+	// Unlock slave
+	var unlock int32
+	if err := ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("TIOCSPTLCK: %s", err)
+	}
+
+	name := fmt.Sprintf("/dev/pts/%d", n)
+
+	// Put the slave in raw mode so that nothing is echoed back to the
+	// host before it configures the port itself
+	if err := make_raw(name); err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	return &pty{master: master, name: name}, nil
+}
+
+func make_raw(name string) error {
+	slave, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return err
+	}
+	defer slave.Close()
+
+	var t syscall.Termios
+	if err := ioctl(slave.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&t))); err != nil {
+		return fmt.Errorf("TCGETS: %s", err)
+	}
+
+	// Same as cfmakeraw(3)
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+
+	if err := ioctl(slave.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&t))); err != nil {
+		return fmt.Errorf("TCSETS: %s", err)
+	}
+
+	return nil
+}
+
+// Read from the master. While no process has the slave open the kernel
+// returns EIO: wait for the host to (re)connect instead of failing.
+func (p *pty) Read(buf []byte) (int, error) {
+	for {
+		n, err := p.master.Read(buf)
+
+		if err != nil && errors.Is(err, syscall.EIO) && !p.closed.Load() {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		return n, err
+	}
+}
+
+func (p *pty) Write(buf []byte) (int, error) {
+	return p.master.Write(buf)
+}
+
+func (p *pty) Close() error {
+	p.closed.Store(true)
+	return p.master.Close()
+}
+
+// Start opens a pseudo-terminal and serves it in the background.
+// It returns the path of the slave device the host tools should open.
+func (e *Emulator) Start() (string, error) {
+
+	p, err := open_pty()
+	if err != nil {
+		return "", err
+	}
+
+	e.pty = p
+
+	go func() {
+		err := e.Serve(p)
+		if err != nil && !p.closed.Load() {
+			e.logf("Serve stopped: %s", err)
+		}
+	}()
+
+	return p.name, nil
+}
+
+// Close stops serving the pseudo-terminal
+func (e *Emulator) Close() error {
+	if e.pty == nil {
+		return nil
+	}
+	return e.pty.Close()
+}
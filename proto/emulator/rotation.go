@@ -0,0 +1,82 @@
+package emulator
+
+import (
+	"fmt"
+	"time"
+)
+
+// RotationModel makes reads wait for their sector to come under the head,
+// like on a real drive. Sectors are laid out on the track with the given
+// interleave: 1 for consecutive sectors, 2 for every other slot...
+type RotationModel struct {
+	RPM        float64 `json:"rpm"`
+	Interleave byte    `json:"interleave"`
+}
+
+// Where the disk is
+type rotation struct {
+	period  time.Duration
+	started time.Time
+
+	// Slot of each sector on the track, by sector number - 1
+	slots []byte
+	n     byte
+}
+
+func new_rotation(m *RotationModel, sectors byte) (*rotation, error) {
+
+	if m.RPM <= 0 {
+		return nil, fmt.Errorf("rotation: bad rpm %g", m.RPM)
+	}
+	if m.Interleave == 0 || m.Interleave >= sectors {
+		return nil, fmt.Errorf("rotation: bad interleave %d for %d sectors", m.Interleave, sectors)
+	}
+
+	layout := InterleaveLayout(sectors, m.Interleave)
+
+	r := &rotation{
+		period:  time.Duration(float64(time.Minute) / m.RPM),
+		started: time.Now(),
+		slots:   make([]byte, sectors),
+		n:       sectors,
+	}
+
+	for slot, sector := range layout {
+		r.slots[sector-1] = byte(slot)
+	}
+
+	return r, nil
+}
+
+// InterleaveLayout returns the sector in each slot of a track formatted
+// with an interleave: the next sector goes interleave slots further, or
+// in the first free slot after that.
+func InterleaveLayout(sectors byte, interleave byte) []byte {
+
+	layout := make([]byte, sectors)
+	slot := byte(0)
+
+	for sector := byte(1); sector <= sectors; sector++ {
+		for layout[slot] != 0 {
+			slot = (slot + 1) % sectors
+		}
+
+		layout[slot] = sector
+		slot = (slot + interleave) % sectors
+	}
+
+	return layout
+}
+
+// Wait for sector to pass under the head
+func (r *rotation) wait(sector byte) {
+
+	slot_time := r.period / time.Duration(r.n)
+	start := time.Duration(r.slots[sector-1]) * slot_time
+
+	// Time to the start of the sector, then to its end
+	pos := time.Since(r.started) % r.period
+	wait := (start - pos + r.period) % r.period
+
+	time.Sleep(wait + slot_time)
+}
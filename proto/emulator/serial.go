@@ -0,0 +1,251 @@
+package emulator
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+
+	"floppy_arduino/proto"
+)
+
+// Emulator answers serial commands like the firmware's SerialInterface
+type Emulator struct {
+	floppy *Floppy
+	buf    []byte
+
+	// If set, every command is logged here
+	Logger *log.Logger
+
+	pty *pty
+}
+
+// New creates an emulator serving the given floppy
+func New(floppy *Floppy) *Emulator {
+	return &Emulator{
+		floppy: floppy,
+		buf:    make([]byte, SECTOR_SIZE*uint(max(proto.READ_BLOCKS_MAX_AMOUNT, proto.WRITE_BLOCKS_MAX_AMOUNT))),
+	}
+}
+
+// Floppy returns the emulated drive
+func (e *Emulator) Floppy() *Floppy {
+	return e.floppy
+}
+
+func (e *Emulator) logf(format string, args ...any) {
+	if e.Logger != nil {
+		e.Logger.Printf(format, args...)
+	}
+}
+
+// Serve handles commands read from rw until it returns an error
+func (e *Emulator) Serve(rw io.ReadWriter) error {
+	cmd := make([]byte, 1)
+
+	for {
+		if _, err := io.ReadFull(rw, cmd); err != nil {
+			return err
+		}
+
+		// Unknown commands get no answer
+		if e.floppy.faults.no_write() && (cmd[0] == proto.CMD_CAPABILITIES || cmd[0] == proto.CMD_WRITE_BLOCKS) {
+			e.logf("Ignored command %q", cmd[0])
+			continue
+		}
+
+		var err error
+
+		switch cmd[0] {
+		case proto.CMD_READ_SECTOR:
+			err = e.cmd_read_sector(rw)
+		case proto.CMD_READ_BLOCKS:
+			err = e.cmd_read_blocks(rw)
+		case proto.CMD_WRITE_BLOCKS:
+			err = e.cmd_write_blocks(rw)
+		case proto.CMD_HANDSHAKE:
+			err = e.cmd_handshake(rw)
+		case proto.CMD_INITIALIZE:
+			err = e.cmd_initialize(rw)
+		case proto.CMD_CAPABILITIES:
+			err = e.cmd_capabilities(rw)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (e *Emulator) cmd_read_sector(rw io.ReadWriter) error {
+
+	// Read sector info
+	args := make([]byte, 3)
+	if _, err := io.ReadFull(rw, args); err != nil {
+		return err
+	}
+	cylinder, head, sector := args[0], args[1], args[2]
+
+	// Tell host that we're doing the read
+	if err := e.write_ack(rw); err != nil {
+		return err
+	}
+
+	// Perform read
+	data := e.buf[:SECTOR_SIZE]
+	ec := e.floppy.read_sector(data, cylinder, head, sector)
+
+	e.logf("Read sector: C=%d H=%d S=%d: %s", cylinder, head, sector, ec)
+
+	// Damaged data is sent anyway
+	if ec == CRC {
+		return e.write_error_data(rw, data)
+	}
+
+	return e.write_result(rw, ec, data)
+}
+
+func (e *Emulator) cmd_read_blocks(rw io.ReadWriter) error {
+
+	// Read command info
+	args := make([]byte, 3)
+	if _, err := io.ReadFull(rw, args); err != nil {
+		return err
+	}
+	block := binary.LittleEndian.Uint16(args[0:2])
+	amount := args[2]
+
+	// Tell host that we're doing the read
+	if err := e.write_ack(rw); err != nil {
+		return err
+	}
+
+	// Perform read
+	var data []byte
+	ec := INVALID_AMOUNT
+	if amount <= proto.READ_BLOCKS_MAX_AMOUNT {
+		data = e.buf[:SECTOR_SIZE*uint(amount)]
+		ec = e.floppy.read_blocks(data, block, amount)
+	}
+
+	e.logf("Read blocks: LBA=%d amount=%d: %s", block, amount, ec)
+
+	return e.write_result(rw, ec, data)
+}
+
+func (e *Emulator) cmd_write_blocks(rw io.ReadWriter) error {
+
+	// Read command info
+	args := make([]byte, 3)
+	if _, err := io.ReadFull(rw, args); err != nil {
+		return err
+	}
+	block := binary.LittleEndian.Uint16(args[0:2])
+	amount := args[2]
+
+	// The payload length is unknown if the amount is invalid
+	if amount == 0 || amount > proto.WRITE_BLOCKS_MAX_AMOUNT {
+		if err := e.write_ack(rw); err != nil {
+			return err
+		}
+		e.logf("Write blocks: LBA=%d amount=%d: %s", block, amount, INVALID_AMOUNT)
+		return e.write_result(rw, INVALID_AMOUNT, nil)
+	}
+
+	// Read payload and checksum
+	data := e.buf[:SECTOR_SIZE*uint(amount)]
+	if _, err := io.ReadFull(rw, data); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rw, args[:2]); err != nil {
+		return err
+	}
+	crc := binary.LittleEndian.Uint16(args[0:2])
+
+	// Tell host that we're doing the write
+	if err := e.write_ack(rw); err != nil {
+		return err
+	}
+
+	if crc != proto.CRC16(data) {
+		e.logf("Write blocks: LBA=%d amount=%d: checksum mismatch", block, amount)
+		return e.write_result(rw, CRC, nil)
+	}
+
+	// Perform write
+	ec := e.floppy.write_blocks(data, block, amount)
+
+	e.logf("Write blocks: LBA=%d amount=%d: %s", block, amount, ec)
+
+	return e.write_result(rw, ec, nil)
+}
+
+func (e *Emulator) cmd_initialize(rw io.ReadWriter) error {
+
+	if err := e.write_ack(rw); err != nil {
+		return err
+	}
+
+	// Initialize floppy
+	ec := e.floppy.initialize()
+
+	e.logf("Initialize: %s", ec)
+
+	return e.write_result(rw, ec, nil)
+}
+
+func (e *Emulator) cmd_handshake(rw io.ReadWriter) error {
+
+	e.logf("Handshake")
+
+	// Respond to handshake
+	_, err := rw.Write([]byte{proto.CMD_HANDSHAKE})
+	return err
+}
+
+func (e *Emulator) cmd_capabilities(rw io.ReadWriter) error {
+
+	e.logf("Capabilities")
+
+	_, err := rw.Write([]byte{proto.CMD_CAPABILITIES, proto.CAP_WRITE})
+	return err
+}
+
+func (e *Emulator) write_ack(rw io.ReadWriter) error {
+	e.floppy.faults.delay_ack()
+
+	_, err := rw.Write([]byte{proto.CMD_ACK})
+	return err
+}
+
+// Send back OK followed by data, or an error
+func (e *Emulator) write_result(rw io.ReadWriter, ec FloppyError, data []byte) error {
+	faults := e.floppy.faults
+
+	faults.delay_result()
+
+	if ec != OK {
+		_, err := rw.Write([]byte{proto.CMD_ERROR})
+		return err
+	}
+
+	res := make([]byte, 0, len(data)+1)
+	res = append(res, proto.CMD_OK)
+	res = append(res, faults.drop_bytes(data)...)
+
+	_, err := rw.Write(res)
+	return err
+}
+
+// Send back an error followed by the damaged data
+func (e *Emulator) write_error_data(rw io.ReadWriter, data []byte) error {
+	faults := e.floppy.faults
+
+	faults.delay_result()
+
+	res := make([]byte, 0, len(data)+1)
+	res = append(res, proto.CMD_ERROR_DATA)
+	res = append(res, faults.drop_bytes(data)...)
+
+	_, err := rw.Write(res)
+	return err
+}
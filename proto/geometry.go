@@ -0,0 +1,87 @@
+package proto
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Geometry is the layout of a disk format
+type Geometry struct {
+	Name    string
+	Tracks  byte
+	Heads   byte
+	Sectors byte // Sectors per track, numbered from 1
+}
+
+// Standard PC formats
+var (
+	FORMAT_360K  = Geometry{Name: "360K", Tracks: 40, Heads: 2, Sectors: 9}
+	FORMAT_720K  = Geometry{Name: "720K", Tracks: 80, Heads: 2, Sectors: 9}
+	FORMAT_1200K = Geometry{Name: "1.2M", Tracks: 80, Heads: 2, Sectors: 15}
+	FORMAT_1440K = Geometry{Name: "1.44M", Tracks: 80, Heads: 2, Sectors: 18}
+	FORMAT_2880K = Geometry{Name: "2.88M", Tracks: 80, Heads: 2, Sectors: 36}
+)
+
+// FORMATS lists the known formats from smallest to largest
+var FORMATS = []Geometry{FORMAT_360K, FORMAT_720K, FORMAT_1200K, FORMAT_1440K, FORMAT_2880K}
+
+// FIRMWARE_GEOMETRY is the layout the firmware's LBA commands assume
+var FIRMWARE_GEOMETRY = FORMAT_1440K
+
+// ParseFormat finds a format by name, e.g. "720K" or "1.44M".
+// Sizes in KB such as "1440" are accepted too.
+func ParseFormat(name string) (Geometry, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+
+	for _, g := range FORMATS {
+		kb := fmt.Sprint(g.Size() / 1024)
+		if name == g.Name || name == kb || name == kb+"K" {
+			return g, nil
+		}
+	}
+
+	return Geometry{}, fmt.Errorf("%w %q", ErrUnknownFormat, name)
+}
+
+// FormatNames returns the names of the known formats, for help messages
+func FormatNames() string {
+	names := make([]string, len(FORMATS))
+	for i, g := range FORMATS {
+		names[i] = g.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+func (g Geometry) String() string {
+	return fmt.Sprintf("%s (%d/%d/%d)", g.Name, g.Tracks, g.Heads, g.Sectors)
+}
+
+// Blocks returns the number of sectors on the disk
+func (g Geometry) Blocks() uint {
+	return uint(g.Tracks) * uint(g.Heads) * uint(g.Sectors)
+}
+
+// Size returns the capacity of the disk in bytes
+func (g Geometry) Size() uint {
+	return g.Blocks() * SECTOR_SIZE
+}
+
+// LBAToCHS maps a block address to cylinder, head and sector the same way
+// LBAtoCHS in the firmware does
+func (g Geometry) LBAToCHS(address uint) (byte, byte, byte) {
+	cylinder := byte(address / (uint(g.Sectors) * uint(g.Heads)))
+	head := byte((address / uint(g.Sectors)) % uint(g.Heads))
+	sector := byte(address%uint(g.Sectors) + 1)
+
+	return cylinder, head, sector
+}
+
+// CHSToLBA is the inverse of LBAToCHS
+func (g Geometry) CHSToLBA(cylinder byte, head byte, sector byte) uint {
+	return (uint(cylinder)*uint(g.Heads)+uint(head))*uint(g.Sectors) + uint(sector) - 1
+}
+
+// Contains tells whether cylinder, head and sector exist on the disk
+func (g Geometry) Contains(cylinder byte, head byte, sector byte) bool {
+	return cylinder < g.Tracks && head < g.Heads && sector >= 1 && sector <= g.Sectors
+}
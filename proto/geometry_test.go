@@ -0,0 +1,74 @@
+package proto
+
+import (
+	"testing"
+)
+
+func TestParseFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Geometry
+	}{
+		{"360K", FORMAT_360K},
+		{"720k", FORMAT_720K},
+		{"1.2M", FORMAT_1200K},
+		{"1200", FORMAT_1200K},
+		{"1.44m", FORMAT_1440K},
+		{"1440K", FORMAT_1440K},
+		{"2.88M", FORMAT_2880K},
+	}
+
+	for _, test := range tests {
+		format, err := ParseFormat(test.name)
+		if err != nil || format != test.format {
+			t.Errorf("ParseFormat(%q) = %v, %v", test.name, format, err)
+		}
+	}
+
+	if _, err := ParseFormat("100K"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestGeometrySize(t *testing.T) {
+	for format, kb := range map[Geometry]uint{
+		FORMAT_360K:  360,
+		FORMAT_720K:  720,
+		FORMAT_1200K: 1200,
+		FORMAT_1440K: 1440,
+		FORMAT_2880K: 2880,
+	} {
+		if format.Size() != kb*1024 {
+			t.Errorf("%s: size %d, want %d", format, format.Size(), kb*1024)
+		}
+	}
+}
+
+func TestLBAToCHS(t *testing.T) {
+	tests := []struct {
+		format                 Geometry
+		lba                    uint
+		cylinder, head, sector byte
+	}{
+		{FORMAT_1440K, 0, 0, 0, 1},
+		{FORMAT_1440K, 17, 0, 0, 18},
+		{FORMAT_1440K, 18, 0, 1, 1},
+		{FORMAT_1440K, 36, 1, 0, 1},
+		{FORMAT_1440K, 2879, 79, 1, 18},
+		{FORMAT_360K, 9, 0, 1, 1},
+		{FORMAT_360K, 719, 39, 1, 9},
+		{FORMAT_1200K, 30, 1, 0, 1},
+		{FORMAT_2880K, 35, 0, 0, 36},
+		{FORMAT_2880K, 5759, 79, 1, 36},
+	}
+
+	for _, test := range tests {
+		c, h, s := test.format.LBAToCHS(test.lba)
+		if c != test.cylinder || h != test.head || s != test.sector {
+			t.Errorf("%s: LBAToCHS(%d) = %d/%d/%d, want %d/%d/%d", test.format.Name, test.lba, c, h, s, test.cylinder, test.head, test.sector)
+		}
+		if lba := test.format.CHSToLBA(c, h, s); lba != test.lba {
+			t.Errorf("%s: CHSToLBA(%d, %d, %d) = %d, want %d", test.format.Name, c, h, s, lba, test.lba)
+		}
+	}
+}
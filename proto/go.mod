@@ -0,0 +1,12 @@
+module floppy_arduino/proto
+
+go 1.21.5
+
+require github.com/albenik/go-serial v1.2.0
+
+require (
+	github.com/creack/goselect v0.1.0 // indirect
+	go.uber.org/atomic v1.4.0 // indirect
+	go.uber.org/multierr v1.1.0 // indirect
+	golang.org/x/sys v0.0.0-20190712062909-fae7ac547cb7 // indirect
+)
@@ -0,0 +1,81 @@
+// Package proto implements the host side of the Arduino floppy controller
+// serial protocol.
+package proto
+
+import (
+	"errors"
+	"time"
+)
+
+const BAUD_RATE int = 115200
+
+const READ_TIMEOUT time.Duration = 1000 * time.Millisecond
+const READ_TIMEOUT_OP time.Duration = 5000 * time.Millisecond
+
+// Time to wait for the Arduino to reset after the port is opened
+const RESET_DELAY time.Duration = 2000 * time.Millisecond
+
+// Serial commands
+const CMD_ACK byte = 'A'
+const CMD_ERROR byte = 'E'
+const CMD_ERROR_DATA byte = 'D' // CRC error, the sector data follows
+const CMD_OK byte = 'O'
+const CMD_READ_SECTOR byte = 'R'
+const CMD_READ_BLOCKS byte = 'B'
+const CMD_WRITE_BLOCKS byte = 'W'
+const CMD_HANDSHAKE byte = 'H'
+const CMD_INITIALIZE byte = 'I'
+const CMD_CAPABILITIES byte = 'C'
+
+// Optional commands, flags of the CMD_CAPABILITIES answer. Firmware from
+// before CMD_CAPABILITIES doesn't answer it and has none of them.
+const CAP_WRITE byte = 0x01 // CMD_WRITE_BLOCKS
+
+const SECTOR_SIZE uint = 512
+const READ_BLOCKS_MAX_AMOUNT byte = 3
+const WRITE_BLOCKS_MAX_AMOUNT byte = 3
+
+// Errors
+var (
+	ErrTimeout          = errors.New("timeout error")
+	ErrNoAck            = errors.New("no ACK")
+	ErrInvalidHandshake = errors.New("invalid handshake response")
+	ErrInitialization   = errors.New("initialization error")
+	ErrFloppyRead       = errors.New("floppy read error")
+	ErrBadCRC           = errors.New("sector CRC error")
+	ErrFloppyWrite      = errors.New("floppy write error")
+	ErrWriteUnsupported = errors.New("the Arduino firmware can't write to disks")
+	ErrWriteVerify      = errors.New("written data does not read back")
+	ErrInvalidAmount    = errors.New("invalid block amount")
+	ErrOutOfRange       = errors.New("block address out of range")
+	ErrGeometry         = errors.New("not supported with this disk format")
+	ErrUnknownFormat    = errors.New("unknown disk format")
+	ErrNoBPB            = errors.New("no valid BIOS parameter block")
+	ErrRotation         = errors.New("unable to measure the disk rotation")
+	ErrNoPorts          = errors.New("no serial ports available")
+	ErrNotFound         = errors.New("unable to find Arduino")
+)
+
+// Kinds of read errors, as logged by the tools. Apart from CRC errors on
+// single sector reads, the firmware doesn't say why a read failed.
+const ERROR_KIND_CRC string = "crc"         // Sector data read with a bad CRC
+const ERROR_KIND_READ string = "read"       // Drive could not read the sector
+const ERROR_KIND_TIMEOUT string = "timeout" // No answer from the Arduino
+const ERROR_KIND_NO_ACK string = "no-ack"   // Command not acknowledged
+const ERROR_KIND_IO string = "io"           // Serial port error
+
+// ErrorKind is the kind of a read error
+func ErrorKind(err error) string {
+	switch {
+	case errors.Is(err, ErrBadCRC):
+		return ERROR_KIND_CRC
+	case errors.Is(err, ErrFloppyRead):
+		return ERROR_KIND_READ
+	case errors.Is(err, ErrTimeout):
+		return ERROR_KIND_TIMEOUT
+	case errors.Is(err, ErrNoAck):
+		return ERROR_KIND_NO_ACK
+	default:
+		return ERROR_KIND_IO
+	}
+}
@@ -0,0 +1,195 @@
+package proto
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Reads of the same sector timed to measure a revolution
+const ROTATION_SAMPLES int = 6
+
+// Times each sector is timed after sector 1, the median is kept
+const ROTATION_PAIRS int = 3
+
+// Rotation describes how the sectors of a track pass under the head
+type Rotation struct {
+	Period time.Duration // One revolution of the disk
+
+	// Time from the end of sector 1 to the end of each sector, by sector
+	// number - 1
+	Phases []time.Duration
+
+	Order      []byte // Sectors in the order they pass, from sector 1
+	Interleave byte   // Slots from a sector to the next one
+
+	// Slots from a sector that was just read to the first one that can be
+	// read without waiting for another revolution
+	Skip byte
+}
+
+// RPM is the speed of the disk in revolutions per minute
+func (r Rotation) RPM() float64 {
+	return float64(time.Minute) / float64(r.Period)
+}
+
+// ReadOrder is the order to read the sectors of a track in with the
+// fewest revolutions: each sector is the first unread one at least Skip
+// slots after the previous.
+func (r Rotation) ReadOrder() []byte {
+
+	n := len(r.Order)
+	read := make([]bool, n)
+	order := make([]byte, 0, n)
+	slot := 0
+
+	for len(order) < n {
+		for read[slot] {
+			slot = (slot + 1) % n
+		}
+
+		order = append(order, r.Order[slot])
+		read[slot] = true
+		slot = (slot + int(r.Skip)) % n
+	}
+
+	return order
+}
+
+// TrackTime estimates the time reading the sectors of a track in order
+// takes, from the end of the first read
+func (r Rotation) TrackTime(order []byte) time.Duration {
+
+	n := len(r.Order)
+	slot_time := r.Period / time.Duration(n)
+
+	slots := make([]int, n+1)
+	for slot, sector := range r.Order {
+		slots[sector] = slot
+	}
+
+	total := time.Duration(0)
+
+	for i := 1; i < len(order); i++ {
+		j := (slots[order[i]] - slots[order[i-1]] + n) % n
+		if j < int(r.Skip) {
+			j += n
+		}
+		total += time.Duration(j) * slot_time
+	}
+
+	return total
+}
+
+// Time the end of a read of sector, retrying failed reads
+func (c *Client) timed_read(ctx context.Context, cylinder byte, head byte, sector byte) (time.Time, error) {
+
+	var err error
+
+	for i := uint(0); i <= DETECT_RETRIES; i++ {
+		if _, err = c.ReadSector(ctx, cylinder, head, sector); err == nil {
+			return time.Now(), nil
+		}
+		if ctx.Err() != nil {
+			return time.Time{}, ctx.Err()
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("sector %d/%d/%d: %w", cylinder, head, sector, err)
+}
+
+// AnalyzeRotation measures how the sectors of a track pass under the head.
+// A read ends when its sector has passed, so two reads of the same sector
+// end a revolution apart, and a read of sector 1 followed by one of
+// another sector tells how far behind sector 1 it is. A read that starts
+// too late for its sector waits a whole revolution more, which tells how
+// close the host can read sectors.
+func (c *Client) AnalyzeRotation(ctx context.Context, cylinder byte, head byte) (Rotation, error) {
+
+	n := c.Geometry().Sectors
+
+	if n < 2 {
+		return Rotation{}, fmt.Errorf("%w: %d sectors per track", ErrRotation, n)
+	}
+
+	// Revolution
+	var ends []time.Time
+
+	for i := 0; i < ROTATION_SAMPLES; i++ {
+		end, err := c.timed_read(ctx, cylinder, head, 1)
+		if err != nil {
+			return Rotation{}, err
+		}
+		ends = append(ends, end)
+	}
+
+	var periods []time.Duration
+	for i := 1; i < len(ends); i++ {
+		periods = append(periods, ends[i].Sub(ends[i-1]))
+	}
+	slices.Sort(periods)
+
+	r := Rotation{Period: periods[len(periods)/2], Phases: make([]time.Duration, n)}
+	slot_time := r.Period / time.Duration(n)
+
+	// Sectors behind sector 1, and whether they were caught in the same
+	// revolution
+	same_rev := make([]bool, n)
+
+	for sector := byte(2); sector <= n; sector++ {
+		var delays []time.Duration
+
+		for i := 0; i < ROTATION_PAIRS; i++ {
+			start, err := c.timed_read(ctx, cylinder, head, 1)
+			if err != nil {
+				return Rotation{}, err
+			}
+
+			end, err := c.timed_read(ctx, cylinder, head, sector)
+			if err != nil {
+				return Rotation{}, err
+			}
+
+			delays = append(delays, end.Sub(start))
+		}
+
+		slices.Sort(delays)
+		d := delays[len(delays)/2]
+
+		r.Phases[sector-1] = d % r.Period
+		same_rev[sector-1] = d < r.Period
+	}
+
+	// Slot of each sector
+	slots := make([]byte, n)
+	taken := make([]bool, n)
+
+	for i, phase := range r.Phases {
+		slot := byte((phase+slot_time/2)/slot_time) % n
+
+		if taken[slot] {
+			return Rotation{}, fmt.Errorf("%w: sectors %d and %d seem to be at the same place", ErrRotation, slices.Index(slots[:i], slot)+1, i+1)
+		}
+
+		slots[i] = slot
+		taken[slot] = true
+	}
+
+	r.Order = make([]byte, n)
+	for i := range r.Order {
+		r.Order[i] = byte(i + 1)
+	}
+	slices.SortFunc(r.Order, func(a, b byte) int { return int(slots[a-1]) - int(slots[b-1]) })
+
+	r.Interleave = slots[1]
+
+	r.Skip = n
+	for i := 1; i < int(n); i++ {
+		if same_rev[i] && slots[i] < r.Skip {
+			r.Skip = slots[i]
+		}
+	}
+
+	return r, nil
+}
@@ -0,0 +1,77 @@
+package proto_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+func TestReadOrder(t *testing.T) {
+	r := proto.Rotation{Order: []byte{1, 4, 7, 2, 5, 8, 3, 6, 9}, Skip: 2}
+
+	if got, want := r.ReadOrder(), []byte{1, 7, 5, 3, 9, 4, 2, 8, 6}; !slices.Equal(got, want) {
+		t.Errorf("ReadOrder = %v, want %v", got, want)
+	}
+
+	// Two slots per sector instead of three or four
+	r.Period = 9 * time.Millisecond
+	if got := r.TrackTime(r.ReadOrder()); got != 16*time.Millisecond {
+		t.Errorf("TrackTime(ReadOrder) = %s", got)
+	}
+	if got := r.TrackTime([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9}); got != 26*time.Millisecond {
+		t.Errorf("TrackTime(logical) = %s", got)
+	}
+
+	// No sector can be caught in the same revolution
+	r.Skip = 9
+	if got, want := r.ReadOrder(), r.Order; !slices.Equal(got, want) {
+		t.Errorf("ReadOrder = %v, want %v", got, want)
+	}
+}
+
+func TestAnalyzeRotation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("timing test")
+	}
+
+	profile := &emulator.Profile{Rotation: &emulator.RotationModel{RPM: 600, Interleave: 3}}
+
+	client := emulatortest.StartClient(t, nil, proto.FORMAT_720K, profile)
+
+	r, err := client.AnalyzeRotation(context.Background(), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rpm := r.RPM(); rpm < 590 || rpm > 610 {
+		t.Errorf("%.1f RPM, want 600", rpm)
+	}
+	if want := emulator.InterleaveLayout(9, 3); !slices.Equal(r.Order, want) {
+		t.Errorf("order %v, want %v", r.Order, want)
+	}
+	if r.Interleave != 3 {
+		t.Errorf("interleave %d, want 3", r.Interleave)
+	}
+
+	// The emulator answers in much less than a slot, but the next slot
+	// has already started
+	if r.Skip != 2 {
+		t.Errorf("skip %d, want 2", r.Skip)
+	}
+
+	// Reading in that order takes about Skip revolutions
+	start := time.Now()
+	for _, sector := range r.ReadOrder() {
+		if _, err := client.ReadSector(context.Background(), 1, 0, sector); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > 3*r.Period {
+		t.Errorf("track read in %s", d)
+	}
+}
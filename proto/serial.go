@@ -0,0 +1,76 @@
+package proto
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+
+	"github.com/albenik/go-serial"
+)
+
+func write_byte(port serial.Port, data byte) error {
+	return write_bytes(port, []byte{data})
+}
+
+func write_uint16(port serial.Port, data uint16) error {
+	buf := make([]byte, 2)
+	binary.LittleEndian.PutUint16(buf, data)
+
+	return write_bytes(port, buf)
+}
+
+func write_bytes(port serial.Port, data []byte) error {
+	written := uint(0)
+
+	for written < uint(len(data)) {
+		n, err := port.Write(data[written:])
+
+		if err != nil {
+			return err
+		}
+
+		written += uint(n)
+	}
+
+	return nil
+}
+
+func read_byte(ctx context.Context, port serial.Port, timeout time.Duration) (byte, error) {
+	buf, err := read_bytes(ctx, port, 1, timeout)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return buf[0], nil
+}
+
+func read_bytes(ctx context.Context, port serial.Port, n_bytes uint, timeout time.Duration) ([]byte, error) {
+	// Read buffer of n bytes
+	buf := make([]byte, n_bytes)
+
+	n := uint(0)
+	var read int
+
+	start := time.Now()
+
+	// Poll the port in short intervals so that the timeout and the
+	// context are checked regularly
+	defer port.SetReadTimeout(-1)
+
+	for n < n_bytes {
+		if err := ctx.Err(); err != nil {
+			return []byte{}, err
+		}
+
+		port.SetReadTimeout(10)
+		read, _ = port.Read(buf[n:])
+		n += uint(read)
+
+		if n < n_bytes && time.Since(start) > timeout {
+			return []byte{}, ErrTimeout
+		}
+	}
+
+	return buf, nil
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+
+	"floppy_arduino/proto"
 )
 
 // Arguments
@@ -15,22 +17,39 @@ const ARG_END_BLK string = "--end-block"
 const ARG_END_BLK_SHORT string = "-e"
 const ARG_RETRIES string = "--retries"
 const ARG_RETRIES_SHORT string = "-r"
+const ARG_FORMAT string = "--format"
+const ARG_FORMAT_SHORT string = "-f"
 const ARG_IGNORE_ERRORS string = "--ignore-errors"
 const ARG_IGNORE_ERRORS_SHORT string = "-i"
+const ARG_MAP string = "--map"
+const ARG_MAP_SHORT string = "-m"
+const ARG_RECOVER string = "--recover"
+const ARG_RECOVER_SHORT string = "-R"
+const ARG_PASSES string = "--passes"
+const ARG_PASSES_SHORT string = "-p"
+const ARG_FILL string = "--fill"
+const ARG_ERROR_LOG string = "--error-log"
+const ARG_VOTES string = "--votes"
+const ARG_AGREE string = "--agree"
+const ARG_MANIFEST string = "--manifest"
+const ARG_ORDER string = "--order"
 const ARG_HELP string = "--help"
 const ARG_HELP_SHORT string = "-h"
 
 // Messages
-const MSG_HELP string = "Usage: disk2img [OPTIONS] OUT_FILE\nOptions: \n \t-d --device: Serial port of Arduino\n \t-s --start-block: First block to read\n \t-e --end-block: Last block to read\n \t-r --retires: Number of read retries\n \t-i --ignore-errors: Ignore read errors\n \t-h --help: Display this message"
+const MSG_HELP string = "Usage: disk2img [OPTIONS] OUT_FILE\nOptions: \n \t-d --device: Serial port of Arduino\n \t-s --start-block: First block to read\n \t-e --end-block: Last block to read\n \t-r --retires: Number of read retries\n \t-f --format: Disk format (360K, 720K, 1.2M, 1.44M, 2.88M), default auto: detect from the disk\n \t-i --ignore-errors: Ignore read errors\n \t-m --map: Map file of finished and failed blocks, a later run with the same map resumes and only retries failed blocks. Blocks are then written at their offset on the disk\n \t-R --recover: Recovery mode for damaged disks: a fast pass, then blocks of failed batches one by one, then passes recalibrating the head before each read, alternately backwards. Implies --ignore-errors\n \t-p --passes: Number of passes in recovery mode, default 4\n \t--fill: Fill of unreadable sectors: zero, marker (\"BADSECTOR <LBA> \" repeated) or keep (leave the out file content), default zero\n \t--error-log: Write unreadable sectors with their CHS address, error and attempts to a file, CSV if it ends in .csv, JSON otherwise\n \t--votes: Read sectors that fail up to this many times and take the byte more than half of them agree on, using the data of reads with a CRC error. Sectors with a byte they don't agree on stay unreadable\n \t--agree: With votes, stop as soon as two reads are identical, default 5 votes\n \t--manifest: JSON manifest with the image hashes, per track hashes and reading settings, default OUT_FILE.manifest.json\n \t--order: Order to read blocks in: logical (batches of consecutive blocks) or physical (time the rotation of the first track, then read the sectors of each track in the order that needs the fewest revolutions), default logical, not with --recover\n \t-h --help: Display this message"
 const MSG_OUT_FILE_MISSING string = "disk2img: missing out file"
 const MSG_OPT_VALUE_MISSING string = "disk2img: missing option value"
 const MSG_OPT_VALUE_INVALID string = "disk2img: invalid option value"
 const MSG_BAD_OPTION string = "disk2img: bad option"
+const MSG_ORDER_RECOVER string = "disk2img: --order physical can't be used with --recover"
 const MSG_TRY_HELP string = "Try 'disk2img --help' for more information"
 
 // Deafaults
 const DEFAULT_MAX_RETRIES uint = 5
 
+const FORMAT_AUTO string = "auto"
+
 type OptionalString struct {
 	value     string
 	has_value bool
@@ -46,12 +65,27 @@ type OptionalUint struct {
 	has_value bool
 }
 
+type OptionalGeometry struct {
+	value     proto.Geometry
+	has_value bool
+}
+
 type Config struct {
 	device        OptionalString
 	start_block   OptionalUint
 	end_block     OptionalUint
 	max_retries   OptionalUint
+	format        OptionalGeometry
 	ignore_errors bool
+	map_file      OptionalString
+	recover       bool
+	passes        OptionalUint
+	fill          string
+	error_log     OptionalString
+	votes         OptionalUint
+	agree         bool
+	manifest      OptionalString
+	order         string
 	out_file      OptionalString
 }
 
@@ -135,6 +169,32 @@ func parse_args() (Config, ConfigResult) {
 					return conf, ConfigERR
 				}
 
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_FORMAT || args[i] == ARG_FORMAT_SHORT {
+			// --format or -f
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+
+				value, err := proto.ParseFormat(args[i])
+
+				if args[i] == FORMAT_AUTO {
+					conf.format.has_value = false
+				} else if err == nil {
+					conf.format.value = value
+					conf.format.has_value = true
+				} else {
+					fmt.Println(MSG_OPT_VALUE_INVALID)
+					fmt.Println(MSG_TRY_HELP)
+					return conf, ConfigERR
+				}
+
 			} else {
 				fmt.Println(MSG_OPT_VALUE_MISSING)
 				fmt.Println(MSG_TRY_HELP)
@@ -164,6 +224,144 @@ func parse_args() (Config, ConfigResult) {
 				fmt.Println(MSG_TRY_HELP)
 				return conf, ConfigERR
 			}
+		} else if args[i] == ARG_MAP || args[i] == ARG_MAP_SHORT {
+			// --map or -m
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+				conf.map_file.value = args[i]
+				conf.map_file.has_value = true
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_RECOVER || args[i] == ARG_RECOVER_SHORT {
+			// --recover or -R
+
+			conf.recover = true
+		} else if args[i] == ARG_PASSES || args[i] == ARG_PASSES_SHORT {
+			// --passes or -p
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+
+				value, err := strconv.ParseUint(args[i], 10, 8)
+
+				if err == nil && value > 0 {
+					conf.passes.value = uint(value)
+					conf.passes.has_value = true
+				} else {
+					fmt.Println(MSG_OPT_VALUE_INVALID)
+					fmt.Println(MSG_TRY_HELP)
+					return conf, ConfigERR
+				}
+
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_FILL {
+			// --fill
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+				switch args[i] {
+				case FILL_ZERO, FILL_MARKER, FILL_KEEP:
+					conf.fill = args[i]
+				default:
+					fmt.Println(MSG_OPT_VALUE_INVALID)
+					fmt.Println(MSG_TRY_HELP)
+					return conf, ConfigERR
+				}
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_ERROR_LOG {
+			// --error-log
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+				conf.error_log.value = args[i]
+				conf.error_log.has_value = true
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_VOTES {
+			// --votes
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+
+				value, err := strconv.ParseUint(args[i], 10, 32)
+
+				if err == nil && value >= 2 {
+					conf.votes.value = uint(value)
+					conf.votes.has_value = true
+				} else {
+					fmt.Println(MSG_OPT_VALUE_INVALID)
+					fmt.Println(MSG_TRY_HELP)
+					return conf, ConfigERR
+				}
+
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_AGREE {
+			// --agree
+
+			conf.agree = true
+		} else if args[i] == ARG_MANIFEST {
+			// --manifest
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+				conf.manifest.value = args[i]
+				conf.manifest.has_value = true
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_ORDER {
+			// --order
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+				switch args[i] {
+				case ORDER_LOGICAL, ORDER_PHYSICAL:
+					conf.order = args[i]
+				default:
+					fmt.Println(MSG_OPT_VALUE_INVALID)
+					fmt.Println(MSG_TRY_HELP)
+					return conf, ConfigERR
+				}
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
 		} else if args[i] == ARG_IGNORE_ERRORS || args[i] == ARG_IGNORE_ERRORS_SHORT {
 			// --ignore-errrors or -i
 
@@ -180,6 +378,30 @@ func parse_args() (Config, ConfigResult) {
 		conf.max_retries.has_value = true
 	}
 
+	if conf.agree && !conf.votes.has_value {
+		conf.votes.value = DEFAULT_VOTES
+		conf.votes.has_value = true
+	}
+
+	if conf.fill == "" {
+		conf.fill = FILL_ZERO
+	}
+
+	if conf.order == "" {
+		conf.order = ORDER_LOGICAL
+	}
+
+	if conf.order == ORDER_PHYSICAL && conf.recover {
+		fmt.Println(MSG_ORDER_RECOVER)
+		fmt.Println(MSG_TRY_HELP)
+		return conf, ConfigERR
+	}
+
+	if !conf.passes.has_value {
+		conf.passes.value = DEFAULT_PASSES
+		conf.passes.has_value = true
+	}
+
 	// Check required parameters
 	if !conf.out_file.has_value {
 		fmt.Println(MSG_OUT_FILE_MISSING)
@@ -187,5 +409,10 @@ func parse_args() (Config, ConfigResult) {
 		return conf, ConfigERR
 	}
 
+	if !conf.manifest.has_value {
+		conf.manifest.value = conf.out_file.value + MANIFEST_SUFFIX
+		conf.manifest.has_value = true
+	}
+
 	return conf, ConfigOK
 }
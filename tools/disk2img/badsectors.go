@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"floppy_arduino/proto"
+)
+
+// How unreadable sectors are filled in the image
+const FILL_ZERO string = "zero"     // Zeroes
+const FILL_MARKER string = "marker" // MARKER_FORMAT repeated
+const FILL_KEEP string = "keep"     // Whatever the file already holds
+
+// Marker filling bad sectors, 16 bytes so it repeats evenly
+const MARKER_FORMAT string = "BADSECTOR %05d "
+
+// BadSector is an entry of the error log
+type BadSector struct {
+	LBA      uint   `json:"lba"`
+	Cylinder byte   `json:"cylinder"`
+	Head     byte   `json:"head"`
+	Sector   byte   `json:"sector"`
+	Error    string `json:"error"`
+	Attempts uint   `json:"attempts"`
+}
+
+// BadSectorLog fills unreadable sectors in the image and keeps track of
+// them
+type BadSectorLog struct {
+	fill     string
+	geometry proto.Geometry
+	sectors  map[uint]*BadSector
+}
+
+func new_bad_sector_log(fill string, geometry proto.Geometry) *BadSectorLog {
+	return &BadSectorLog{fill: fill, geometry: geometry, sectors: make(map[uint]*BadSector)}
+}
+
+// Contents of a bad sector, nil if it is left alone
+func fill_sector(fill string, lba uint) []byte {
+	switch fill {
+	case FILL_KEEP:
+		return nil
+	case FILL_MARKER:
+		marker := fmt.Sprintf(MARKER_FORMAT, lba)
+		return []byte(strings.Repeat(marker, int(SECTOR_SIZE)/len(marker)))
+	default:
+		return make([]byte, SECTOR_SIZE)
+	}
+}
+
+// Record a failed read of amount blocks at block, which out holds at
+// offset, and fill them
+func (l *BadSectorLog) failed(out io.WriterAt, offset int64, block uint, amount byte, err error, attempts uint) error {
+
+	for i := uint(0); i < uint(amount); i++ {
+		lba := block + i
+
+		if data := fill_sector(l.fill, lba); data != nil {
+			if _, err := out.WriteAt(data, offset+int64(i*SECTOR_SIZE)); err != nil {
+				return err
+			}
+		}
+
+		cylinder, head, sector := l.geometry.LBAToCHS(lba)
+
+		l.sectors[lba] = &BadSector{
+			LBA:      lba,
+			Cylinder: cylinder,
+			Head:     head,
+			Sector:   sector,
+			Error:    proto.ErrorKind(err),
+			Attempts: attempts,
+		}
+	}
+
+	return nil
+}
+
+// Blocks read after all are taken off the log
+func (l *BadSectorLog) read_ok(block uint, amount byte) {
+	for i := uint(0); i < uint(amount); i++ {
+		delete(l.sectors, block+i)
+	}
+}
+
+// Bad sectors by LBA
+func (l *BadSectorLog) list() []BadSector {
+	list := make([]BadSector, 0, len(l.sectors))
+	for _, s := range l.sectors {
+		list = append(list, *s)
+	}
+	slices.SortFunc(list, func(a, b BadSector) int { return int(a.LBA) - int(b.LBA) })
+	return list
+}
+
+// Write the log as CSV if path ends in .csv, as JSON otherwise
+func (l *BadSectorLog) save(path string) error {
+
+	var b bytes.Buffer
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		w := csv.NewWriter(&b)
+		w.Write([]string{"lba", "cylinder", "head", "sector", "error", "attempts"})
+
+		for _, s := range l.list() {
+			w.Write([]string{
+				strconv.FormatUint(uint64(s.LBA), 10),
+				strconv.Itoa(int(s.Cylinder)),
+				strconv.Itoa(int(s.Head)),
+				strconv.Itoa(int(s.Sector)),
+				s.Error,
+				strconv.FormatUint(uint64(s.Attempts), 10),
+			})
+		}
+
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return err
+		}
+	} else {
+		data, err := json.MarshalIndent(l.list(), "", "  ")
+		if err != nil {
+			return err
+		}
+		b.Write(append(data, '\n'))
+	}
+
+	return os.WriteFile(path, b.Bytes(), 0644)
+}
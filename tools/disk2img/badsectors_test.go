@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+func TestFillSector(t *testing.T) {
+	marker := fill_sector(FILL_MARKER, 40)
+	if uint(len(marker)) != SECTOR_SIZE || !bytes.HasPrefix(marker, []byte("BADSECTOR 00040 BADSECTOR 00040 ")) {
+		t.Errorf("marker = %q", marker[:32])
+	}
+	if !bytes.Equal(fill_sector(FILL_ZERO, 40), make([]byte, SECTOR_SIZE)) {
+		t.Error("zero fill is not zeroes")
+	}
+	if fill_sector(FILL_KEEP, 40) != nil {
+		t.Error("keep fill writes data")
+	}
+}
+
+func TestImageBlocksFill(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	profile := &emulator.Profile{
+		Sectors: []emulator.SectorFault{sector_error(40, emulator.CRC, 0)},
+	}
+	client := emulatortest.StartClient(t, image, proto.FORMAT_1440K, profile)
+
+	for _, fill := range []string{FILL_MARKER, FILL_KEEP} {
+		blocks := make(memory_image, 72*SECTOR_SIZE)
+		for i := range blocks {
+			blocks[i] = 0xAA
+		}
+		bad := new_bad_sector_log(fill, client.Geometry())
+
+		n_errors, err := image_blocks(context.Background(), client, blocks, nil, bad, nil, 0, 71, nil, OptionalUint{value: 1}, true)
+		if err != nil || n_errors != 3 {
+			t.Fatalf("%s: %d errors, %v", fill, n_errors, err)
+		}
+
+		// The whole batch 39-41 failed
+		for lba := uint(39); lba <= 41; lba++ {
+			want := fill_sector(fill, lba)
+			if want == nil {
+				want = bytes.Repeat([]byte{0xAA}, int(SECTOR_SIZE))
+			}
+			if !bytes.Equal(blocks[lba*SECTOR_SIZE:(lba+1)*SECTOR_SIZE], want) {
+				t.Errorf("%s: block %d not filled", fill, lba)
+			}
+		}
+
+		list := bad.list()
+		if len(list) != 3 || list[0].LBA != 39 || list[0].Attempts != 2 || list[0].Error != proto.ERROR_KIND_READ {
+			t.Errorf("%s: bad sectors = %+v", fill, list)
+		}
+	}
+}
+
+func TestBadSectorLogSave(t *testing.T) {
+	bad := new_bad_sector_log(FILL_ZERO, proto.FORMAT_720K)
+	bad.failed(make(memory_image, 100*SECTOR_SIZE), 0, 20, 2, proto.ErrTimeout, 3)
+	bad.failed(make(memory_image, 100*SECTOR_SIZE), 0, 9, 1, proto.ErrFloppyRead, 1)
+	bad.read_ok(21, 1)
+
+	dir := t.TempDir()
+
+	if err := bad.save(filepath.Join(dir, "errors.csv")); err != nil {
+		t.Fatal(err)
+	}
+	text, _ := os.ReadFile(filepath.Join(dir, "errors.csv"))
+	want := "lba,cylinder,head,sector,error,attempts\n9,0,1,1,read,1\n20,1,0,3,timeout,3\n"
+	if string(text) != want {
+		t.Errorf("CSV log:\n%s\nwant:\n%s", text, want)
+	}
+
+	if err := bad.save(filepath.Join(dir, "errors.json")); err != nil {
+		t.Fatal(err)
+	}
+	text, _ = os.ReadFile(filepath.Join(dir, "errors.json"))
+	var list []BadSector
+	if err := json.Unmarshal(text, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[1] != (BadSector{LBA: 20, Cylinder: 1, Head: 0, Sector: 3, Error: proto.ERROR_KIND_TIMEOUT, Attempts: 3}) {
+		t.Errorf("JSON log = %+v", list)
+	}
+	if !strings.Contains(string(text), `"lba": 9`) {
+		t.Errorf("JSON log:\n%s", text)
+	}
+}
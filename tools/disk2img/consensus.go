@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"floppy_arduino/proto"
+)
+
+// Reads of a sector at most in consensus mode, if not given
+const DEFAULT_VOTES uint = 5
+
+// Consensus puts sectors that can't be read cleanly together from several
+// damaged reads: each byte is the one more than half the reads agree on.
+// Reads without data, like a sector not found, don't take part.
+type Consensus struct {
+	votes uint // Reads of a sector at most
+	agree bool // Stop as soon as two reads are identical
+	voted []VotedSector
+}
+
+// VotedSector tells how the data of a sector was decided
+type VotedSector struct {
+	LBA      uint
+	Reads    uint // Damaged reads used
+	Agreed   bool // Two reads were identical
+	Disputed uint // Bytes not all reads agreed on
+}
+
+func (v VotedSector) String() string {
+	if v.Agreed {
+		return fmt.Sprintf("block %d: two of %d reads identical", v.LBA, v.Reads)
+	}
+	return fmt.Sprintf("block %d: majority of %d reads, %d bytes disputed", v.LBA, v.Reads, v.Disputed)
+}
+
+// Per-byte majority of reads. Also returns the number of bytes not all
+// reads agree on, and false if more than half the reads don't agree on
+// some byte, as the data would then be a guess.
+func majority(reads [][]byte) ([]byte, uint, bool) {
+
+	res := make([]byte, len(reads[0]))
+	disputed := uint(0)
+
+	var counts [256]uint
+
+	for i := range res {
+		clear(counts[:])
+
+		best := reads[0][i]
+		for _, read := range reads {
+			counts[read[i]]++
+			if counts[read[i]] > counts[best] {
+				best = read[i]
+			}
+		}
+
+		if counts[best]*2 <= uint(len(reads)) {
+			return nil, 0, false
+		}
+
+		if counts[best] != uint(len(reads)) {
+			disputed++
+		}
+		res[i] = best
+	}
+
+	return res, disputed, true
+}
+
+// Read a block up to c.votes times. A clean read is returned straight
+// away, otherwise damaged reads are voted on; at least two are needed,
+// and without a majority on every byte the sector stays bad. Also returns
+// the number of reads done.
+func (c *Consensus) read(ctx context.Context, client *proto.Client, block uint) ([]byte, uint, error) {
+
+	cylinder, head, sector := client.Geometry().LBAToCHS(block)
+
+	var reads [][]byte
+	var err, crc_err error
+
+	n := uint(0)
+
+	for n < c.votes {
+		var data []byte
+
+		data, err = client.ReadSector(ctx, cylinder, head, sector)
+		n++
+
+		if err == nil || ctx.Err() != nil {
+			return data, n, err
+		}
+
+		if !errors.Is(err, proto.ErrBadCRC) {
+			continue
+		}
+
+		if c.agree {
+			for _, read := range reads {
+				if string(read) == string(data) {
+					c.voted = append(c.voted, VotedSector{LBA: block, Reads: uint(len(reads)) + 1, Agreed: true})
+					return data, n, nil
+				}
+			}
+		}
+
+		reads = append(reads, data)
+		crc_err = err
+	}
+
+	if len(reads) < 2 {
+		return nil, n, err
+	}
+
+	data, disputed, ok := majority(reads)
+	if !ok {
+		return nil, n, fmt.Errorf("%w, no majority of %d reads", crc_err, len(reads))
+	}
+
+	c.voted = append(c.voted, VotedSector{LBA: block, Reads: uint(len(reads)), Disputed: disputed})
+
+	return data, n, nil
+}
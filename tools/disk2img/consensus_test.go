@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+func TestMajority(t *testing.T) {
+	reads := [][]byte{
+		{1, 2, 3, 4},
+		{1, 9, 3, 4},
+		{1, 2, 7, 6},
+	}
+
+	data, disputed, ok := majority(reads)
+	if !ok || !bytes.Equal(data, []byte{1, 2, 3, 4}) || disputed != 3 {
+		t.Errorf("majority = %v, %d disputed, %t", data, disputed, ok)
+	}
+
+	// A three way tie, or two reads that differ, is no majority
+	reads[1][3] = 5
+	if _, _, ok := majority(reads); ok {
+		t.Errorf("three way tie decided")
+	}
+	if _, _, ok := majority(reads[:2]); ok {
+		t.Errorf("two different reads decided")
+	}
+}
+
+func TestImageBlocksConsensus(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+
+	for _, agree := range []bool{false, true} {
+		weak := sector_error(40, emulator.CRC, 0)
+		weak.CorruptBytes = 2
+
+		profile := &emulator.Profile{
+			Sectors: []emulator.SectorFault{
+				weak,
+				sector_error(41, emulator.CRC, 0),
+				sector_error(50, emulator.SECTOR_NOT_FOUND, 0),
+			},
+		}
+		client := emulatortest.StartClient(t, image, proto.FORMAT_1440K, profile)
+
+		consensus := &Consensus{votes: DEFAULT_VOTES, agree: agree}
+		bad := new_bad_sector_log(FILL_ZERO, client.Geometry())
+		blocks := make(memory_image, 72*SECTOR_SIZE)
+
+		n_errors, err := image_blocks(context.Background(), client, blocks, nil, bad, consensus, 0, 71, nil, OptionalUint{value: 0}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the sector that sends no data is lost, not its whole batch
+		if n_errors != 1 {
+			t.Errorf("agree %v: n_errors = %d, want 1", agree, n_errors)
+		}
+		if list := bad.list(); len(list) != 1 || list[0].LBA != 50 || list[0].Attempts != 1+DEFAULT_VOTES {
+			t.Errorf("agree %v: bad sectors = %+v", agree, list)
+		}
+
+		want := bytes.Clone(image[:72*SECTOR_SIZE])
+		clear(want[50*SECTOR_SIZE : 51*SECTOR_SIZE])
+		if !bytes.Equal(blocks, want) {
+			t.Errorf("agree %v: image differs from disk", agree)
+		}
+
+		if len(consensus.voted) != 2 {
+			t.Fatalf("agree %v: voted = %+v", agree, consensus.voted)
+		}
+
+		voted, intact := consensus.voted[0], consensus.voted[1]
+		if voted.LBA != 40 || voted.Agreed || voted.Reads != DEFAULT_VOTES || voted.Disputed == 0 {
+			t.Errorf("agree %v: block 40 %+v", agree, voted)
+		}
+		if agree && (intact != VotedSector{LBA: 41, Reads: 2, Agreed: true}) {
+			t.Errorf("agree %v: block 41 %+v", agree, intact)
+		}
+		if !agree && (intact != VotedSector{LBA: 41, Reads: DEFAULT_VOTES}) {
+			t.Errorf("agree %v: block 41 %+v", agree, intact)
+		}
+	}
+}
+
+func TestConsensusNoMajority(t *testing.T) {
+	lba := uint(40)
+	weak := sector_error(lba, emulator.CRC, 0)
+	weak.CorruptBytes = 16
+	client := emulatortest.StartClient(t, emulatortest.RandomImage(proto.FORMAT_1440K), proto.FORMAT_1440K, &emulator.Profile{
+		Sectors: []emulator.SectorFault{weak},
+	})
+
+	// Two damaged reads that differ don't make a sector
+	consensus := &Consensus{votes: 2}
+	data, reads, err := consensus.read(context.Background(), client, lba)
+	if !errors.Is(err, proto.ErrBadCRC) || data != nil || reads != 2 || len(consensus.voted) != 0 {
+		t.Errorf("read = %d bytes, %d reads, %v, voted %+v", len(data), reads, err, consensus.voted)
+	}
+}
@@ -1,43 +1,30 @@
 package main
 
 import (
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"time"
 
-	"github.com/albenik/go-serial"
+	"floppy_arduino/proto"
 	"golang.org/x/term"
 )
 
-const BAUD_RATE int = 115200
+const SECTOR_SIZE uint = proto.SECTOR_SIZE
 
-const READ_TIMEOUT time.Duration = 1000 * time.Millisecond
-const READ_TIMEOUT_OP time.Duration = 5000 * time.Millisecond
-
-// Serial commands
-const CMD_ACK byte = 'A'
-const CMD_ERROR byte = 'E'
-const CMD_OK byte = 'O'
-const CMD_READ_SECTOR byte = 'R'
-const CMD_READ_BLOCKS byte = 'B'
-const CMD_HANDSHAKE byte = 'H'
-const CMD_INITIALIZE byte = 'I'
-
-const TRACKS byte = 80
-const HEADS byte = 2
-const SECTORS byte = 18
-const SECTOR_SIZE uint = 512
-const READ_BLOCKS_MAX_AMOUNT byte = 3
-
-const N_BLOCKS uint = uint(TRACKS) * uint(HEADS) * uint(SECTORS)
-
-// const N_BLOCKS uint = 36
+// Width used when stdout is not a terminal
+const DEFAULT_TERM_WIDTH uint = 80
 
 func get_term_width() uint {
-	width, _, _ := term.GetSize(int(os.Stdout.Fd()))
+	width, _, err := term.GetSize(int(os.Stdout.Fd()))
+
+	if err != nil || width <= 0 {
+		return DEFAULT_TERM_WIDTH
+	}
 
 	return uint(width)
 }
@@ -75,7 +62,12 @@ func update_progress_bar(blocks_done uint, total_blocks uint) {
 	fmt.Printf("\r")
 
 	// Print blocks read
-	available_width -= print_return_size(fmt.Sprintf("%9s blocks ", fmt.Sprintf("%d/%d", blocks_done, total_blocks)))
+	available_width -= min(available_width, print_return_size(fmt.Sprintf("%9s blocks ", fmt.Sprintf("%d/%d", blocks_done, total_blocks))))
+
+	// No room left for the bar
+	if available_width < 2 {
+		return
+	}
 
 	// Draw progress bar
 	available_width -= print_return_size(draw_progress_bar(float32(blocks_done)/float32(total_blocks), available_width))
@@ -91,334 +83,165 @@ func print_log_message(msg string) {
 	fmt.Println()
 }
 
-func write_byte(port serial.Port, data byte) error {
-	buf := []byte{data}
-
-	n := 0
-	var err error
-
-	for n == 0 {
-		n, err = port.Write(buf)
-
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func write_uint16(port serial.Port, data uint16) error {
-	buf := make([]byte, 2)
-	binary.LittleEndian.PutUint16(buf, data)
-
-	return write_bytes(port, buf)
-}
-
-func read_byte(port serial.Port, timeout time.Duration) (byte, error) {
-	// Read buffer of 1 byte
-	buf := make([]byte, 1)
-
-	n := 0
-	// var err error
-
-	start := time.Now()
-
-	for n <= 0 {
-		port.SetReadTimeout(10)
-		n, _ = port.Read(buf)
-
-		// if err != nil {
-		// 	port.SetReadTimeout(-1)
-		// 	return 0, err
-		// }
-
-		if time.Since(start) > timeout {
-			port.SetReadTimeout(-1)
-			return 0, errors.New("timeout error")
-		}
-	}
-
-	port.SetReadTimeout(-1)
-	return buf[0], nil
-}
-
-func read_bytes(port serial.Port, n_bytes uint, timeout time.Duration) ([]byte, error) {
-	// Read buffer of n bytes
-	buf := make([]byte, n_bytes)
-
-	n := uint(0)
-	// var err error
-	var read int
-
-	start := time.Now()
-
-	for n < n_bytes {
-		port.SetReadTimeout(10)
-		read, _ = port.Read(buf[n:])
-
-		// if err != nil {
-		// 	port.SetReadTimeout(-1)
-		// 	return []byte{}, err
-		// }
-
-		if time.Since(start) > timeout {
-			port.SetReadTimeout(-1)
-			return []byte{}, errors.New("timeout error")
-		}
-
-		n += uint(read)
-	}
-
-	port.SetReadTimeout(-1)
-	return buf, nil
-}
-
-func write_bytes(port serial.Port, data []byte) error {
-	written := uint(0)
-
-	for written < uint(len(data)) {
-		n, err := port.Write(data[written:])
-
-		if err != nil {
-			return err
-		}
-
-		written += uint(n)
-	}
-
-	return nil
-}
-
-func do_handshake(port serial.Port) error {
-
-	// Send handshake
-	write_byte(port, CMD_HANDSHAKE)
-
-	// Expect handshake back
-	res, err := read_byte(port, READ_TIMEOUT)
+// Buffer the image is read into by read_all_blocks
+type memory_image []byte
 
-	if err != nil {
-		// fmt.Printf("Read error: %s\n", err)
-		return err
-	}
-
-	if res != CMD_HANDSHAKE {
-		// fmt.Printf("Invalid handshake response: %c\n", res)
-		return errors.New("invalid handshake response")
-	}
-
-	return nil
+func (m memory_image) WriteAt(p []byte, off int64) (int, error) {
+	return copy(m[off:], p), nil
 }
 
-func connect_and_handshake(name string) (serial.Port, error) {
-
-	mode := &serial.Mode{
-		BaudRate: BAUD_RATE,
-	}
-
-	// Try to open port
-	port, err := serial.Open(name, mode)
-
-	if err != nil {
-		return nil, err
-	}
+func read_all_blocks(ctx context.Context, client *proto.Client, start_block OptionalUint, end_block OptionalUint, retries OptionalUint, ignore_errors bool) ([]byte, uint, error) {
 
-	// Wait for Arduino to reset
-	time.Sleep(500 * time.Millisecond)
-
-	// Clear any stuff still in input buffer
-	port.ResetInputBuffer()
-
-	// Perform handshake on port
-	err = do_handshake(port)
+	start, end, err := block_range(client, start_block, end_block)
 
 	if err != nil {
-		// fmt.Printf("Handshake failed: %s\n", err)
-		port.Close()
-		return nil, err
+		return []byte{}, 0, err
 	}
 
-	return port, nil
-}
+	blocks := make(memory_image, (end-start+1)*SECTOR_SIZE)
 
-func find_arduino() (serial.Port, string, error) {
+	bad := new_bad_sector_log(FILL_ZERO, client.Geometry())
 
-	// Get serial ports list
-	port_names, err := serial.GetPortsList()
+	n_errors, err := image_blocks(ctx, client, blocks, nil, bad, nil, start, end, nil, retries, ignore_errors)
 
 	if err != nil {
-		return nil, "", err
+		return []byte{}, 0, err
 	}
 
-	// If there are no ports available
-	if len(port_names) == 0 {
-		return nil, "", errors.New("no serial ports available")
-	}
-
-	// Repeat for each available port
-	for _, name := range port_names {
-
-		// Try to handhsake with device at this port
-		port, err := connect_and_handshake(name)
-
-		// If handshake succesful, use this port
-		if err == nil {
-			return port, name, nil
-		}
-
-		// fmt.Println(err)
-	}
-	return nil, "", errors.New("unable to find Arduino")
-
+	return blocks, n_errors, nil
 }
 
-func do_initialize(port serial.Port) error {
-
-	// Send initialization command
-	write_byte(port, CMD_INITIALIZE)
-
-	var res byte
-	var err error
-
-	// Wait for acknowledgement
-	res, err = read_byte(port, READ_TIMEOUT)
+// Check the block range to read, filling in the defaults
+func block_range(client *proto.Client, start_block OptionalUint, end_block OptionalUint) (uint, uint, error) {
 
-	if err != nil {
-		return err
-	}
-
-	if res != CMD_ACK {
-		return errors.New("init no ACK")
+	if !start_block.has_value {
+		start_block.value = 0
 	}
+	n_disk_blocks := client.Geometry().Blocks()
 
-	// Wait for result
-	res, err = read_byte(port, READ_TIMEOUT_OP)
-
-	if err != nil {
-		return err
+	if !end_block.has_value {
+		end_block.value = n_disk_blocks - 1
 	}
 
-	if res != CMD_OK {
-		return errors.New("initialization error")
+	if end_block.value >= n_disk_blocks || start_block.value > end_block.value {
+		return 0, 0, fmt.Errorf("invalid block range %d-%d, disk has %d blocks", start_block.value, end_block.value, n_disk_blocks)
 	}
 
-	return nil
+	return start_block.value, end_block.value, nil
 }
 
-func do_read_blocks(port serial.Port, address uint16, amount byte) ([]byte, error) {
-	var res byte
-	var err error
-
-	// Send read block command
-	write_byte(port, CMD_READ_BLOCKS)
-	write_uint16(port, address)
-	write_byte(port, amount)
-
-	// Expect ACK
-	res, err = read_byte(port, READ_TIMEOUT)
+// Read blocks start to end included into out as they come.
+// Without a map, block start goes at offset 0 of out. With a map, blocks go
+// at their offset on the disk, blocks already finished are skipped and the
+// map is saved after every read. Bad blocks are filled and logged in bad.
+// With consensus, blocks of failed batches are read again one by one and
+// pieced together from damaged reads. With an order, the sectors of each
+// track are read one by one in that order.
+// Returns the number of bad blocks.
+func image_blocks(ctx context.Context, client *proto.Client, out io.WriterAt, rmap *RescueMap, bad *BadSectorLog, consensus *Consensus, start uint, end uint, order []byte, retries OptionalUint, ignore_errors bool) (uint, error) {
 
-	if err != nil {
-		return []byte{}, err
+	base := start
+	if rmap != nil {
+		base = 0
 	}
 
-	if res != CMD_ACK {
-		return []byte{}, errors.New("no ACK")
+	pending := func(block uint) bool {
+		return rmap == nil || rmap.status[block] != STATUS_FINISHED
 	}
 
-	// Read result
-	res, err = read_byte(port, READ_TIMEOUT_OP)
+	batches := plan_batches(client.Geometry(), start, end, pending, order)
 
-	if err != nil {
-		return []byte{}, err
+	n_blocks := uint(0)
+	for _, b := range batches {
+		n_blocks += uint(b.amount)
 	}
 
-	if res != CMD_OK {
-		return []byte{}, errors.New("floppy read error")
-	}
+	// Write or fill blocks and record how the read went
+	store := func(block uint, amount byte, data []byte, err error, attempts uint) error {
 
-	// If result is OK, read data
-	var buf []byte
-	buf, err = read_bytes(port, SECTOR_SIZE*uint(amount), READ_TIMEOUT)
-
-	if err != nil {
-		return []byte{}, err
-	}
-
-	return buf, nil
-
-}
-
-func retry_read_blocks(port serial.Port, address uint16, amount byte, retries uint) ([]byte, error) {
-
-	var data []byte
-	var err error
-
-	// Always do at least 1 try
-	retries++
-
-	for retries > 0 {
-		data, err = do_read_blocks(port, address, amount)
+		offset := int64((block - base) * SECTOR_SIZE)
 
 		if err == nil {
-			return data, nil
+			if _, err := out.WriteAt(data, offset); err != nil {
+				return err
+			}
+			bad.read_ok(block, amount)
+		} else if err := bad.failed(out, offset, block, amount, err, attempts); err != nil {
+			return err
 		}
 
-		retries--
-	}
-
-	return data, err
-}
+		if rmap == nil {
+			return nil
+		}
 
-func read_all_blocks(port serial.Port, start_block OptionalUint, end_block OptionalUint, retries OptionalUint, ignore_errors bool) ([]byte, uint, error) {
+		status := STATUS_FINISHED
+		if err != nil {
+			status = STATUS_BAD
+		}
+		rmap.set(block, uint(amount), status)
 
-	if !start_block.has_value {
-		start_block.value = 0
-	}
-	if !end_block.has_value {
-		end_block.value = N_BLOCKS - 1
+		return rmap.save()
 	}
 
-	n_blocks := end_block.value - start_block.value + 1
-
-	// Initialize buffer
-	blocks := make([]byte, n_blocks*SECTOR_SIZE)
-
 	n_errors := uint(0)
+	blocks_done := uint(0)
 
 	update_progress_bar(0, n_blocks)
 
-	for i := uint(0); i < n_blocks; {
+	for _, b := range batches {
 
-		amount := byte(min(uint(READ_BLOCKS_MAX_AMOUNT), n_blocks-i))
+		i, amount := b.block, b.amount
 
-		blocksr, err := retry_read_blocks(port, uint16(i+start_block.value), amount, retries.value)
+		blocksr, err := client.ReadBlocksRetries(ctx, uint16(i), amount, retries.value)
 
-		if err != nil {
+		// Interrupted, what was read so far is kept
+		if ctx.Err() != nil {
+			return n_errors, ctx.Err()
+		}
+
+		failed := uint(0)
+
+		if err != nil && consensus != nil {
+			// Sector by sector, putting damaged reads together
+			for block := i; block < i+uint(amount); block++ {
+				data, reads, err := consensus.read(ctx, client, block)
+
+				if ctx.Err() != nil {
+					return n_errors, ctx.Err()
+				}
+				if err != nil {
+					failed++
+				}
+				if err := store(block, 1, data, err, retries.value+1+reads); err != nil {
+					return n_errors, err
+				}
+			}
+		} else {
+			if err != nil {
+				failed = uint(amount)
+			}
+			if err := store(i, amount, blocksr, err, retries.value+1); err != nil {
+				return n_errors, err
+			}
+		}
+
+		if failed > 0 {
 
 			// If ignore errors, skip to next block
-			if ignore_errors {
-				print_log_message(fmt.Sprintf("%s read error on block %d", FmtCol("Warning: ", ColorYellowHI), i+start_block.value))
-				update_progress_bar(i+1, n_blocks)
-				i += uint(amount)
-				n_errors += uint(amount)
-				continue
+			if !ignore_errors {
+				return n_errors, fmt.Errorf("floppy read error on block: %d", i)
 			}
 
-			return []byte{}, 0, fmt.Errorf("floppy read error on block: %d", i+start_block.value)
+			print_log_message(fmt.Sprintf("%s read error on block %d", FmtCol("Warning: ", ColorYellowHI), i))
+			n_errors += failed
 		}
 
-		// Copy read block in file buffer
-		start := i * SECTOR_SIZE
-		end := start + SECTOR_SIZE*uint(amount)
-		copy(blocks[start:end], blocksr)
-
-		i += uint(amount)
+		blocks_done += uint(amount)
 
-		update_progress_bar(i, n_blocks)
+		update_progress_bar(blocks_done, n_blocks)
 	}
 
-	return blocks, n_errors, nil
+	return n_errors, nil
 }
 
 func main() {
@@ -435,13 +258,15 @@ func main() {
 	}
 
 	var err error
-	var port serial.Port
-	var name string
+	var client *proto.Client
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// Find serial port
 	if !conf.device.has_value {
 		fmt.Println("Trying to find Arduino...")
-		port, name, err = find_arduino()
+		client, err = proto.Find(ctx, proto.RESET_DELAY)
 		if err != nil {
 			PrtCol("Error: ", ColorRedHI)
 			fmt.Println("unable to find Arduino")
@@ -449,77 +274,250 @@ func main() {
 		}
 	} else {
 		fmt.Println("Connecting to Arduino...")
-		port, err = connect_and_handshake(conf.device.value)
+		client, err = proto.Open(ctx, conf.device.value, proto.RESET_DELAY)
 		if err != nil {
 			PrtCol("Error: ", ColorRedHI)
 			fmt.Printf("unable to connect to Arduino on port %s: %s\n", conf.device.value, err)
 			os.Exit(1)
 		}
-		name = conf.device.value
 	}
 
 	PrtCol("Connected ", ColorGreenHI)
-	fmt.Printf("on port %s\n", name)
+	fmt.Printf("on port %s\n", client.Name())
 
-	// CTRL-C handler
+	// CTRL-C handler: stop reading, what was read so far is still written
+	// out. A second CTRL-C exits right away.
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	go func() {
-		for sig := range c {
-			if sig != nil {
-				port.Close()
-				fmt.Println("Exiting...")
-				os.Exit(0)
-			}
-		}
+		<-c
+		print_log_message("Interrupted, stopping...")
+		cancel()
+		<-c
+		fmt.Println("Exiting...")
+		os.Exit(130)
 	}()
 
 	// Initialize drive
-	err = do_initialize(port)
+	err = client.Initialize(ctx)
 
 	if err != nil {
 		PrtCol("Error: ", ColorRedHI)
 		fmt.Println("drive initalization failed!")
-		port.Close()
+		client.Close()
 		os.Exit(2)
 	}
 
-	fmt.Println("Drive initialized!")
+	// Disk format, detected unless given
+	if conf.format.has_value {
+		client.SetGeometry(conf.format.value)
+	} else {
+		geometry, from_bpb, err := client.DetectFormat(ctx)
 
-	fmt.Println("Reading disk...")
+		if err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("unable to detect disk format: %s, try --format\n", err)
+			client.Close()
+			os.Exit(2)
+		}
 
-	// Read blocks from disk
-	var data []byte
-	var n_errors uint
-	data, n_errors, err = read_all_blocks(port, conf.start_block, conf.end_block, conf.max_retries, conf.ignore_errors)
+		client.SetGeometry(geometry)
+
+		if from_bpb {
+			fmt.Printf("Detected %s disk from boot sector\n", geometry)
+		} else {
+			fmt.Printf("Detected %s disk from sectors on track 0\n", geometry)
+		}
+	}
+
+	fmt.Println("Drive initialized!")
 
-	port.Close()
+	start, end, err := block_range(client, conf.start_block, conf.end_block)
 
 	if err != nil {
 		fmt.Printf("%s: %s\n", FmtCol("Error", ColorRedHI), err)
-		os.Exit(3)
+		client.Close()
+		os.Exit(1)
 	}
 
-	// Write data to disk
+	// Map of a previous run, if any
+	var rmap *RescueMap
+
+	if conf.map_file.has_value {
+		rmap, err = load_map(conf.map_file.value, client.Geometry().Blocks())
+
+		if err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("unable to load map %s: %s\n", conf.map_file.value, err)
+			client.Close()
+			os.Exit(1)
+		}
+
+		finished := rmap.count(start, end, STATUS_FINISHED)
+		bad := rmap.count(start, end, STATUS_BAD)
+
+		if finished+bad > 0 {
+			fmt.Printf("Resuming: %d blocks finished, %d bad, %d untried\n", finished, bad, rmap.count(start, end, STATUS_UNTRIED))
+		}
+	}
+
+	// Output is only truncated when not resuming or keeping its content
 	var outf *os.File
-	outf, err = os.Create(conf.out_file.value)
+	if rmap != nil || conf.fill == FILL_KEEP {
+		outf, err = os.OpenFile(conf.out_file.value, os.O_RDWR|os.O_CREATE, 0644)
+	} else {
+		outf, err = os.Create(conf.out_file.value)
+	}
 
 	if err != nil {
 		PrtCol("Error: ", ColorRedHI)
-		fmt.Printf(" Unable to open %s: %s", conf.out_file.value, err)
+		fmt.Printf("unable to open %s: %s\n", conf.out_file.value, err)
+		client.Close()
+		os.Exit(1)
+	}
+
+	// Sectors in the order they come under the head
+	var order []byte
+
+	if conf.order == ORDER_PHYSICAL {
+		cylinder, head, _ := client.Geometry().LBAToCHS(start)
+
+		fmt.Println("Analyzing rotation...")
+		rotation, err := client.AnalyzeRotation(ctx, cylinder, head)
+
+		if err == nil {
+			order = rotation.ReadOrder()
+			fmt.Printf("%.1f RPM, interleave %d, reading tracks in order %v\n", rotation.RPM(), rotation.Interleave, order)
+		} else if ctx.Err() == nil {
+			fmt.Printf("%s rotation analysis failed: %s, reading in logical order\n", FmtCol("Warning:", ColorYellowHI), err)
+		}
+	}
+
+	fmt.Println("Reading disk...")
+
+	started := time.Now()
+
+	// Read blocks from disk
+	var n_errors uint
+	var recovery *Recovery
+
+	bad := new_bad_sector_log(conf.fill, client.Geometry())
+
+	var consensus *Consensus
+	if conf.votes.has_value {
+		consensus = &Consensus{votes: conf.votes.value, agree: conf.agree}
+	}
+
+	if conf.recover {
+		if rmap == nil {
+			rmap = new_map("", client.Geometry().Blocks())
+		}
+		recovery, err = recover_blocks(ctx, client, outf, rmap, bad, consensus, start, end, conf.max_retries, conf.passes.value)
+	} else {
+		n_errors, err = image_blocks(ctx, client, outf, rmap, bad, consensus, start, end, order, conf.max_retries, conf.ignore_errors)
+	}
+
+	client.Close()
+
+	if close_err := outf.Close(); err == nil && close_err != nil {
+		err = close_err
 	}
 
-	_, err = outf.Write(data)
+	// Error log is written even if reading stopped early
+	if conf.error_log.has_value {
+		if log_err := bad.save(conf.error_log.value); log_err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("unable to write error log %s: %s\n", conf.error_log.value, log_err)
+		}
+	}
+
+	if errors.Is(err, context.Canceled) {
+		if conf.map_file.has_value {
+			fmt.Printf("Stopped, %d blocks left, run again with the same map to resume\n", end-start+1-rmap.count(start, end, STATUS_FINISHED))
+		} else {
+			fmt.Println("Stopped, the image is incomplete: use --map to be able to resume")
+		}
+		os.Exit(4)
+	}
 
 	if err != nil {
-		PrtCol("Error: ", ColorRedHI)
-		fmt.Printf(" Unable to write to %s: %s", conf.out_file.value, err)
+		fmt.Printf("%s: %s\n", FmtCol("Error", ColorRedHI), err)
+		if conf.map_file.has_value {
+			fmt.Println("Run again with the same map to retry the failed blocks")
+		}
+		os.Exit(3)
 	}
-	outf.Close()
 
 	PrtCol("Done!\n", ColorGreenHI)
 
-	if conf.ignore_errors {
+	if rmap != nil {
+		n_errors = rmap.count(start, end, STATUS_BAD)
+	}
+
+	// Blocks read on each pass
+	if recovery != nil {
+		for pass := PASS_FAST; uint(pass) <= conf.passes.value; pass++ {
+			fmt.Printf("Pass %d (%s): %d blocks\n", pass, pass_name(pass), recovery.count(pass))
+		}
+	}
+
+	// Sectors whose data is a best guess
+	if consensus != nil {
+		fmt.Printf("%d sectors needed votes\n", len(consensus.voted))
+		for _, v := range consensus.voted {
+			cylinder, head, sector := client.Geometry().LBAToCHS(v.LBA)
+			fmt.Printf("  %s (%d/%d/%d)\n", v, cylinder, head, sector)
+		}
+	}
+
+	if conf.ignore_errors || conf.recover || n_errors > 0 {
 		fmt.Printf("%d read %s\n", n_errors, FmtCol("errors", ColorRedHI))
 	}
+
+	// Image hashes and how it was made
+	manifest := Manifest{
+		Tool:       "disk2img",
+		Version:    tool_version(),
+		Image:      filepath.Base(conf.out_file.value),
+		Geometry:   new_manifest_geometry(client.Geometry()),
+		StartBlock: start,
+		EndBlock:   end,
+		Retries:    conf.max_retries.value,
+		Fill:       conf.fill,
+		Errors:     n_errors,
+		Started:    started,
+		Finished:   time.Now(),
+	}
+
+	if conf.recover {
+		manifest.Passes = conf.passes.value
+	}
+	if consensus != nil {
+		manifest.Votes = consensus.votes
+	}
+	for _, sector := range order {
+		manifest.ReadOrder = append(manifest.ReadOrder, uint(sector))
+	}
+
+	// Blocks are at their disk offset with a map
+	base := start
+	if conf.map_file.has_value {
+		base = 0
+	}
+
+	manifest.Hashes, manifest.Tracks, manifest.Size, err = hash_image(conf.out_file.value, base, start, end, client.Geometry())
+
+	if err == nil {
+		fmt.Printf("MD5:     %s\n", manifest.Hashes.MD5)
+		fmt.Printf("SHA-256: %s\n", manifest.Hashes.SHA256)
+		err = manifest.save(conf.manifest.value)
+	}
+
+	// The image is complete without its manifest
+	if err != nil {
+		fmt.Printf("%s unable to write manifest %s: %s\n", FmtCol("Warning:", ColorYellowHI), conf.manifest.value, err)
+		return
+	}
+
+	fmt.Printf("Manifest written to %s\n", conf.manifest.value)
 }
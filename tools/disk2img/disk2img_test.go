@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+func sector_error(lba uint, ec emulator.FloppyError, fail_count uint) emulator.SectorFault {
+	return emulator.SectorFault{LBA: &lba, Error: &ec, FailCount: fail_count}
+}
+
+func TestReadAllBlocks(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	client := emulatortest.StartClient(t, image, proto.FORMAT_1440K, nil)
+
+	data, n_errors, err := read_all_blocks(context.Background(), client, OptionalUint{}, OptionalUint{}, OptionalUint{value: 0}, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n_errors != 0 {
+		t.Errorf("n_errors = %d, want 0", n_errors)
+	}
+	if !bytes.Equal(data, image) {
+		t.Error("image differs from disk")
+	}
+}
+
+func TestReadAllBlocksFormat(t *testing.T) {
+	for _, format := range []proto.Geometry{proto.FORMAT_720K, proto.FORMAT_1200K} {
+		image := emulatortest.RandomImage(format)
+		client := emulatortest.StartClient(t, image, format, nil)
+
+		data, _, err := read_all_blocks(context.Background(), client, OptionalUint{}, OptionalUint{}, OptionalUint{value: 0}, false)
+
+		if err != nil {
+			t.Fatalf("%s: %s", format.Name, err)
+		}
+		if !bytes.Equal(data, image) {
+			t.Errorf("%s: image differs from disk", format.Name)
+		}
+	}
+}
+
+func TestReadAllBlocksOutOfRange(t *testing.T) {
+	client := emulatortest.StartClient(t, nil, proto.FORMAT_720K, nil)
+
+	end := OptionalUint{value: proto.FORMAT_720K.Blocks(), has_value: true}
+
+	if _, _, err := read_all_blocks(context.Background(), client, OptionalUint{}, end, OptionalUint{value: 0}, false); err == nil {
+		t.Error("expected error past the end of the disk")
+	}
+}
+
+func TestReadAllBlocksRange(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	client := emulatortest.StartClient(t, image, proto.FORMAT_1440K, nil)
+
+	start := OptionalUint{value: 100, has_value: true}
+	end := OptionalUint{value: 250, has_value: true}
+
+	data, _, err := read_all_blocks(context.Background(), client, start, end, OptionalUint{value: 0}, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, image[100*SECTOR_SIZE:251*SECTOR_SIZE]) {
+		t.Error("image differs from disk")
+	}
+}
+
+func TestReadAllBlocksRetries(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	profile := &emulator.Profile{
+		Sectors: []emulator.SectorFault{sector_error(10, emulator.CRC, 2)},
+	}
+	client := emulatortest.StartClient(t, image, proto.FORMAT_1440K, profile)
+
+	end := OptionalUint{value: 35, has_value: true}
+
+	data, _, err := read_all_blocks(context.Background(), client, OptionalUint{}, end, OptionalUint{value: 2}, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, image[:36*SECTOR_SIZE]) {
+		t.Error("image differs from disk")
+	}
+}
+
+func TestReadAllBlocksError(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	profile := &emulator.Profile{
+		Sectors: []emulator.SectorFault{sector_error(40, emulator.CRC, 0)},
+	}
+	client := emulatortest.StartClient(t, image, proto.FORMAT_1440K, profile)
+
+	end := OptionalUint{value: 71, has_value: true}
+
+	_, _, err := read_all_blocks(context.Background(), client, OptionalUint{}, end, OptionalUint{value: 1}, false)
+
+	if err == nil {
+		t.Fatal("expected read error")
+	}
+}
+
+func TestReadAllBlocksIgnoreErrors(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	profile := &emulator.Profile{
+		Sectors: []emulator.SectorFault{
+			sector_error(40, emulator.CRC, 0),
+			sector_error(50, emulator.SECTOR_NOT_FOUND, 0),
+		},
+	}
+	client := emulatortest.StartClient(t, image, proto.FORMAT_1440K, profile)
+
+	end := OptionalUint{value: 71, has_value: true}
+
+	data, n_errors, err := read_all_blocks(context.Background(), client, OptionalUint{}, end, OptionalUint{value: 1}, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Whole batches of READ_BLOCKS_MAX_AMOUNT blocks are skipped
+	if n_errors != 6 {
+		t.Errorf("n_errors = %d, want 6", n_errors)
+	}
+
+	want := bytes.Clone(image[:72*SECTOR_SIZE])
+	clear(want[39*SECTOR_SIZE : 42*SECTOR_SIZE])
+	clear(want[48*SECTOR_SIZE : 51*SECTOR_SIZE])
+
+	if !bytes.Equal(data, want) {
+		t.Error("image differs from disk")
+	}
+}
+
+func TestImageBlocksResume(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	profile := &emulator.Profile{
+		Sectors: []emulator.SectorFault{sector_error(40, emulator.CRC, 1)},
+	}
+	client := emulatortest.StartClient(t, image, proto.FORMAT_1440K, profile)
+
+	dir := t.TempDir()
+	rmap, err := load_map(filepath.Join(dir, "disk.map"), client.Geometry().Blocks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.Create(filepath.Join(dir, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	ctx := context.Background()
+
+	// First run stops at the bad batch, blocks go at their disk offset
+	if _, err := image_blocks(ctx, client, out, rmap, new_bad_sector_log(FILL_ZERO, client.Geometry()), nil, 18, 71, nil, OptionalUint{value: 0}, false); err == nil {
+		t.Fatal("expected read error")
+	}
+	if rmap.count(18, 71, STATUS_FINISHED) != 21 || rmap.count(18, 71, STATUS_BAD) != 3 {
+		t.Fatalf("map after first run: %d finished, %d bad", rmap.count(18, 71, STATUS_FINISHED), rmap.count(18, 71, STATUS_BAD))
+	}
+
+	// Second run from the saved map reads the rest
+	rmap, err = load_map(rmap.path, client.Geometry().Blocks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n_errors, err := image_blocks(ctx, client, out, rmap, new_bad_sector_log(FILL_ZERO, client.Geometry()), nil, 18, 71, nil, OptionalUint{value: 0}, false)
+	if err != nil || n_errors != 0 {
+		t.Fatalf("second run: %d errors, %v", n_errors, err)
+	}
+	if rmap.count(18, 71, STATUS_FINISHED) != 54 {
+		t.Errorf("%d blocks finished, want 54", rmap.count(18, 71, STATUS_FINISHED))
+	}
+
+	data, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data[18*SECTOR_SIZE:], image[18*SECTOR_SIZE:72*SECTOR_SIZE]) {
+		t.Error("image differs from disk")
+	}
+}
+
+func TestImageBlocksCanceled(t *testing.T) {
+	client := emulatortest.StartClient(t, emulatortest.RandomImage(proto.FORMAT_1440K), proto.FORMAT_1440K, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	rmap, _ := load_map(filepath.Join(t.TempDir(), "disk.map"), client.Geometry().Blocks())
+	blocks := make(memory_image, 72*SECTOR_SIZE)
+
+	if _, err := image_blocks(ctx, client, blocks, rmap, new_bad_sector_log(FILL_ZERO, client.Geometry()), nil, 0, 71, nil, OptionalUint{value: 0}, true); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if rmap.count(0, 71, STATUS_UNTRIED) != 72 {
+		t.Error("blocks marked although the read was canceled")
+	}
+}
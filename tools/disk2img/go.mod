@@ -3,14 +3,17 @@ module floppy_arduino/disk2img
 go 1.21.5
 
 require (
-	github.com/albenik/go-serial v1.2.0
+	floppy_arduino/proto v0.0.0
 	golang.org/x/term v0.15.0
 )
 
 require (
+	github.com/albenik/go-serial v1.2.0 // indirect
 	github.com/creack/goselect v0.1.2 // indirect
 	github.com/stretchr/testify v1.7.0 // indirect
 	go.uber.org/atomic v1.4.0 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
 )
+
+replace floppy_arduino/proto => ../../proto
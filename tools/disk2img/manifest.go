@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"floppy_arduino/proto"
+)
+
+// Manifest file written next to the image unless given
+const MANIFEST_SUFFIX string = ".manifest.json"
+
+// Hashes of the whole image
+type ImageHashes struct {
+	MD5    string `json:"md5"`
+	SHA1   string `json:"sha1"`
+	SHA256 string `json:"sha256"`
+	CRC32  string `json:"crc32"`
+}
+
+// Hashes of the blocks of one side of a cylinder in the image
+type TrackHash struct {
+	Cylinder byte   `json:"cylinder"`
+	Head     byte   `json:"head"`
+	FirstLBA uint   `json:"first_lba"`
+	Blocks   uint   `json:"blocks"`
+	SHA256   string `json:"sha256"`
+	CRC32    string `json:"crc32"`
+}
+
+type ManifestGeometry struct {
+	Name    string `json:"name"`
+	Tracks  byte   `json:"tracks"`
+	Heads   byte   `json:"heads"`
+	Sectors byte   `json:"sectors"`
+}
+
+// Manifest describes how an image was made, for archival
+type Manifest struct {
+	Tool       string           `json:"tool"`
+	Version    string           `json:"version"`
+	Image      string           `json:"image"`
+	Size       int64            `json:"size"`
+	Geometry   ManifestGeometry `json:"geometry"`
+	StartBlock uint             `json:"start_block"`
+	EndBlock   uint             `json:"end_block"`
+	Retries    uint             `json:"retries"`
+	Passes     uint             `json:"passes,omitempty"`
+	Votes      uint             `json:"votes,omitempty"`
+	ReadOrder  []uint           `json:"read_order,omitempty"` // Sectors of a track in the order read
+	Fill       string           `json:"fill"`
+	Errors     uint             `json:"errors"`
+	Started    time.Time        `json:"started"`
+	Finished   time.Time        `json:"finished"`
+	Hashes     ImageHashes      `json:"hashes"`
+	Tracks     []TrackHash      `json:"tracks"`
+}
+
+// Version of the build, with the commit if known
+func tool_version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	version := info.Main.Version
+
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			version += " " + setting.Value
+		}
+	}
+
+	return version
+}
+
+func new_manifest_geometry(g proto.Geometry) ManifestGeometry {
+	return ManifestGeometry{Name: g.Name, Tracks: g.Tracks, Heads: g.Heads, Sectors: g.Sectors}
+}
+
+func hex_sum(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Hash blocks start to end of the image at path in one pass. Block base of
+// the disk is at offset 0 of the file. Anything else the file holds, from an
+// earlier run or another range, is left out.
+func hash_image(path string, base uint, start uint, end uint, geometry proto.Geometry) (ImageHashes, []TrackHash, int64, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return ImageHashes{}, nil, 0, err
+	}
+	defer file.Close()
+
+	h_md5, h_sha1, h_sha256, h_crc32 := md5.New(), sha1.New(), sha256.New(), crc32.NewIEEE()
+	image := io.MultiWriter(h_md5, h_sha1, h_sha256, h_crc32)
+
+	var tracks []TrackHash
+	var t_sha256, t_crc32 hash.Hash
+
+	// Hashes of the track being read are done
+	end_track := func() {
+		if len(tracks) > 0 {
+			track := &tracks[len(tracks)-1]
+			track.SHA256 = hex_sum(t_sha256)
+			track.CRC32 = hex_sum(t_crc32)
+		}
+	}
+
+	block := make([]byte, SECTOR_SIZE)
+	size := int64(0)
+
+	imaged := io.NewSectionReader(file, int64((start-base)*SECTOR_SIZE), int64((end-start+1)*SECTOR_SIZE))
+
+	for lba := start; ; lba++ {
+		n, err := io.ReadFull(imaged, block)
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return ImageHashes{}, nil, 0, err
+		}
+
+		size += int64(n)
+		image.Write(block[:n])
+
+		cylinder, head, sector := geometry.LBAToCHS(lba)
+
+		if len(tracks) == 0 || sector == 1 {
+			end_track()
+			tracks = append(tracks, TrackHash{Cylinder: cylinder, Head: head, FirstLBA: lba})
+			t_sha256, t_crc32 = sha256.New(), crc32.NewIEEE()
+		}
+
+		tracks[len(tracks)-1].Blocks++
+		t_sha256.Write(block[:n])
+		t_crc32.Write(block[:n])
+	}
+
+	end_track()
+
+	hashes := ImageHashes{
+		MD5:    hex_sum(h_md5),
+		SHA1:   hex_sum(h_sha1),
+		SHA256: hex_sum(h_sha256),
+		CRC32:  hex_sum(h_crc32),
+	}
+
+	return hashes, tracks, size, nil
+}
+
+func (m *Manifest) save(path string) error {
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+func TestHashImage(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)[:20*SECTOR_SIZE]
+	path := filepath.Join(t.TempDir(), "disk.img")
+
+	// Stale blocks from an earlier run follow the image
+	if err := os.WriteFile(path, append(append([]byte{}, image...), make([]byte, 3*SECTOR_SIZE)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Image is blocks 5 to 24 of a 720K disk, 9 sectors per track
+	hashes, tracks, size, err := hash_image(path, 5, 5, 24, proto.FORMAT_720K)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum_md5 := md5.Sum(image)
+	sum_sha256 := sha256.Sum256(image)
+	if size != int64(len(image)) || hashes.MD5 != hex.EncodeToString(sum_md5[:]) || hashes.SHA256 != hex.EncodeToString(sum_sha256[:]) {
+		t.Errorf("hashes = %+v, size %d", hashes, size)
+	}
+	if len(hashes.SHA1) != 40 || len(hashes.CRC32) != 8 {
+		t.Errorf("hashes = %+v", hashes)
+	}
+
+	want := []TrackHash{
+		{Cylinder: 0, Head: 0, FirstLBA: 5, Blocks: 4},
+		{Cylinder: 0, Head: 1, FirstLBA: 9, Blocks: 9},
+		{Cylinder: 1, Head: 0, FirstLBA: 18, Blocks: 7},
+	}
+	if len(tracks) != len(want) {
+		t.Fatalf("tracks = %+v", tracks)
+	}
+	for i, track := range tracks {
+		sum := sha256.Sum256(image[(track.FirstLBA-5)*SECTOR_SIZE : (track.FirstLBA-5+track.Blocks)*SECTOR_SIZE])
+		want[i].SHA256 = hex.EncodeToString(sum[:])
+		want[i].CRC32 = track.CRC32
+		if track != want[i] {
+			t.Errorf("track %d = %+v, want %+v", i, track, want[i])
+		}
+	}
+}
+
+func TestHashImageMap(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)[:40*SECTOR_SIZE]
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// With a map, blocks are at their disk offset and only 10 to 19 were imaged
+	hashes, tracks, size, err := hash_image(path, 0, 10, 19, proto.FORMAT_720K)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum_sha256 := sha256.Sum256(image[10*SECTOR_SIZE : 20*SECTOR_SIZE])
+	if size != 10*int64(SECTOR_SIZE) || hashes.SHA256 != hex.EncodeToString(sum_sha256[:]) {
+		t.Errorf("hashes = %+v, size %d", hashes, size)
+	}
+	if len(tracks) != 2 || tracks[0].FirstLBA != 10 || tracks[0].Blocks != 8 || tracks[1].Blocks != 2 {
+		t.Errorf("tracks = %+v", tracks)
+	}
+}
+
+func TestManifestSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img.manifest.json")
+	m := Manifest{Tool: "disk2img", Geometry: new_manifest_geometry(proto.FORMAT_720K), EndBlock: 1439, Retries: 5, Errors: 2}
+
+	if err := m.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"tool", "version", "geometry", "start_block", "end_block", "retries", "errors", "started", "finished", "hashes", "tracks"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("manifest lacks %q", key)
+		}
+	}
+	if _, ok := fields["passes"]; ok {
+		t.Error("passes written outside recovery mode")
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Block status in the map file, same characters as GNU ddrescue
+const STATUS_UNTRIED byte = '?'
+const STATUS_FINISHED byte = '+'
+const STATUS_BAD byte = '-'
+
+// RescueMap tracks which blocks of the disk have been read, in a map file
+// compatible with GNU ddrescue's. Positions and sizes are in bytes:
+//
+//	# current_pos  current_status
+//	0x00012000     ?
+//	#      pos        size  status
+//	0x00000000  0x00012000  +
+//	0x00012000  0x00000600  -
+//	0x00012600  0x0015DA00  ?
+type RescueMap struct {
+	path    string
+	status  []byte
+	current uint
+}
+
+// New map of n_blocks untried blocks. Without a path it is only kept in
+// memory.
+func new_map(path string, n_blocks uint) *RescueMap {
+
+	m := &RescueMap{path: path, status: make([]byte, n_blocks)}
+
+	for i := range m.status {
+		m.status[i] = STATUS_UNTRIED
+	}
+
+	return m
+}
+
+// Load the map file at path, or start a new one if it doesn't exist.
+// n_blocks is the size of the disk.
+func load_map(path string, n_blocks uint) (*RescueMap, error) {
+
+	m := new_map(path, n_blocks)
+
+	file, err := os.Open(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	line_no := 0
+	seen_current := false
+	current := uint(0)
+
+	for scanner.Scan() {
+		line_no++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+
+		// First line is the current position and status
+		if !seen_current {
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("%s:%d: bad current position line", path, line_no)
+			}
+			pos, err := strconv.ParseUint(fields[0], 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line_no, err)
+			}
+			current = uint(pos) / SECTOR_SIZE
+			seen_current = true
+			continue
+		}
+
+		if len(fields) != 3 || len(fields[2]) != 1 {
+			return nil, fmt.Errorf("%s:%d: expected pos size status", path, line_no)
+		}
+
+		pos, err := strconv.ParseUint(fields[0], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line_no, err)
+		}
+		size, err := strconv.ParseUint(fields[1], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line_no, err)
+		}
+
+		if pos%uint64(SECTOR_SIZE) != 0 || size%uint64(SECTOR_SIZE) != 0 {
+			return nil, fmt.Errorf("%s:%d: range not aligned to sectors", path, line_no)
+		}
+		if (pos+size)/uint64(SECTOR_SIZE) > uint64(n_blocks) {
+			return nil, fmt.Errorf("%s:%d: range past the end of the disk", path, line_no)
+		}
+
+		// Statuses of a ddrescue run that was not finished count as bad
+		status := fields[2][0]
+		switch status {
+		case STATUS_UNTRIED, STATUS_FINISHED, STATUS_BAD:
+		case '*', '/':
+			status = STATUS_BAD
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown status %q", path, line_no, status)
+		}
+
+		m.set(uint(pos)/SECTOR_SIZE, uint(size)/SECTOR_SIZE, status)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	m.current = current
+	return m, nil
+}
+
+// Set the status of amount blocks starting at block
+func (m *RescueMap) set(block uint, amount uint, status byte) {
+	for i := block; i < block+amount; i++ {
+		m.status[i] = status
+	}
+	m.current = block + amount
+}
+
+// Count the blocks from start to end included with the given status
+func (m *RescueMap) count(start uint, end uint, status byte) uint {
+	n := uint(0)
+	for i := start; i <= end; i++ {
+		if m.status[i] == status {
+			n++
+		}
+	}
+	return n
+}
+
+// Write the map, replacing the old file only once the new one is complete
+func (m *RescueMap) save() error {
+
+	if m.path == "" {
+		return nil
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# Mapfile. Created by disk2img\n")
+	fmt.Fprintf(&b, "# Updated: %s\n", time.Now().Format(time.DateTime))
+	fmt.Fprintf(&b, "# current_pos  current_status\n")
+
+	current_status := STATUS_FINISHED
+	if m.current < uint(len(m.status)) {
+		current_status = m.status[m.current]
+	}
+	fmt.Fprintf(&b, "0x%08X     %c\n", m.current*SECTOR_SIZE, current_status)
+
+	fmt.Fprintf(&b, "#      pos        size  status\n")
+
+	// One line per run of blocks with the same status
+	for start := 0; start < len(m.status); {
+		end := start + 1
+		for end < len(m.status) && m.status[end] == m.status[start] {
+			end++
+		}
+		fmt.Fprintf(&b, "0x%08X  0x%08X  %c\n", uint(start)*SECTOR_SIZE, uint(end-start)*SECTOR_SIZE, m.status[start])
+		start = end
+	}
+
+	tmp := m.path + ".tmp"
+
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, m.path)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRescueMapSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.map")
+
+	m, err := load_map(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.count(0, 99, STATUS_UNTRIED) != 100 {
+		t.Fatal("new map is not untried")
+	}
+
+	m.set(0, 30, STATUS_FINISHED)
+	m.set(30, 3, STATUS_BAD)
+	m.set(33, 10, STATUS_FINISHED)
+
+	if err := m.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	text, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"0x00005600     ?",
+		"0x00000000  0x00003C00  +",
+		"0x00003C00  0x00000600  -",
+		"0x00004200  0x00001400  +",
+		"0x00005600  0x00007200  ?",
+	} {
+		if !strings.Contains(string(text), line+"\n") {
+			t.Errorf("map lacks line %q:\n%s", line, text)
+		}
+	}
+
+	loaded, err := load_map(path, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(loaded.status) != string(m.status) || loaded.current != 43 {
+		t.Errorf("loaded map differs, current %d", loaded.current)
+	}
+
+	// Disk smaller than the map
+	if _, err := load_map(path, 50); err == nil {
+		t.Error("expected error for a map larger than the disk")
+	}
+}
+
+func TestRescueMapBadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.map")
+
+	for _, text := range []string{
+		"0x0 ?\n0x0 0x100 +\n",
+		"0x0 ?\n0x0 0x200 x\n",
+		"0x0 ?\n0x0 0x200\n",
+		"nope ?\n",
+	} {
+		os.WriteFile(path, []byte(text), 0644)
+		if _, err := load_map(path, 10); err == nil {
+			t.Errorf("expected error loading %q", text)
+		}
+	}
+
+	// Unfinished ddrescue areas count as bad
+	os.WriteFile(path, []byte("0x0 ?\n0x0 0x400 *\n0x400 0x200 /\n"), 0644)
+	m, err := load_map(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.count(0, 9, STATUS_BAD) != 3 {
+		t.Errorf("bad blocks = %d, want 3", m.count(0, 9, STATUS_BAD))
+	}
+}
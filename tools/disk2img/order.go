@@ -0,0 +1,58 @@
+package main
+
+import (
+	"floppy_arduino/proto"
+)
+
+// Orders to read blocks in
+const ORDER_LOGICAL string = "logical"   // Batches of consecutive blocks
+const ORDER_PHYSICAL string = "physical" // Tracks sector by sector, in the order they come under the head
+
+// Blocks read with one command
+type Batch struct {
+	block  uint
+	amount byte
+}
+
+// Plan the reads of the pending blocks from start to end. Without an order
+// consecutive blocks are read together, otherwise the sectors of each
+// track are read one by one in that order.
+func plan_batches(geometry proto.Geometry, start uint, end uint, pending func(uint) bool, order []byte) []Batch {
+
+	var batches []Batch
+
+	if order == nil {
+		for i := start; i <= end; {
+
+			if !pending(i) {
+				i++
+				continue
+			}
+
+			// Up to the next finished block
+			amount := byte(1)
+			for amount < proto.READ_BLOCKS_MAX_AMOUNT && i+uint(amount) <= end && pending(i+uint(amount)) {
+				amount++
+			}
+
+			batches = append(batches, Batch{block: i, amount: amount})
+			i += uint(amount)
+		}
+
+		return batches
+	}
+
+	sectors := uint(geometry.Sectors)
+
+	for track := start - start%sectors; track <= end; track += sectors {
+		for _, sector := range order {
+			block := track + uint(sector) - 1
+
+			if block >= start && block <= end && pending(block) {
+				batches = append(batches, Batch{block: block, amount: 1})
+			}
+		}
+	}
+
+	return batches
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+func TestPlanBatches(t *testing.T) {
+	pending := func(block uint) bool { return block != 10 }
+
+	// Consecutive pending blocks, up to the batch size
+	batches := plan_batches(proto.FORMAT_720K, 5, 16, pending, nil)
+	want := []Batch{{5, 3}, {8, 2}, {11, 3}, {14, 3}}
+
+	if !slices.Equal(batches, want) {
+		t.Errorf("logical = %v, want %v", batches, want)
+	}
+
+	// Tracks in order, only blocks in the range
+	order := []byte{1, 3, 5, 7, 9, 2, 4, 6, 8}
+	batches = plan_batches(proto.FORMAT_720K, 5, 16, pending, order)
+
+	var blocks []uint
+	for _, b := range batches {
+		if b.amount != 1 {
+			t.Fatalf("batch %v of more than one block", b)
+		}
+		blocks = append(blocks, b.block)
+	}
+
+	if want := []uint{6, 8, 5, 7, 9, 11, 13, 15, 12, 14, 16}; !slices.Equal(blocks, want) {
+		t.Errorf("physical = %v, want %v", blocks, want)
+	}
+}
+
+func TestImageBlocksOrder(t *testing.T) {
+	format := proto.FORMAT_720K
+	image := emulatortest.RandomImage(format)
+
+	profile := &emulator.Profile{Rotation: &emulator.RotationModel{RPM: 1200, Interleave: 1}}
+	client := emulatortest.StartClient(t, image, format, profile)
+
+	// Every other sector comes in time
+	rotation := proto.Rotation{Order: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9}, Skip: 2}
+
+	read := func(order []byte) ([]byte, time.Duration) {
+		t.Helper()
+
+		out := make(memory_image, 18*SECTOR_SIZE)
+		bad := new_bad_sector_log(FILL_ZERO, format)
+
+		started := time.Now()
+		if _, err := image_blocks(context.Background(), client, out, nil, bad, nil, 0, 17, order, OptionalUint{value: 0}, false); err != nil {
+			t.Fatal(err)
+		}
+
+		return out, time.Since(started)
+	}
+
+	logical, logical_time := read(nil)
+	physical, physical_time := read(rotation.ReadOrder())
+
+	if !bytes.Equal(logical, image[:18*SECTOR_SIZE]) || !bytes.Equal(physical, logical) {
+		t.Fatal("image differs from disk")
+	}
+
+	// A revolution per sector against about two per track
+	if physical_time > logical_time/2 {
+		t.Errorf("physical order took %s, logical %s", physical_time, logical_time)
+	}
+}
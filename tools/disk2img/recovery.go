@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"floppy_arduino/proto"
+)
+
+// Recovery passes. Passes after PASS_SPLIT recalibrate the head before
+// every read, and every other one goes backwards.
+const PASS_FAST byte = 1  // Big batches, no retries
+const PASS_SPLIT byte = 2 // Blocks of failed batches one by one
+
+// Passes done by default in recovery mode
+const DEFAULT_PASSES uint = 4
+
+// Recovery records how the blocks start to end were read
+type Recovery struct {
+	start    uint
+	end      uint
+	pass     []byte // Pass a block was read on, 0 if it wasn't
+	attempts []uint // Reads that included a block
+}
+
+func new_recovery(start uint, end uint) *Recovery {
+	return &Recovery{
+		start:    start,
+		end:      end,
+		pass:     make([]byte, end-start+1),
+		attempts: make([]uint, end-start+1),
+	}
+}
+
+// Pass a block was read on, 0 if it is still bad
+func (r *Recovery) pass_of(block uint) byte {
+	return r.pass[block-r.start]
+}
+
+// Number of blocks read on a pass
+func (r *Recovery) count(pass byte) uint {
+	n := uint(0)
+	for _, p := range r.pass {
+		if p == pass {
+			n++
+		}
+	}
+	return n
+}
+
+// Bad blocks, in increasing order
+func (r *Recovery) bad_blocks(rmap *RescueMap) []uint {
+	var blocks []uint
+	for i := r.start; i <= r.end; i++ {
+		if rmap.status[i] == STATUS_BAD {
+			blocks = append(blocks, i)
+		}
+	}
+	return blocks
+}
+
+// Recalibration passes alternate direction, starting backwards
+func pass_backwards(pass byte) bool {
+	return pass > PASS_SPLIT && (pass-PASS_SPLIT)%2 == 1
+}
+
+func pass_name(pass byte) string {
+	switch {
+	case pass == PASS_FAST:
+		return "fast"
+	case pass == PASS_SPLIT:
+		return "split"
+	case pass_backwards(pass):
+		return "recalibrate, backwards"
+	default:
+		return "recalibrate"
+	}
+}
+
+// Read the blocks start to end in several passes, like image_blocks but
+// going on past errors. The fast pass reads every block not finished in the
+// map in batches, the split pass re-reads the blocks of failed batches
+// one at a time, then up to passes in total recalibrate the head before
+// every read of a block still bad, alternately backwards and forwards.
+// Bad blocks are filled and logged in bad. With consensus, single blocks
+// are pieced together from damaged reads instead of retried.
+func recover_blocks(ctx context.Context, client *proto.Client, out io.WriterAt, rmap *RescueMap, bad *BadSectorLog, consensus *Consensus, start uint, end uint, retries OptionalUint, passes uint) (*Recovery, error) {
+
+	base := start
+	if rmap.path != "" {
+		base = 0
+	}
+
+	r := new_recovery(start, end)
+
+	// Read amount blocks at block, tries times
+	read := func(block uint, amount byte, tries uint, pass byte) error {
+
+		var data []byte
+		var err error
+
+		if amount == 1 && consensus != nil {
+			var reads uint
+			data, reads, err = consensus.read(ctx, client, block)
+			r.attempts[block-start] += reads
+		} else {
+			for try := uint(0); try < tries; try++ {
+				for i := block; i < block+uint(amount); i++ {
+					r.attempts[i-start]++
+				}
+
+				data, err = client.ReadBlocks(ctx, uint16(block), amount)
+
+				if err == nil || ctx.Err() != nil {
+					break
+				}
+			}
+		}
+
+		// Interrupted, what was read so far is kept
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		status := STATUS_BAD
+
+		if err == nil {
+			if _, err := out.WriteAt(data, int64((block-base)*SECTOR_SIZE)); err != nil {
+				return err
+			}
+
+			status = STATUS_FINISHED
+			bad.read_ok(block, amount)
+
+			for i := block; i < block+uint(amount); i++ {
+				r.pass[i-start] = pass
+			}
+
+			if pass > PASS_SPLIT {
+				cylinder, head, sector := client.Geometry().LBAToCHS(block)
+				print_log_message(fmt.Sprintf("%s block %d (%d/%d/%d) on pass %d", FmtCol("Recovered", ColorGreenHI), block, cylinder, head, sector, pass))
+			}
+		}
+
+		if status == STATUS_BAD {
+			if err := bad.failed(out, int64((block-base)*SECTOR_SIZE), block, amount, err, r.attempts[block-start]); err != nil {
+				return err
+			}
+		}
+
+		rmap.set(block, uint(amount), status)
+
+		return rmap.save()
+	}
+
+	// Fast pass
+	var todo []uint
+	for i := start; i <= end; i++ {
+		if rmap.status[i] != STATUS_FINISHED {
+			todo = append(todo, i)
+		}
+	}
+
+	print_log_message(fmt.Sprintf("Pass %d (%s): %d blocks", PASS_FAST, pass_name(PASS_FAST), len(todo)))
+	update_progress_bar(0, uint(len(todo)))
+
+	for i := 0; i < len(todo); {
+
+		// Batch of consecutive blocks
+		amount := 1
+		for amount < int(proto.READ_BLOCKS_MAX_AMOUNT) && i+amount < len(todo) && todo[i+amount] == todo[i]+uint(amount) {
+			amount++
+		}
+
+		if err := read(todo[i], byte(amount), 1, PASS_FAST); err != nil {
+			return r, err
+		}
+
+		i += amount
+		update_progress_bar(uint(i), uint(len(todo)))
+	}
+
+	for pass := PASS_SPLIT; uint(pass) <= passes; pass++ {
+
+		todo = r.bad_blocks(rmap)
+
+		if len(todo) == 0 {
+			break
+		}
+
+		print_log_message(fmt.Sprintf("Pass %d (%s): %d blocks", pass, pass_name(pass), len(todo)))
+		update_progress_bar(0, uint(len(todo)))
+
+		for i := range todo {
+
+			block := todo[i]
+			if pass_backwards(pass) {
+				block = todo[len(todo)-1-i]
+			}
+
+			// Seek to track 0 and back, the head may settle better
+			if pass > PASS_SPLIT {
+				if err := client.Initialize(ctx); err != nil && ctx.Err() != nil {
+					return r, ctx.Err()
+				}
+			}
+
+			if err := read(block, 1, retries.value+1, pass); err != nil {
+				return r, err
+			}
+
+			update_progress_bar(uint(i+1), uint(len(todo)))
+		}
+	}
+
+	return r, nil
+}
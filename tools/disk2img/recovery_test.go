@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+func TestRecoverBlocks(t *testing.T) {
+	image := emulatortest.RandomImage(proto.FORMAT_1440K)
+	profile := &emulator.Profile{
+		Sectors: []emulator.SectorFault{
+			sector_error(40, emulator.CRC, 0),
+			sector_error(50, emulator.CRC, 2),
+			sector_error(60, emulator.SECTOR_NOT_FOUND, 1),
+		},
+	}
+	client := emulatortest.StartClient(t, image, proto.FORMAT_1440K, profile)
+
+	rmap := new_map("", client.Geometry().Blocks())
+	bad := new_bad_sector_log(FILL_ZERO, client.Geometry())
+	blocks := make(memory_image, 72*SECTOR_SIZE)
+
+	r, err := recover_blocks(context.Background(), client, blocks, rmap, bad, nil, 0, 71, OptionalUint{value: 0}, DEFAULT_PASSES)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Batches 39-41, 48-50 and 60-62 fail on the fast pass
+	for _, c := range []struct {
+		pass   byte
+		blocks uint
+	}{{PASS_FAST, 63}, {PASS_SPLIT, 7}, {3, 1}, {4, 0}} {
+		if r.count(c.pass) != c.blocks {
+			t.Errorf("pass %d read %d blocks, want %d", c.pass, r.count(c.pass), c.blocks)
+		}
+	}
+
+	for block, pass := range map[uint]byte{0: PASS_FAST, 40: 0, 41: PASS_SPLIT, 50: 3, 60: PASS_SPLIT} {
+		if r.pass_of(block) != pass {
+			t.Errorf("block %d read on pass %d, want %d", block, r.pass_of(block), pass)
+		}
+	}
+
+	// Tried on every pass
+	if r.attempts[40] != 4 {
+		t.Errorf("block 40 attempts = %d, want 4", r.attempts[40])
+	}
+
+	if list := bad.list(); len(list) != 1 || list[0] != (BadSector{LBA: 40, Cylinder: 1, Head: 0, Sector: 5, Error: proto.ERROR_KIND_READ, Attempts: 4}) {
+		t.Errorf("bad sectors = %+v", list)
+	}
+
+	if rmap.count(0, 71, STATUS_BAD) != 1 {
+		t.Errorf("%d bad blocks, want 1", rmap.count(0, 71, STATUS_BAD))
+	}
+
+	want := bytes.Clone(image[:72*SECTOR_SIZE])
+	clear(want[40*SECTOR_SIZE : 41*SECTOR_SIZE])
+
+	if !bytes.Equal(blocks, want) {
+		t.Error("image differs from disk")
+	}
+}
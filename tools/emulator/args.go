@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"floppy_arduino/proto"
+)
+
+// Arguments
+const ARG_FAULTS string = "--faults"
+const ARG_FAULTS_SHORT string = "-f"
+const ARG_FORMAT string = "--format"
+const ARG_VERBOSE string = "--verbose"
+const ARG_VERBOSE_SHORT string = "-v"
+const ARG_HELP string = "--help"
+const ARG_HELP_SHORT string = "-h"
+
+// Messages
+const MSG_HELP string = "Usage: emulator [OPTIONS] IMAGE_FILE\nOptions: \n \t-f --faults: Fault injection profile file\n \t--format: Disk format (360K, 720K, 1.2M, 1.44M, 2.88M), default 1.44M\n \t-v --verbose: Log every command\n \t-h --help: Display this message"
+const MSG_IMAGE_FILE_MISSING string = "emulator: missing image file"
+const MSG_OPT_VALUE_MISSING string = "emulator: missing option value"
+const MSG_OPT_VALUE_INVALID string = "emulator: invalid option value"
+const MSG_BAD_OPTION string = "emulator: bad option"
+const MSG_TRY_HELP string = "Try 'emulator --help' for more information"
+
+// Deafaults
+var DEFAULT_FORMAT = proto.FORMAT_1440K
+
+type OptionalString struct {
+	value     string
+	has_value bool
+}
+
+type OptionalGeometry struct {
+	value     proto.Geometry
+	has_value bool
+}
+
+type Config struct {
+	faults     OptionalString
+	format     OptionalGeometry
+	verbose    bool
+	image_file OptionalString
+}
+
+type ConfigResult byte
+
+const (
+	ConfigOK          = 0
+	ConfigERR         = 1
+	ConfigExitCleanly = 2
+)
+
+func parse_args() (Config, ConfigResult) {
+
+	var conf Config
+
+	// Remove this program name form args
+	args := os.Args[1:]
+
+	for i := 0; i < len(args); i++ {
+
+		if args[i] == ARG_HELP || args[i] == ARG_HELP_SHORT {
+			// --help or -h
+			fmt.Println(MSG_HELP)
+			return conf, ConfigExitCleanly
+
+		} else if args[i] == ARG_FAULTS || args[i] == ARG_FAULTS_SHORT {
+			// --faults or -f
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+				conf.faults.value = args[i]
+				conf.faults.has_value = true
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+
+		} else if args[i] == ARG_FORMAT {
+			// --format
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+
+				value, err := proto.ParseFormat(args[i])
+
+				if err == nil {
+					conf.format.value = value
+					conf.format.has_value = true
+				} else {
+					fmt.Println(MSG_OPT_VALUE_INVALID)
+					fmt.Println(MSG_TRY_HELP)
+					return conf, ConfigERR
+				}
+
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+
+		} else if args[i] == ARG_VERBOSE || args[i] == ARG_VERBOSE_SHORT {
+			// --verbose or -v
+
+			conf.verbose = true
+		} else {
+			conf.image_file.value = args[i]
+			conf.image_file.has_value = true
+		}
+	}
+
+	// Handle defaults
+	if !conf.format.has_value {
+		conf.format.value = DEFAULT_FORMAT
+		conf.format.has_value = true
+	}
+
+	// Check required parameters
+	if !conf.image_file.has_value {
+		fmt.Println(MSG_IMAGE_FILE_MISSING)
+		fmt.Println(MSG_TRY_HELP)
+		return conf, ConfigERR
+	}
+
+	return conf, ConfigOK
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"floppy_arduino/proto/emulator"
+)
+
+func main() {
+
+	// Parse arguments
+	conf, conf_res := parse_args()
+
+	// Check result of configuration
+	switch conf_res {
+	case ConfigERR:
+		os.Exit(1)
+	case ConfigExitCleanly:
+		os.Exit(0)
+	}
+
+	// Load disk image
+	image, err := os.ReadFile(conf.image_file.value)
+
+	if err != nil {
+		PrtCol("Error: ", ColorRedHI)
+		fmt.Printf("unable to read %s: %s\n", conf.image_file.value, err)
+		os.Exit(1)
+	}
+
+	floppy, err := emulator.NewFloppyFormat(image, conf.format.value)
+
+	if err != nil {
+		PrtCol("Error: ", ColorRedHI)
+		fmt.Printf("invalid image %s: %s\n", conf.image_file.value, err)
+		os.Exit(1)
+	}
+
+	// Load fault injection profile
+	if conf.faults.has_value {
+		profile, err := emulator.LoadProfile(conf.faults.value)
+
+		if err == nil {
+			err = floppy.SetProfile(profile)
+		}
+
+		if err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("invalid fault profile %s: %s\n", conf.faults.value, err)
+			os.Exit(1)
+		}
+	}
+
+	emu := emulator.New(floppy)
+
+	if conf.verbose {
+		emu.Logger = log.New(os.Stdout, "", log.LstdFlags)
+	}
+
+	// Open pseudo-terminal
+	name, err := emu.Start()
+
+	if err != nil {
+		PrtCol("Error: ", ColorRedHI)
+		fmt.Printf("unable to open pseudo-terminal: %s\n", err)
+		os.Exit(2)
+	}
+
+	PrtCol("Listening ", ColorGreenHI)
+	fmt.Printf("on port %s\n", name)
+
+	// Wait for CTRL-C
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	<-c
+
+	fmt.Println("Exiting...")
+	emu.Close()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"floppy_arduino/proto"
+)
+
+// Arguments
+const ARG_DEVICE string = "--device"
+const ARG_DEVICE_SHORT string = "-d"
+const ARG_IMAGE string = "--image"
+const ARG_IMAGE_SHORT string = "-i"
+const ARG_RETRIES string = "--retries"
+const ARG_RETRIES_SHORT string = "-r"
+const ARG_FORMAT string = "--format"
+const ARG_FORMAT_SHORT string = "-f"
+const ARG_HELP string = "--help"
+const ARG_HELP_SHORT string = "-h"
+
+// Commands
+const CMD_LS string = "ls"
+const CMD_TREE string = "tree"
+const CMD_CAT string = "cat"
+const CMD_GET string = "get"
+
+// Messages
+const MSG_HELP string = "Usage: fatfs [OPTIONS] COMMAND [PATH...]\nReads files of a FAT12 or FAT16 disk in the drive, reading only the sectors needed\nCommands: \n \tls [DIR]: List a directory, default the root directory\n \ttree [DIR]: List a directory and all the directories below it\n \tcat FILE: Print a file to stdout\n \tget PATH [DEST]: Copy a file, or a directory and all it holds, to DEST, default its name in the current directory\nOptions: \n \t-d --device: Serial port of Arduino\n \t-i --image: Read a disk image file instead of the drive\n \t-r --retires: Number of read retries\n \t-f --format: Disk format (360K, 720K, 1.2M, 1.44M, 2.88M), default auto: detect from the disk\n \t-h --help: Display this message"
+const MSG_COMMAND_MISSING string = "fatfs: missing command"
+const MSG_BAD_COMMAND string = "fatfs: unknown command"
+const MSG_BAD_PATHS string = "fatfs: wrong number of paths for the command"
+const MSG_IMAGE_DEVICE string = "fatfs: --image can't be used with --device"
+const MSG_OPT_VALUE_MISSING string = "fatfs: missing option value"
+const MSG_OPT_VALUE_INVALID string = "fatfs: invalid option value"
+const MSG_BAD_OPTION string = "fatfs: bad option"
+const MSG_TRY_HELP string = "Try 'fatfs --help' for more information"
+
+// Deafaults
+const DEFAULT_MAX_RETRIES uint = 5
+
+const FORMAT_AUTO string = "auto"
+
+type OptionalString struct {
+	value     string
+	has_value bool
+}
+
+type OptionalUint struct {
+	value     uint
+	has_value bool
+}
+
+type OptionalGeometry struct {
+	value     proto.Geometry
+	has_value bool
+}
+
+type Config struct {
+	device      OptionalString
+	image       OptionalString
+	max_retries OptionalUint
+	format      OptionalGeometry
+
+	command OptionalString
+	paths   []string
+}
+
+type ConfigResult byte
+
+const (
+	ConfigOK          = 0
+	ConfigERR         = 1
+	ConfigExitCleanly = 2
+)
+
+// Paths each command takes, at least and at most
+var COMMAND_PATHS = map[string][2]int{
+	CMD_LS:   {0, 1},
+	CMD_TREE: {0, 1},
+	CMD_CAT:  {1, 1},
+	CMD_GET:  {1, 2},
+}
+
+func parse_args() (Config, ConfigResult) {
+
+	var conf Config
+
+	// Remove this program name form args
+	args := os.Args[1:]
+
+	for i := 0; i < len(args); i++ {
+
+		if args[i] == ARG_HELP || args[i] == ARG_HELP_SHORT {
+			// --help or -h
+			fmt.Println(MSG_HELP)
+			return conf, ConfigExitCleanly
+
+		} else if args[i] == ARG_DEVICE || args[i] == ARG_DEVICE_SHORT {
+			// --device or -d
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+				conf.device.value = args[i]
+				conf.device.has_value = true
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+
+		} else if args[i] == ARG_IMAGE || args[i] == ARG_IMAGE_SHORT {
+			// --image or -i
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+				conf.image.value = args[i]
+				conf.image.has_value = true
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+
+		} else if args[i] == ARG_FORMAT || args[i] == ARG_FORMAT_SHORT {
+			// --format or -f
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+
+				value, err := proto.ParseFormat(args[i])
+
+				if args[i] == FORMAT_AUTO {
+					conf.format.has_value = false
+				} else if err == nil {
+					conf.format.value = value
+					conf.format.has_value = true
+				} else {
+					fmt.Println(MSG_OPT_VALUE_INVALID)
+					fmt.Println(MSG_TRY_HELP)
+					return conf, ConfigERR
+				}
+
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_RETRIES || args[i] == ARG_RETRIES_SHORT {
+			// --retries or -r
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+
+				value, err := strconv.ParseUint(args[i], 10, 32)
+
+				if err == nil {
+					conf.max_retries.value = uint(value)
+					conf.max_retries.has_value = true
+				} else {
+					fmt.Println(MSG_OPT_VALUE_INVALID)
+					fmt.Println(MSG_TRY_HELP)
+					return conf, ConfigERR
+				}
+
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if strings.HasPrefix(args[i], "-") {
+			fmt.Println(MSG_BAD_OPTION)
+			fmt.Println(MSG_TRY_HELP)
+			return conf, ConfigERR
+
+		} else if !conf.command.has_value {
+			// Command
+			if _, ok := COMMAND_PATHS[args[i]]; !ok {
+				fmt.Println(MSG_BAD_COMMAND)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+
+			conf.command.value = args[i]
+			conf.command.has_value = true
+
+		} else {
+			// Path for the command
+			conf.paths = append(conf.paths, args[i])
+		}
+	}
+
+	if !conf.command.has_value {
+		fmt.Println(MSG_COMMAND_MISSING)
+		fmt.Println(MSG_TRY_HELP)
+		return conf, ConfigERR
+	}
+
+	if paths := COMMAND_PATHS[conf.command.value]; len(conf.paths) < paths[0] || len(conf.paths) > paths[1] {
+		fmt.Println(MSG_BAD_PATHS)
+		fmt.Println(MSG_TRY_HELP)
+		return conf, ConfigERR
+	}
+
+	if conf.image.has_value && conf.device.has_value {
+		fmt.Println(MSG_IMAGE_DEVICE)
+		fmt.Println(MSG_TRY_HELP)
+		return conf, ConfigERR
+	}
+
+	// Handle defaults
+	if !conf.max_retries.has_value {
+		conf.max_retries.value = DEFAULT_MAX_RETRIES
+		conf.max_retries.has_value = true
+	}
+
+	return conf, ConfigOK
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"floppy_arduino/fat"
+)
+
+// Deepest directory tree and get go, in case directories loop
+const MAX_DEPTH int = 32
+
+// Date of an entry, blank if not set
+func format_modified(e fat.Entry) string {
+	if e.Modified.IsZero() {
+		return strings.Repeat(" ", 16)
+	}
+	return e.Modified.Format("2006-01-02 15:04")
+}
+
+// List a directory, one entry per line, like DOS dir
+func do_ls(ctx context.Context, fs *fat.FS, out io.Writer, dir string) error {
+
+	entry, err := fs.Stat(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	// A file lists itself
+	entries := []fat.Entry{entry}
+	if entry.IsDir() {
+		if entries, err = fs.List(ctx, entry); err != nil {
+			return err
+		}
+	}
+
+	files, size := 0, uint64(0)
+
+	for _, e := range entries {
+		kind := fmt.Sprint(e.Size)
+		if e.IsDir() {
+			kind = "<DIR>"
+		} else {
+			files++
+			size += uint64(e.Size)
+		}
+
+		name := e.Name
+		if e.Name != e.ShortName {
+			name += fmt.Sprintf("  (%s)", e.ShortName)
+		}
+
+		fmt.Fprintf(out, "%s  %10s  %s\n", format_modified(e), kind, name)
+	}
+
+	fmt.Fprintf(out, "%d files, %d bytes, %d directories\n", files, size, len(entries)-files)
+
+	return nil
+}
+
+// Print the directories and files below dir, prefix before each line
+func print_tree(ctx context.Context, fs *fat.FS, out io.Writer, dir fat.Entry, prefix string, depth int, dirs *int, files *int) error {
+
+	if depth > MAX_DEPTH {
+		return fmt.Errorf("%s: directories deeper than %d", dir.Name, MAX_DEPTH)
+	}
+
+	entries, err := fs.List(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	for i, e := range entries {
+		branch, indent := "├── ", "│   "
+		if i == len(entries)-1 {
+			branch, indent = "└── ", "    "
+		}
+
+		if !e.IsDir() {
+			*files++
+			fmt.Fprintf(out, "%s%s%s\n", prefix, branch, e.Name)
+			continue
+		}
+
+		*dirs++
+		fmt.Fprintf(out, "%s%s%s/\n", prefix, branch, e.Name)
+
+		if err := print_tree(ctx, fs, out, e, prefix+indent, depth+1, dirs, files); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func do_tree(ctx context.Context, fs *fat.FS, out io.Writer, dir string) error {
+
+	entry, err := fs.Stat(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, path.Clean("/"+dir))
+
+	dirs, files := 0, 0
+	if err := print_tree(ctx, fs, out, entry, "", 0, &dirs, &files); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "\n%d directories, %d files\n", dirs, files)
+
+	return nil
+}
+
+func do_cat(ctx context.Context, fs *fat.FS, out io.Writer, file string) error {
+
+	entry, err := fs.Stat(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	return fs.Copy(ctx, out, entry)
+}
+
+// Whether a name read from the disk can be used as a file name here
+func safe_name(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// Copy a file from the disk to dest
+func get_file(ctx context.Context, fs *fat.FS, e fat.Entry, dest string) error {
+
+	file, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.Copy(ctx, file, e); err != nil {
+		file.Close()
+		os.Remove(dest)
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if !e.Modified.IsZero() {
+		os.Chtimes(dest, e.Modified, e.Modified)
+	}
+
+	fmt.Printf("%s (%d bytes)\n", dest, e.Size)
+
+	return nil
+}
+
+// Copy a directory and all it holds from the disk to dest
+func get_dir(ctx context.Context, fs *fat.FS, dir fat.Entry, dest string, depth int) error {
+
+	if depth > MAX_DEPTH {
+		return fmt.Errorf("%s: directories deeper than %d", dir.Name, MAX_DEPTH)
+	}
+
+	entries, err := fs.List(ctx, dir)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if !safe_name(e.Name) {
+			PrtCol("Warning: ", ColorYellowHI)
+			fmt.Printf("skipping %q in %s\n", e.Name, dest)
+			continue
+		}
+
+		target := filepath.Join(dest, e.Name)
+
+		if e.IsDir() {
+			err = get_dir(ctx, fs, e, target, depth+1)
+		} else {
+			err = get_file(ctx, fs, e, target)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Copy a file or a directory from the disk. dest defaults to its name in
+// the current directory, and an existing directory gets it inside.
+func do_get(ctx context.Context, fs *fat.FS, name string, dest string) error {
+
+	entry, err := fs.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// The root directory has no name
+	base := entry.Name
+	if base == "/" {
+		base = "."
+	}
+
+	if dest == "" {
+		if !safe_name(base) && base != "." {
+			return fmt.Errorf("%q can't be used as a file name, give a destination", base)
+		}
+		dest = base
+	} else if info, err := os.Stat(dest); err == nil && info.IsDir() && base != "." {
+		dest = filepath.Join(dest, base)
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if entry.IsDir() {
+		return get_dir(ctx, fs, entry, dest, 0)
+	}
+
+	return get_file(ctx, fs, entry, dest)
+}
+
+// Run the command of conf, printing to out
+func run_command(ctx context.Context, fs *fat.FS, out io.Writer, conf Config) error {
+
+	arg := func(i int) string {
+		if i < len(conf.paths) {
+			return conf.paths[i]
+		}
+		return ""
+	}
+
+	switch conf.command.value {
+	case CMD_LS:
+		return do_ls(ctx, fs, out, arg(0))
+	case CMD_TREE:
+		return do_tree(ctx, fs, out, arg(0))
+	case CMD_CAT:
+		return do_cat(ctx, fs, out, arg(0))
+	case CMD_GET:
+		return do_get(ctx, fs, arg(0), arg(1))
+	}
+
+	return fmt.Errorf("unknown command %s", conf.command.value)
+}
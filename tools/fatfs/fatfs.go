@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"floppy_arduino/fat"
+	"floppy_arduino/proto"
+)
+
+// Connect to the drive and find the format of the disk
+func open_drive(ctx context.Context, conf Config) (*proto.Client, error) {
+
+	var err error
+	var client *proto.Client
+
+	// Find serial port
+	if !conf.device.has_value {
+		fmt.Println("Trying to find Arduino...")
+		client, err = proto.Find(ctx, proto.RESET_DELAY)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find Arduino")
+		}
+	} else {
+		fmt.Println("Connecting to Arduino...")
+		client, err = proto.Open(ctx, conf.device.value, proto.RESET_DELAY)
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to Arduino on port %s: %s", conf.device.value, err)
+		}
+	}
+
+	PrtCol("Connected ", ColorGreenHI)
+	fmt.Printf("on port %s\n", client.Name())
+
+	// Initialize drive
+	if err := client.Initialize(ctx); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("drive initalization failed!")
+	}
+
+	// Disk format, detected unless given
+	if conf.format.has_value {
+		client.SetGeometry(conf.format.value)
+	} else {
+		geometry, _, err := client.DetectFormat(ctx)
+
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("unable to detect disk format: %s, try --format", err)
+		}
+
+		client.SetGeometry(geometry)
+		fmt.Printf("Detected %s disk\n", geometry)
+	}
+
+	return client, nil
+}
+
+func main() {
+
+	// Parse arguments
+	conf, conf_res := parse_args()
+
+	// Check result of configuration
+	switch conf_res {
+	case ConfigERR:
+		os.Exit(1)
+	case ConfigExitCleanly:
+		os.Exit(0)
+	}
+
+	// Listings and files go to stdout, messages to stderr
+	out := os.Stdout
+	os.Stdout = os.Stderr
+
+	ctx := context.Background()
+
+	var reader fat.SectorReader
+	var drive *drive_reader
+	var image *os.File
+
+	if conf.image.has_value {
+		var err error
+
+		image, err = os.Open(conf.image.value)
+		if err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("unable to open image %s: %s\n", conf.image.value, err)
+			os.Exit(1)
+		}
+		reader = fat.NewImageReader(image)
+	} else {
+		client, err := open_drive(ctx, conf)
+		if err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Println(err)
+			os.Exit(2)
+		}
+
+		// CTRL-C handler
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt)
+		go func() {
+			for sig := range c {
+				if sig != nil {
+					client.Close()
+					fmt.Println("Exiting...")
+					os.Exit(0)
+				}
+			}
+		}()
+
+		drive = &drive_reader{client: client, retries: conf.max_retries.value}
+		reader = drive
+	}
+
+	fs, err := fat.Open(ctx, reader)
+
+	if err == nil {
+		err = run_command(ctx, fs, out, conf)
+	}
+
+	if drive != nil {
+		fmt.Printf("%d sectors read\n", drive.sectors)
+		drive.client.Close()
+	} else {
+		image.Close()
+	}
+
+	if err != nil {
+		PrtCol("Error: ", ColorRedHI)
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
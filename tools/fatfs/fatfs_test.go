@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"floppy_arduino/fat"
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+const SECTOR_SIZE = fat.SECTOR_SIZE
+
+// 360K disk: 1 reserved sector, 2 FATs of 2 sectors, 7 sectors of root
+// directory, then clusters of 2 sectors from LBA 12
+const DATA_START uint = 12
+
+func cluster_offset(cluster int) uint {
+	return (DATA_START + uint(cluster-2)*2) * SECTOR_SIZE
+}
+
+func dir_entry(name string, attr byte, cluster uint16, size uint32) []byte {
+	raw := make([]byte, fat.DIR_ENTRY_SIZE)
+
+	copy(raw, name)
+	raw[11] = attr
+	binary.LittleEndian.PutUint16(raw[24:], 44<<9|5<<5|17) // 2024-05-17
+	binary.LittleEndian.PutUint16(raw[26:], cluster)
+	binary.LittleEndian.PutUint32(raw[28:], size)
+
+	return raw
+}
+
+// Test disk:
+//
+//	HELLO.TXT      cluster 2
+//	DATA/          cluster 3
+//	  BIG.BIN      clusters 4 and 5
+var HELLO_DATA = []byte("Hello from the floppy\n")
+var BIG_DATA = bytes.Repeat([]byte("0123456789abcdef"), 100)
+
+func test_image() []byte {
+	img := emulatortest.FormatImage(proto.FORMAT_360K, "", 0)
+
+	// Clusters 2 to 5: end, end, 5, end
+	for _, start := range []uint{1, 3} {
+		copy(img[start*SECTOR_SIZE+3:], []byte{0xFF, 0xFF, 0xFF, 0x05, 0xF0, 0xFF})
+	}
+
+	root := append(dir_entry("HELLO   TXT", fat.ATTR_ARCHIVE, 2, uint32(len(HELLO_DATA))), dir_entry("DATA       ", fat.ATTR_DIRECTORY, 3, 0)...)
+	copy(img[5*SECTOR_SIZE:], root)
+
+	copy(img[cluster_offset(2):], HELLO_DATA)
+	copy(img[cluster_offset(3):], dir_entry("BIG     BIN", fat.ATTR_ARCHIVE, 4, uint32(len(BIG_DATA))))
+	copy(img[cluster_offset(4):], BIG_DATA[:1024])
+	copy(img[cluster_offset(5):], BIG_DATA[1024:])
+
+	return img
+}
+
+func open_image(t *testing.T) *fat.FS {
+	t.Helper()
+
+	fs, err := fat.Open(context.Background(), fat.NewImageReader(bytes.NewReader(test_image())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fs
+}
+
+func run(t *testing.T, fs *fat.FS, command string, paths ...string) string {
+	t.Helper()
+
+	var out bytes.Buffer
+	conf := Config{command: OptionalString{command, true}, paths: paths}
+
+	if err := run_command(context.Background(), fs, &out, conf); err != nil {
+		t.Fatalf("%s %v: %s", command, paths, err)
+	}
+
+	return out.String()
+}
+
+func TestLs(t *testing.T) {
+	fs := open_image(t)
+
+	want := "2024-05-17 00:00          22  HELLO.TXT\n" +
+		"2024-05-17 00:00       <DIR>  DATA\n" +
+		"1 files, 22 bytes, 1 directories\n"
+
+	if out := run(t, fs, CMD_LS); out != want {
+		t.Errorf("ls:\n%s\nwant:\n%s", out, want)
+	}
+
+	if out := run(t, fs, CMD_LS, "data"); !strings.Contains(out, "1600  BIG.BIN") {
+		t.Errorf("ls data:\n%s", out)
+	}
+}
+
+func TestTree(t *testing.T) {
+	want := "/\n" +
+		"├── HELLO.TXT\n" +
+		"└── DATA/\n" +
+		"    └── BIG.BIN\n" +
+		"\n1 directories, 2 files\n"
+
+	if out := run(t, open_image(t), CMD_TREE); out != want {
+		t.Errorf("tree:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestCat(t *testing.T) {
+	if out := run(t, open_image(t), CMD_CAT, "/DATA/BIG.BIN"); out != string(BIG_DATA) {
+		t.Errorf("cat: %d bytes", len(out))
+	}
+}
+
+func TestGet(t *testing.T) {
+	fs := open_image(t)
+	dir := t.TempDir()
+
+	// Into a directory, and to a file name
+	run(t, fs, CMD_GET, "HELLO.TXT", dir)
+	run(t, fs, CMD_GET, "DATA/BIG.BIN", filepath.Join(dir, "copy.bin"))
+	run(t, fs, CMD_GET, "/", filepath.Join(dir, "all"))
+
+	for name, want := range map[string][]byte{
+		"HELLO.TXT":        HELLO_DATA,
+		"copy.bin":         BIG_DATA,
+		"all/HELLO.TXT":    HELLO_DATA,
+		"all/DATA/BIG.BIN": BIG_DATA,
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(data, want) {
+			t.Errorf("%s: %d bytes, %v", name, len(data), err)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "HELLO.TXT"))
+	if err != nil || info.ModTime().Year() != 2024 {
+		t.Errorf("modified %v, %v", info, err)
+	}
+}
+
+func TestDriveReader(t *testing.T) {
+	client := emulatortest.StartClient(t, test_image(), proto.FORMAT_360K, nil)
+	ctx := context.Background()
+
+	drive := &drive_reader{client: client, retries: 1}
+
+	fs, err := fat.Open(ctx, drive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out := run(t, fs, CMD_CAT, "DATA/BIG.BIN"); out != string(BIG_DATA) {
+		t.Errorf("cat: %d bytes", len(out))
+	}
+
+	// Boot sector, root directory, FAT, the first sector of DATA, which
+	// ends the directory, and the 4 sectors of BIG.BIN
+	if drive.sectors != 8 {
+		t.Errorf("%d sectors read, want 8", drive.sectors)
+	}
+
+	if _, err := drive.ReadSector(ctx, 720); err == nil {
+		t.Errorf("sector past the end read")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"floppy_arduino/proto"
+)
+
+// Sector reader of the disk in the drive
+type drive_reader struct {
+	client  *proto.Client
+	retries uint
+
+	sectors uint // Sectors read
+}
+
+func (d *drive_reader) ReadSector(ctx context.Context, lba uint) ([]byte, error) {
+
+	geometry := d.client.Geometry()
+
+	if lba >= geometry.Blocks() {
+		return nil, fmt.Errorf("%w: LBA %d", proto.ErrOutOfRange, lba)
+	}
+
+	cylinder, head, sector := geometry.LBAToCHS(lba)
+
+	var data []byte
+	var err error
+
+	for tries := uint(0); tries <= d.retries; tries++ {
+		data, err = d.client.ReadSector(ctx, cylinder, head, sector)
+
+		if err == nil {
+			d.sectors++
+			return data, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, fmt.Errorf("%d/%d/%d: %w", cylinder, head, sector, err)
+}
@@ -3,7 +3,11 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+
+	"floppy_arduino/proto"
 )
 
 // Arguments
@@ -15,19 +19,40 @@ const ARG_END_TK string = "--end-track"
 const ARG_END_TK_SHORT string = "-e"
 const ARG_RETRIES string = "--retries"
 const ARG_RETRIES_SHORT string = "-r"
+const ARG_FORMAT string = "--format"
+const ARG_FORMAT_SHORT string = "-f"
+const ARG_AGAINST string = "--against"
+const ARG_AGAINST_SHORT string = "-a"
+const ARG_OUTPUT string = "--output"
+const ARG_OUTPUT_SHORT string = "-o"
+const ARG_HISTORY string = "--history"
+const ARG_NO_HISTORY string = "--no-history"
+const ARG_DISK_ID string = "--disk-id"
+const ARG_HEATMAP string = "--heatmap"
+const ARG_HEATMAP_OUT string = "--heatmap-out"
+const ARG_ANALYZE_ROTATION string = "--analyze-rotation"
+const ARG_DUMP string = "--dump"
+const ARG_DECODE string = "--decode"
+const ARG_TUI string = "--tui"
+const ARG_TUI_SHORT string = "-t"
 const ARG_HELP string = "--help"
 const ARG_HELP_SHORT string = "-h"
 
 // Messages
-const MSG_HELP string = "Usage: verify [OPTIONS]\nOptions: \n \t-d --device: Serial port of Arduino\n \t-s --start-track: Track to start verification from\n \t-e --end-track: Track to end verification on\n \t-r --retires: Number of read retries\n \t-h --help: Display this message"
+const MSG_HELP string = "Usage: verify [OPTIONS]\n       verify history [--history FILE] DISK\nOptions: \n \t-d --device: Serial port of Arduino\n \t-s --start-track: Track to start verification from\n \t-e --end-track: Track to end verification on\n \t-r --retires: Number of read retries\n \t-f --format: Disk format (360K, 720K, 1.2M, 1.44M, 2.88M), default auto: detect from the disk\n \t-a --against: Compare the disk with an image file, sectors that differ are marked X and listed\n \t-o --output: Print one record per sector and a summary to stdout (json, csv), the table goes to stderr. With csv the summary goes to stderr\n \t--history: History file, default verify_history.jsonl in the user config directory\n \t--no-history: Don't add this verification to the history\n \t--disk-id: Disk id for the history, default the volume serial of the boot sector\n \t--heatmap: Colour the table by how long reads took instead of showing retries, printed once all the tracks are read\n \t--heatmap-out: Draw the read times of the disk surface of each head to an image file (.png, .svg)\n \t--analyze-rotation: Instead of verifying, time reads on the start track to find the RPM, the physical order of the sectors and the fastest order to read them in\n \t--dump: Instead of verifying, print sectors in hex and ASCII: an LBA (19), a C/H/S address (0/1/2) or a range of either (19-32, 0/1/2-0/1/5)\n \t--decode: Decode the sectors dumped as a boot sector (boot), FAT entries (fat) or directory entries (dir)\n \t-t --tui: Full screen grid of the whole disk, filled as sectors are verified. Keys: arrows or hjkl select a sector, space pauses, r re-tests the sector, d shows it in hex, q quits\n \t-h --help: Display this message"
 const MSG_OPT_VALUE_MISSING string = "verify: missing option value"
 const MSG_OPT_VALUE_INVALID string = "verify: invalid option value"
 const MSG_BAD_OPTION string = "verify: bad option"
+const MSG_DISK_MISSING string = "verify: missing disk to show the history of"
+const MSG_TRACK_RANGE string = "verify: start track is after end track"
+const MSG_DECODE_DUMP string = "verify: --decode needs --dump"
 const MSG_TRY_HELP string = "Try 'verify --help' for more information"
 
 // Deafaults
 const DEFAULT_MAX_RETRIES uint = 0
 
+const FORMAT_AUTO string = "auto"
+
 type OptionalString struct {
 	value     string
 	has_value bool
@@ -43,11 +68,37 @@ type OptionalUint struct {
 	has_value bool
 }
 
+type OptionalRange struct {
+	value     SectorRange
+	has_value bool
+}
+
+type OptionalGeometry struct {
+	value     proto.Geometry
+	has_value bool
+}
+
 type Config struct {
 	device      OptionalString
 	start_track OptionalByte
 	end_track   OptionalByte
 	max_retries OptionalUint
+	format      OptionalGeometry
+	against     OptionalString
+	output      OptionalString
+	history     OptionalString
+	no_history  bool
+	disk_id     OptionalString
+	heatmap     bool
+	heatmap_out OptionalString
+
+	analyze_rotation bool
+	tui              bool
+	dump             OptionalRange
+	decode           OptionalString
+
+	// verify history DISK
+	history_disk OptionalString
 }
 
 type ConfigResult byte
@@ -65,6 +116,12 @@ func parse_args() (Config, ConfigResult) {
 	// Remove this program name form args
 	args := os.Args[1:]
 
+	// verify history DISK
+	history := len(args) > 0 && args[0] == CMD_HISTORY
+	if history {
+		args = args[1:]
+	}
+
 	for i := 0; i < len(args); i++ {
 
 		if args[i] == ARG_HELP || args[i] == ARG_HELP_SHORT {
@@ -130,6 +187,46 @@ func parse_args() (Config, ConfigResult) {
 					return conf, ConfigERR
 				}
 
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_AGAINST || args[i] == ARG_AGAINST_SHORT {
+			// --against or -a
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+				conf.against.value = args[i]
+				conf.against.has_value = true
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_FORMAT || args[i] == ARG_FORMAT_SHORT {
+			// --format or -f
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+
+				value, err := proto.ParseFormat(args[i])
+
+				if args[i] == FORMAT_AUTO {
+					conf.format.has_value = false
+				} else if err == nil {
+					conf.format.value = value
+					conf.format.has_value = true
+				} else {
+					fmt.Println(MSG_OPT_VALUE_INVALID)
+					fmt.Println(MSG_TRY_HELP)
+					return conf, ConfigERR
+				}
+
 			} else {
 				fmt.Println(MSG_OPT_VALUE_MISSING)
 				fmt.Println(MSG_TRY_HELP)
@@ -159,6 +256,147 @@ func parse_args() (Config, ConfigResult) {
 				fmt.Println(MSG_TRY_HELP)
 				return conf, ConfigERR
 			}
+		} else if args[i] == ARG_OUTPUT || args[i] == ARG_OUTPUT_SHORT {
+			// --output or -o
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+
+				if args[i] == OUTPUT_JSON || args[i] == OUTPUT_CSV {
+					conf.output.value = args[i]
+					conf.output.has_value = true
+				} else {
+					fmt.Println(MSG_OPT_VALUE_INVALID)
+					fmt.Println(MSG_TRY_HELP)
+					return conf, ConfigERR
+				}
+
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_HISTORY {
+			// --history
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+				conf.history.value = args[i]
+				conf.history.has_value = true
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_NO_HISTORY {
+			// --no-history
+			conf.no_history = true
+
+		} else if args[i] == ARG_DISK_ID {
+			// --disk-id
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) && args[i] != "" {
+				conf.disk_id.value = args[i]
+				conf.disk_id.has_value = true
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_TUI || args[i] == ARG_TUI_SHORT {
+			// --tui or -t
+			conf.tui = true
+
+		} else if args[i] == ARG_ANALYZE_ROTATION {
+			// --analyze-rotation
+			conf.analyze_rotation = true
+
+		} else if args[i] == ARG_DUMP {
+			// --dump
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+
+				value, err := parse_sector_range(args[i])
+
+				if err == nil {
+					conf.dump.value = value
+					conf.dump.has_value = true
+				} else {
+					fmt.Println(MSG_OPT_VALUE_INVALID)
+					fmt.Println(MSG_TRY_HELP)
+					return conf, ConfigERR
+				}
+
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_DECODE {
+			// --decode
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+
+				if args[i] == DECODE_BOOT || args[i] == DECODE_FAT || args[i] == DECODE_DIR {
+					conf.decode.value = args[i]
+					conf.decode.has_value = true
+				} else {
+					fmt.Println(MSG_OPT_VALUE_INVALID)
+					fmt.Println(MSG_TRY_HELP)
+					return conf, ConfigERR
+				}
+
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if args[i] == ARG_HEATMAP {
+			// --heatmap
+			conf.heatmap = true
+
+		} else if args[i] == ARG_HEATMAP_OUT {
+			// --heatmap-out
+
+			// Try to consume option
+			// Check if there is a value to consume
+			i++
+			if i < len(args) {
+
+				ext := strings.ToLower(filepath.Ext(args[i]))
+
+				if ext == ".png" || ext == ".svg" {
+					conf.heatmap_out.value = args[i]
+					conf.heatmap_out.has_value = true
+				} else {
+					fmt.Println(MSG_OPT_VALUE_INVALID)
+					fmt.Println(MSG_TRY_HELP)
+					return conf, ConfigERR
+				}
+
+			} else {
+				fmt.Println(MSG_OPT_VALUE_MISSING)
+				fmt.Println(MSG_TRY_HELP)
+				return conf, ConfigERR
+			}
+		} else if history && !conf.history_disk.has_value {
+			// DISK of verify history
+			conf.history_disk.value = args[i]
+			conf.history_disk.has_value = true
+
 		} else {
 			fmt.Println(MSG_BAD_OPTION)
 			fmt.Println(MSG_TRY_HELP)
@@ -166,7 +404,30 @@ func parse_args() (Config, ConfigResult) {
 		}
 	}
 
+	if history && !conf.history_disk.has_value {
+		fmt.Println(MSG_DISK_MISSING)
+		fmt.Println(MSG_TRY_HELP)
+		return conf, ConfigERR
+	}
+
+	if conf.start_track.has_value && conf.end_track.has_value && conf.start_track.value > conf.end_track.value {
+		fmt.Println(MSG_TRACK_RANGE)
+		fmt.Println(MSG_TRY_HELP)
+		return conf, ConfigERR
+	}
+
+	if conf.decode.has_value && !conf.dump.has_value {
+		fmt.Println(MSG_DECODE_DUMP)
+		fmt.Println(MSG_TRY_HELP)
+		return conf, ConfigERR
+	}
+
 	// Handle defaults
+	if !conf.history.has_value {
+		conf.history.value = default_history_path()
+		conf.history.has_value = true
+	}
+
 	if !conf.max_retries.has_value {
 		conf.max_retries.value = DEFAULT_MAX_RETRIES
 		conf.max_retries.has_value = true
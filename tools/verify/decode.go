@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"floppy_arduino/fat"
+)
+
+// Ways to decode dumped sectors
+const DECODE_BOOT string = "boot"
+const DECODE_FAT string = "fat"
+const DECODE_DIR string = "dir"
+
+// FAT entries per line when decoding a FAT
+const FAT_PER_LINE int = 8
+
+// Fields of a boot sector, one per line. The layout of the file system
+// only follows if the boot sector passed validation, otherwise the reason
+// it failed does.
+func describe_boot_sector(b fat.BootSector, invalid error) []string {
+
+	lines := []string{
+		fmt.Sprintf("OEM name:             %q", b.OEM),
+		fmt.Sprintf("Bytes per sector:     %d", b.BytesPerSector),
+		fmt.Sprintf("Sectors per cluster:  %d", b.SectorsPerCluster),
+		fmt.Sprintf("Reserved sectors:     %d", b.ReservedSectors),
+		fmt.Sprintf("FATs:                 %d", b.FATs),
+		fmt.Sprintf("Root entries:         %d", b.RootEntries),
+		fmt.Sprintf("Total sectors:        %d", b.TotalSectors),
+		fmt.Sprintf("Media descriptor:     0x%02X", b.Media),
+		fmt.Sprintf("Sectors per FAT:      %d", b.SectorsPerFAT),
+		fmt.Sprintf("Sectors per track:    %d", b.SectorsPerTrack),
+		fmt.Sprintf("Heads:                %d", b.Heads),
+		fmt.Sprintf("Hidden sectors:       %d", b.HiddenSectors),
+	}
+
+	if b.ExtendedSignature != 0 {
+		lines = append(lines,
+			fmt.Sprintf("Drive number:         0x%02X", b.Drive),
+			fmt.Sprintf("Extended signature:   0x%02X", b.ExtendedSignature),
+			fmt.Sprintf("Volume serial:        %04X-%04X", b.Serial>>16, b.Serial&0xFFFF))
+
+		if b.ExtendedSignature == 0x29 {
+			lines = append(lines,
+				fmt.Sprintf("Volume label:         %q", b.Label),
+				fmt.Sprintf("File system type:     %q", b.FSType))
+		}
+	}
+
+	signature := fmt.Sprintf("0x%04X", b.Signature)
+	if b.Signature != 0xAA55 {
+		signature += " (not bootable)"
+	}
+
+	lines = append(lines, fmt.Sprintf("Boot signature:       %s", signature), "")
+
+	if invalid != nil {
+		return append(lines, fmt.Sprintf("Invalid: %v", invalid))
+	}
+
+	lines = append(lines,
+		fmt.Sprintf("FAT%d, %d clusters of %d bytes", b.FATBits(), b.Clusters(), b.ClusterSize()),
+		fmt.Sprintf("FAT at LBA %d, root directory at LBA %d (%d sectors), data at LBA %d", b.FATStart(), b.RootStart(), b.RootSectors(), b.DataStart()))
+
+	return lines
+}
+
+// Meaning of a FAT entry
+func fat_entry_label(b fat.BootSector, cluster uint32, value uint32) string {
+
+	// Values just below the bad mark are reserved
+	switch {
+	case cluster < 2:
+		return "rsvd"
+	case value == 0:
+		return "free"
+	case value == b.BadMark():
+		return "bad"
+	case b.EndOfChain(value):
+		return "end"
+	case value == 1 || value >= b.BadMark()-7:
+		return "rsvd"
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// FAT entries in data, the sectors of a FAT from LBA first. Entries that
+// straddle the end of data are left out.
+func describe_fat(b fat.BootSector, first uint, data []byte) ([]string, error) {
+
+	size := uint(b.SectorsPerFAT)
+
+	if first < b.FATStart() || first >= b.RootStart() {
+		return nil, fmt.Errorf("LBA %d is not in a FAT, the FATs are LBA %d-%d", first, b.FATStart(), b.RootStart()-1)
+	}
+
+	// Bytes before data in its copy of the FAT
+	offset := ((first - b.FATStart()) % size) * SECTOR_SIZE
+	end := offset + uint(len(data))
+
+	bits := b.FATBits()
+	var cluster uint32
+
+	if bits == 12 {
+		// Two entries in three bytes, the first one starting in data
+		cluster = uint32((offset*2 + 2) / 3)
+	} else {
+		cluster = uint32(offset / 2)
+	}
+
+	// Past the last cluster entries are unused
+	last := b.Clusters() + 1
+
+	lines := []string{fmt.Sprintf("FAT%d entries from cluster %d", bits, cluster)}
+	var line strings.Builder
+
+	for ; cluster <= last; cluster++ {
+		start := b.FATOffset(cluster)
+		if start+2 > end {
+			break
+		}
+
+		value := b.FATEntry(cluster, data[start-offset:])
+
+		if line.Len() == 0 {
+			fmt.Fprintf(&line, "%5d:", cluster)
+		}
+		fmt.Fprintf(&line, " %5s", fat_entry_label(b, cluster, value))
+
+		if (cluster+1)%uint32(FAT_PER_LINE) == 0 {
+			lines = append(lines, line.String())
+			line.Reset()
+		}
+	}
+
+	if line.Len() > 0 {
+		lines = append(lines, line.String())
+	}
+
+	return lines, nil
+}
+
+// Attribute letters of a directory entry
+func describe_attributes(attr byte) string {
+
+	letters := []byte("ADVSHR")
+	flags := []byte{fat.ATTR_ARCHIVE, fat.ATTR_DIRECTORY, fat.ATTR_VOLUME, fat.ATTR_SYSTEM, fat.ATTR_HIDDEN, fat.ATTR_READ_ONLY}
+
+	for i, flag := range flags {
+		if attr&flag == 0 {
+			letters[i] = '-'
+		}
+	}
+
+	return string(letters)
+}
+
+// Date and time of a directory entry, blank if not set
+func describe_timestamp(t time.Time) string {
+
+	if t.IsZero() {
+		return "                "
+	}
+
+	return t.Format("2006-01-02 15:04")
+}
+
+// Directory entries in data, until the end marker
+func describe_directory(data []byte) []string {
+
+	lines := []string{fmt.Sprintf("%-3s  %-12s  %-6s  %-16s  %7s  %10s", "#", "Name", "Attr", "Modified", "Cluster", "Size")}
+
+	for i := uint(0); i+fat.DIR_ENTRY_SIZE <= uint(len(data)); i += fat.DIR_ENTRY_SIZE {
+		raw := data[i : i+fat.DIR_ENTRY_SIZE]
+		n := i / fat.DIR_ENTRY_SIZE
+
+		if raw[0] == fat.DIR_END {
+			lines = append(lines, fmt.Sprintf("%-3d  end of directory", n))
+			break
+		}
+
+		if raw[11] == fat.ATTR_LONG_NAME {
+			lines = append(lines, fmt.Sprintf("%-3d  long name part %d: %q", n, raw[0]&0x1F, fat.LongNamePart(raw)))
+			continue
+		}
+
+		entry := fat.ParseDirEntry(raw)
+
+		name := entry.ShortName
+		if raw[0] == fat.DIR_DELETED {
+			name = "?" + name[1:]
+		}
+
+		line := fmt.Sprintf("%-3d  %-12s  %-6s  %-16s  %7d  %10d", n, name, describe_attributes(entry.Attr),
+			describe_timestamp(entry.Modified), entry.Cluster, entry.Size)
+
+		if raw[0] == fat.DIR_DELETED {
+			line += "  deleted"
+		}
+
+		lines = append(lines, line)
+	}
+
+	return lines
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/binary"
+	"slices"
+	"strings"
+	"testing"
+
+	"floppy_arduino/fat"
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+// Boot sector of a 1.44M disk formatted by DOS
+func fat12_boot_sector() []byte {
+	return emulatortest.FormatImage(proto.FORMAT_1440K, "TESTDISK", 0x1234ABCD)[:SECTOR_SIZE]
+}
+
+func set_fat12(table []byte, cluster int, value uint16) {
+	i := cluster * 3 / 2
+	entry := binary.LittleEndian.Uint16(table[i:])
+
+	if cluster%2 == 1 {
+		entry = entry&0x000F | value<<4
+	} else {
+		entry = entry&0xF000 | value&0x0FFF
+	}
+
+	binary.LittleEndian.PutUint16(table[i:], entry)
+}
+
+func TestDescribeBootSector(t *testing.T) {
+	boot, err := fat.ParseBootSector(fat12_boot_sector())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Join(describe_boot_sector(boot, nil), "\n")
+	for _, want := range []string{`"MSDOS5.0"`, "Volume serial:        1234-ABCD", `"TESTDISK"`, `"FAT12"`, "0xAA55", "FAT12, 2847 clusters of 512 bytes",
+		"FAT at LBA 1, root directory at LBA 19 (14 sectors), data at LBA 33"} {
+		if !strings.Contains(lines, want) {
+			t.Errorf("description lacks %q", want)
+		}
+	}
+
+	// Fields of a boot sector that fails validation are still shown
+	sector := fat12_boot_sector()
+	sector[0x0D] = 3
+	boot, err = fat.DecodeBootSector(sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, invalid := fat.ParseBootSector(sector)
+
+	lines = strings.Join(describe_boot_sector(boot, invalid), "\n")
+	for _, want := range []string{`"TESTDISK"`, "Sectors per cluster:  3", "Invalid: not a FAT file system: 3 sectors per cluster"} {
+		if !strings.Contains(lines, want) {
+			t.Errorf("description lacks %q", want)
+		}
+	}
+	if strings.Contains(lines, "clusters of") {
+		t.Errorf("layout of an invalid boot sector described")
+	}
+}
+
+func TestDescribeFat(t *testing.T) {
+	boot, _ := fat.ParseBootSector(fat12_boot_sector())
+
+	table := make([]byte, 9*SECTOR_SIZE)
+	set_fat12(table, 0, 0xFF0)
+	set_fat12(table, 1, 0xFFF)
+	set_fat12(table, 2, 3)
+	set_fat12(table, 3, 0xFFF)
+	set_fat12(table, 4, 0xFF7)
+	set_fat12(table, 6, 0xFF8)
+	set_fat12(table, 342, 343)
+	set_fat12(table, 343, 0xFFF)
+
+	lines, err := describe_fat(boot, 1, table[:SECTOR_SIZE])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines[1] != "    0:  rsvd  rsvd     3   end   bad  free   end  free" {
+		t.Errorf("line %q", lines[1])
+	}
+	// Entry 341 straddles the end of the sector
+	if last := lines[len(lines)-1]; !strings.HasPrefix(last, "  336:") || strings.Count(last, "free") != 5 {
+		t.Errorf("last line %q", last)
+	}
+
+	// From the second sector, of the second copy
+	lines, err = describe_fat(boot, 11, table[SECTOR_SIZE:2*SECTOR_SIZE])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines[0] != "FAT12 entries from cluster 342" || lines[1] != "  342:   343   end" {
+		t.Errorf("lines %q", lines[:2])
+	}
+
+	// The last cluster is 2848
+	lines, _ = describe_fat(boot, 9, table[8*SECTOR_SIZE:])
+	if last := lines[len(lines)-1]; !strings.HasPrefix(last, " 2848:") {
+		t.Errorf("last line %q", last)
+	}
+
+	if _, err := describe_fat(boot, 19, table[:SECTOR_SIZE]); err == nil {
+		t.Errorf("root directory decoded as a FAT")
+	}
+}
+
+// Directory entry with a short name
+func dir_entry(name string, attr byte, date uint16, time uint16, cluster uint16, size uint32) []byte {
+	entry := make([]byte, fat.DIR_ENTRY_SIZE)
+
+	copy(entry, name)
+	entry[11] = attr
+	binary.LittleEndian.PutUint16(entry[22:], time)
+	binary.LittleEndian.PutUint16(entry[24:], date)
+	binary.LittleEndian.PutUint16(entry[26:], cluster)
+	binary.LittleEndian.PutUint32(entry[28:], size)
+
+	return entry
+}
+
+func TestDescribeDirectory(t *testing.T) {
+	long := make([]byte, fat.DIR_ENTRY_SIZE)
+	long[0] = 0x41
+	long[11] = fat.ATTR_LONG_NAME
+	for i, c := range "ReadMe.txt" {
+		offset := []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22}[i]
+		binary.LittleEndian.PutUint16(long[offset:], uint16(c))
+	}
+
+	// 2024-05-17 12:34
+	date := uint16(44<<9 | 5<<5 | 17)
+	time := uint16(12<<11 | 34<<5)
+
+	var data []byte
+	for _, entry := range [][]byte{
+		dir_entry("TESTDISK   ", fat.ATTR_VOLUME, 0, 0, 0, 0),
+		long,
+		dir_entry("README  TXT", fat.ATTR_ARCHIVE|fat.ATTR_READ_ONLY, date, time, 2, 1234),
+		dir_entry("\xE5OLD    BAK", fat.ATTR_ARCHIVE, date, time, 5, 10),
+		dir_entry("DOCS       ", fat.ATTR_DIRECTORY, date, time, 7, 0),
+		make([]byte, fat.DIR_ENTRY_SIZE),
+		dir_entry("GHOST   TXT", fat.ATTR_ARCHIVE, date, time, 9, 1),
+	} {
+		data = append(data, entry...)
+	}
+
+	lines := describe_directory(data)
+
+	want := []string{
+		"#    Name          Attr    Modified          Cluster        Size",
+		"0    TESTDISK      --V---                          0           0",
+		`1    long name part 1: "ReadMe.txt"`,
+		"2    README.TXT    A----R  2024-05-17 12:34        2        1234",
+		"3    ?OLD.BAK      A-----  2024-05-17 12:34        5          10  deleted",
+		"4    DOCS          -D----  2024-05-17 12:34        7           0",
+		"5    end of directory",
+	}
+
+	if !slices.Equal(lines, want) {
+		t.Errorf("lines\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"floppy_arduino/fat"
+	"floppy_arduino/proto"
+)
+
+// Bytes per line of a hex dump
+const DUMP_WIDTH int = 16
+
+// Hex and ASCII dump of data, one line per DUMP_WIDTH bytes
+func hex_dump(data []byte) []string {
+
+	var lines []string
+
+	for offset := 0; offset < len(data); offset += DUMP_WIDTH {
+		row := data[offset:min(offset+DUMP_WIDTH, len(data))]
+
+		var hex, ascii strings.Builder
+
+		for i := 0; i < DUMP_WIDTH; i++ {
+			if i == DUMP_WIDTH/2 {
+				hex.WriteByte(' ')
+			}
+
+			if i >= len(row) {
+				hex.WriteString("   ")
+				continue
+			}
+
+			fmt.Fprintf(&hex, "%02x ", row[i])
+
+			if row[i] >= 0x20 && row[i] < 0x7F {
+				ascii.WriteByte(row[i])
+			} else {
+				ascii.WriteByte('.')
+			}
+		}
+
+		lines = append(lines, fmt.Sprintf("%04x  %s |%s|", offset, hex.String(), ascii.String()))
+	}
+
+	return lines
+}
+
+// Sector given as an LBA or as cylinder/head/sector, which needs the
+// geometry of the disk to be resolved
+type SectorAddress struct {
+	lba      uint
+	chs      bool
+	cylinder byte
+	head     byte
+	sector   byte
+}
+
+// Sectors from first to last, both included
+type SectorRange struct {
+	first SectorAddress
+	last  SectorAddress
+}
+
+// Parse an LBA (19) or a C/H/S address (0/1/2)
+func parse_sector_address(s string) (SectorAddress, error) {
+
+	parts := strings.Split(s, "/")
+
+	switch len(parts) {
+	case 1:
+		lba, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return SectorAddress{}, fmt.Errorf("bad LBA %q", s)
+		}
+		return SectorAddress{lba: uint(lba)}, nil
+
+	case 3:
+		var chs [3]byte
+		for i, part := range parts {
+			value, err := strconv.ParseUint(part, 10, 8)
+			if err != nil {
+				return SectorAddress{}, fmt.Errorf("bad address %q, use C/H/S", s)
+			}
+			chs[i] = byte(value)
+		}
+		return SectorAddress{chs: true, cylinder: chs[0], head: chs[1], sector: chs[2]}, nil
+	}
+
+	return SectorAddress{}, fmt.Errorf("bad address %q, use an LBA or C/H/S", s)
+}
+
+// Parse a sector or a range of sectors: 19, 19-32, 0/1/2 or 0/1/2-0/1/5
+func parse_sector_range(s string) (SectorRange, error) {
+
+	first, last, is_range := strings.Cut(s, "-")
+
+	start, err := parse_sector_address(first)
+	if err != nil {
+		return SectorRange{}, err
+	}
+
+	end := start
+	if is_range {
+		if end, err = parse_sector_address(last); err != nil {
+			return SectorRange{}, err
+		}
+	}
+
+	return SectorRange{first: start, last: end}, nil
+}
+
+// LBA of the address on a disk with geometry
+func (a SectorAddress) resolve(geometry proto.Geometry) (uint, error) {
+
+	if !a.chs {
+		if a.lba >= geometry.Blocks() {
+			return 0, fmt.Errorf("LBA %d is past the end of a %s disk", a.lba, geometry.Name)
+		}
+		return a.lba, nil
+	}
+
+	if !geometry.Contains(a.cylinder, a.head, a.sector) {
+		return 0, fmt.Errorf("sector %d/%d/%d is not on a %s disk", a.cylinder, a.head, a.sector, geometry.Name)
+	}
+
+	return geometry.CHSToLBA(a.cylinder, a.head, a.sector), nil
+}
+
+// First and last LBA of the range on a disk with geometry
+func (r SectorRange) resolve(geometry proto.Geometry) (uint, uint, error) {
+
+	first, err := r.first.resolve(geometry)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	last, err := r.last.resolve(geometry)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if last < first {
+		return 0, 0, fmt.Errorf("range ends before it starts")
+	}
+
+	return first, last, nil
+}
+
+// Read the sectors of a range and print them in hex, then decode them.
+// Sectors read with a CRC error are shown with the data the drive
+// returned, unreadable ones are left as zeros for the decoder. Returns
+// false if a sector could not be read.
+func do_dump(ctx context.Context, client *proto.Client, first uint, last uint, retries uint, decode string) (bool, error) {
+
+	geometry := client.Geometry()
+	data := make([]byte, 0, (last-first+1)*SECTOR_SIZE)
+	ok := true
+
+	for lba := first; lba <= last; lba++ {
+		cylinder, head, sector := geometry.LBAToCHS(lba)
+
+		read, _, _, err := verify_sector_retries(ctx, client, cylinder, head, sector, retries)
+
+		fmt.Println()
+		PrtCol(fmt.Sprintf("Sector %d/%d/%d, LBA %d\n", cylinder, head, sector, lba), ColorWhiteBold)
+
+		if err != nil {
+			ok = false
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Println(err)
+
+			if len(read) == 0 {
+				data = append(data, make([]byte, SECTOR_SIZE)...)
+				continue
+			}
+			fmt.Println("Data read with the error:")
+		}
+
+		for _, line := range hex_dump(read) {
+			fmt.Println(line)
+		}
+
+		data = append(data, read...)
+	}
+
+	if decode == "" {
+		return ok, nil
+	}
+
+	fmt.Println()
+
+	var lines []string
+	var err error
+
+	switch decode {
+	case DECODE_BOOT:
+		// Show the fields even if they don't make a file system
+		boot, _ := fat.DecodeBootSector(data)
+		_, invalid := fat.ParseBootSector(data)
+		lines = describe_boot_sector(boot, invalid)
+
+	case DECODE_FAT:
+		var sector []byte
+		if sector, err = read_boot_sector(ctx, client, first, data, retries); err == nil {
+			var boot fat.BootSector
+			if boot, err = fat.ParseBootSector(sector); err == nil {
+				lines, err = describe_fat(boot, first, data)
+			} else {
+				// The FATs can't be found, show why
+				boot, _ = fat.DecodeBootSector(sector)
+				lines = describe_boot_sector(boot, err)
+			}
+		}
+
+	case DECODE_DIR:
+		lines = describe_directory(data)
+	}
+
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+
+	return ok, err
+}
+
+// Boot sector of the disk, from the sectors dumped if they start at LBA 0
+func read_boot_sector(ctx context.Context, client *proto.Client, first uint, data []byte, retries uint) ([]byte, error) {
+
+	if first == 0 {
+		return data[:SECTOR_SIZE], nil
+	}
+
+	boot, _, _, err := verify_sector_retries(ctx, client, 0, 0, 1, retries)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the boot sector: %w", err)
+	}
+
+	return boot, nil
+}
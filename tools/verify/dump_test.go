@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"floppy_arduino/fat"
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+func TestHexDump(t *testing.T) {
+	data := []byte("Hello, floppy!\x00\x01\xFFend")
+
+	lines := hex_dump(data)
+
+	want := []string{
+		"0000  48 65 6c 6c 6f 2c 20 66  6c 6f 70 70 79 21 00 01  |Hello, floppy!..|",
+		"0010  ff 65 6e 64                                       |.end|",
+	}
+
+	if len(lines) != len(want) {
+		t.Fatalf("%d lines, want %d", len(lines), len(want))
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %d = %q, want %q", i, lines[i], want[i])
+		}
+	}
+}
+
+func TestParseSectorRange(t *testing.T) {
+	geometry := proto.FORMAT_1440K
+
+	tests := []struct {
+		s           string
+		first, last uint
+	}{
+		{"19", 19, 19},
+		{"19-32", 19, 32},
+		{"0/1/2", 19, 19},
+		{"0/1/2-1/0/1", 19, 36},
+		{"0-0/0/3", 0, 2},
+	}
+
+	for _, test := range tests {
+		r, err := parse_sector_range(test.s)
+		if err != nil {
+			t.Errorf("%s: %s", test.s, err)
+			continue
+		}
+
+		first, last, err := r.resolve(geometry)
+		if err != nil || first != test.first || last != test.last {
+			t.Errorf("%s = %d-%d, %v, want %d-%d", test.s, first, last, err, test.first, test.last)
+		}
+	}
+
+	for _, s := range []string{"", "x", "1/2", "0/0/1/2", "1-2-3", "-1"} {
+		if _, err := parse_sector_range(s); err == nil {
+			t.Errorf("%q parsed", s)
+		}
+	}
+
+	for _, s := range []string{"2880", "0/0/0", "0/2/1", "80/0/1", "5-4"} {
+		r, _ := parse_sector_range(s)
+		if _, _, err := r.resolve(geometry); err == nil {
+			t.Errorf("%q resolved", s)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	client := emulatortest.StartClient(t, nil, proto.FORMAT_1440K, test_profile())
+
+	// 1/0/5 has a CRC error
+	lba := client.Geometry().CHSToLBA(1, 0, 5)
+
+	if ok, err := do_dump(context.Background(), client, lba-2, lba-1, 0, ""); !ok || err != nil {
+		t.Errorf("dump = %t, %v", ok, err)
+	}
+	if ok, err := do_dump(context.Background(), client, lba, lba+1, 0, DECODE_DIR); ok || err != nil {
+		t.Errorf("dump with a bad sector = %t, %v", ok, err)
+	}
+	// A blank boot sector is shown, but has no FATs to decode
+	if _, err := do_dump(context.Background(), client, 0, 0, 0, DECODE_BOOT); err != nil {
+		t.Errorf("blank boot sector: %v", err)
+	}
+	if _, err := do_dump(context.Background(), client, 1, 1, 0, DECODE_FAT); !errors.Is(err, fat.ErrNotFAT) {
+		t.Errorf("FAT of a blank disk: %v", err)
+	}
+}
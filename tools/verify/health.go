@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+
+	"floppy_arduino/fat"
+)
+
+// Health score from 0 to 100. A bad sector costs a whole sector, a
+// degraded one the share of the retries it needed, so a disk going soft
+// loses points before it loses data. Sectors that differ from an image
+// are readable and only cost their retries.
+func health_score(results []SectorResult, max_retries uint) float64 {
+
+	if len(results) == 0 {
+		return 0
+	}
+
+	penalty := 0.0
+
+	for _, r := range results {
+		if r.Status == STATUS_BAD {
+			penalty++
+		} else if r.Tries > 1 {
+			penalty += float64(r.Tries-1) / float64(max_retries+1)
+		}
+	}
+
+	score := 100 * (1 - penalty/float64(len(results)))
+
+	return math.Round(score*10) / 10
+}
+
+// Identify a disk from its boot sector: the volume serial number of the
+// extended BPB, or a hash of the sector on disks without one. The label
+// is empty if there is none.
+func disk_identity(sector []byte) (string, string) {
+
+	// Extended boot signature
+	if boot, err := fat.DecodeBootSector(sector); err == nil && boot.HasJump() && boot.ExtendedSignature != 0 {
+		id := fmt.Sprintf("%04X-%04X", boot.Serial>>16, boot.Serial&0xFFFF)
+
+		label := boot.Label
+		if label == "NO NAME" {
+			label = ""
+		}
+
+		return id, label
+	}
+
+	sum := sha256.Sum256(sector)
+	return "boot-" + hex.EncodeToString(sum[:4]), ""
+}
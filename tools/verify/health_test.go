@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestHealthScore(t *testing.T) {
+	results := make([]SectorResult, 10)
+	for i := range results {
+		results[i] = SectorResult{Status: STATUS_GOOD, Tries: 1}
+	}
+
+	if score := health_score(results, 3); score != 100 {
+		t.Errorf("all good: score = %.1f", score)
+	}
+
+	// A bad sector costs as much as two sectors needing 3 retries out of 3
+	results[0] = SectorResult{Status: STATUS_BAD, Tries: 4}
+	bad := health_score(results, 3)
+
+	results[0] = SectorResult{Status: STATUS_DEGRADED, Tries: 4}
+	results[1] = SectorResult{Status: STATUS_DEGRADED, Tries: 4}
+	degraded := health_score(results, 3)
+
+	if bad != 90 || degraded != 85 {
+		t.Errorf("bad = %.1f, degraded = %.1f", bad, degraded)
+	}
+
+	if score := health_score(nil, 3); score != 0 {
+		t.Errorf("no sectors: score = %.1f", score)
+	}
+}
+
+func boot_sector(signature byte, serial uint32, label string) []byte {
+	boot := make([]byte, SECTOR_SIZE)
+	boot[0] = 0xEB
+	boot[0x26] = signature
+	binary.LittleEndian.PutUint32(boot[0x27:], serial)
+	copy(boot[0x2B:0x36], label+strings.Repeat(" ", 11-len(label)))
+	return boot
+}
+
+func TestDiskIdentity(t *testing.T) {
+	tests := []struct {
+		boot      []byte
+		id, label string
+	}{
+		{boot_sector(0x29, 0x1234ABCD, "GAMES"), "1234-ABCD", "GAMES"},
+		{boot_sector(0x29, 0x00000042, "NO NAME"), "0000-0042", ""},
+		{boot_sector(0x28, 0xDEADBEEF, "IGNORED"), "DEAD-BEEF", ""},
+	}
+
+	for _, test := range tests {
+		id, label := disk_identity(test.boot)
+		if id != test.id || label != test.label {
+			t.Errorf("disk_identity = %q, %q, want %q, %q", id, label, test.id, test.label)
+		}
+	}
+
+	// No extended BPB
+	boot := make([]byte, SECTOR_SIZE)
+	id, label := disk_identity(boot)
+	if !strings.HasPrefix(id, "boot-") || len(id) != 13 || label != "" {
+		t.Errorf("disk_identity = %q, %q", id, label)
+	}
+
+	boot[100] = 1
+	if other, _ := disk_identity(boot); other == id {
+		t.Errorf("different boot sectors have the same id %s", id)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"floppy_arduino/proto"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Limits of the latency buckets, as multiples of the median read time of
+// the disk. A read waits for its sector, up to a revolution, then sends it
+// at 115200 baud, so even a healthy disk takes a few hundred ms a sector
+// and only the spread tells something. A read that misses its sector and
+// waits a revolution more takes about twice the median.
+var HEAT_RATIOS = []float64{1.25, 1.5, 2, 3}
+
+// Colours of the buckets, fastest first
+var HEAT_COLORS = []Color{ColorBgBlue, ColorBgCyan, ColorBgGreen, ColorBgYellow, ColorBgRedHI}
+
+var HEAT_RGB = []color.RGBA{
+	{0x30, 0x60, 0xC0, 0xFF},
+	{0x30, 0xB0, 0xC0, 0xFF},
+	{0x40, 0xB0, 0x40, 0xFF},
+	{0xE0, 0xC0, 0x30, 0xFF},
+	{0xE0, 0x40, 0x30, 0xFF},
+}
+
+var HEAT_RGB_BAD = color.RGBA{0x20, 0x20, 0x20, 0xFF}
+var HEAT_RGB_NOT_VERIFIED = color.RGBA{0xD8, 0xD8, 0xD8, 0xFF}
+var HEAT_RGB_BACKGROUND = color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}
+
+// Size of the drawing of a head, in pixels
+const HEAT_DISK_SIZE int = 400
+
+// Legend below the drawing: a title, then a line per colour
+const HEAT_LEGEND_LINE int = 18
+const HEAT_LEGEND_LINES int = 8
+const HEAT_LEGEND_HEIGHT int = HEAT_LEGEND_LINE*HEAT_LEGEND_LINES + 10
+
+// Mean time of the reads of a sector
+func sector_latency(r SectorResult) float64 {
+	if len(r.ReadMs) == 0 {
+		return 0
+	}
+	return r.TimeMs / float64(len(r.ReadMs))
+}
+
+// Latency buckets of a disk, in ms
+type heat_scale struct {
+	median float64
+	limits []float64
+}
+
+// Buckets from the median read time of the sectors read
+func new_heat_scale(results []SectorResult) heat_scale {
+
+	var latencies []float64
+	for _, r := range results {
+		if r.Status != STATUS_BAD && len(r.ReadMs) > 0 {
+			latencies = append(latencies, sector_latency(r))
+		}
+	}
+
+	scale := heat_scale{}
+	if len(latencies) > 0 {
+		slices.Sort(latencies)
+		scale.median = latencies[len(latencies)/2]
+	}
+
+	for _, ratio := range HEAT_RATIOS {
+		scale.limits = append(scale.limits, ratio*scale.median)
+	}
+
+	return scale
+}
+
+func (s heat_scale) bucket(ms float64) int {
+	bucket := 0
+	for bucket < len(s.limits) && ms >= s.limits[bucket] {
+		bucket++
+	}
+	return bucket
+}
+
+// Whole ms, with decimals for the fast reads of an emulated drive
+func format_heat_ms(ms float64) string {
+	if ms >= 100 {
+		return fmt.Sprintf("%.0f", ms)
+	}
+	return fmt.Sprintf("%.3g", ms)
+}
+
+func (s heat_scale) label(bucket int) string {
+	switch bucket {
+	case 0:
+		return fmt.Sprintf("< %s ms", format_heat_ms(s.limits[0]))
+	case len(s.limits):
+		return fmt.Sprintf(">= %s ms", format_heat_ms(s.limits[bucket-1]))
+	default:
+		return fmt.Sprintf("%s-%s ms", format_heat_ms(s.limits[bucket-1]), format_heat_ms(s.limits[bucket]))
+	}
+}
+
+func (s heat_scale) title() string {
+	return fmt.Sprintf("Read time, median %s ms", format_heat_ms(s.median))
+}
+
+// Labels of the colours of the images, the buckets then bad and not
+// verified sectors
+func (s heat_scale) legend() []string {
+	labels := make([]string, 0, len(HEAT_RGB)+2)
+	for bucket := range HEAT_RGB {
+		labels = append(labels, s.label(bucket))
+	}
+	return append(labels, "bad", "not verified")
+}
+
+func print_heat_cell(r SectorResult, scale heat_scale) {
+	switch r.Status {
+	case STATUS_BAD:
+		PrtCol(" E ", ColorBgRed)
+	case STATUS_DIFFER:
+		PrtCol(" X ", ColorBgPurple)
+	default:
+		bucket := scale.bucket(sector_latency(r))
+		PrtCol(fmt.Sprintf(" %d ", bucket), HEAT_COLORS[bucket])
+	}
+}
+
+// Table of the sectors verified, one row per track, coloured against the
+// median of all of them
+func print_heat_table(geometry proto.Geometry, results []SectorResult) {
+
+	scale := new_heat_scale(results)
+	per_track := int(geometry.Heads) * int(geometry.Sectors)
+
+	print_table_header(geometry)
+
+	for start := 0; start < len(results); start += per_track {
+		row := results[start:min(start+per_track, len(results))]
+
+		fmt.Printf("%-2d ", row[0].Track)
+		for _, r := range row {
+			print_heat_cell(r, scale)
+		}
+		fmt.Println()
+	}
+
+	print_heat_legend(scale)
+}
+
+func print_heat_legend(scale heat_scale) {
+	fmt.Println()
+	fmt.Println(scale.title())
+	for bucket := range HEAT_COLORS {
+		PrtCol(fmt.Sprintf(" %d ", bucket), HEAT_COLORS[bucket])
+		fmt.Printf(" %s  ", scale.label(bucket))
+	}
+	fmt.Println()
+}
+
+// Colours of the legend, in the order of heat_scale.legend
+func heat_swatches() []color.RGBA {
+	return append(append([]color.RGBA{}, HEAT_RGB...), HEAT_RGB_BAD, HEAT_RGB_NOT_VERIFIED)
+}
+
+// Results by LBA, nil for sectors not verified
+func heat_cells(geometry proto.Geometry, results []SectorResult) []*SectorResult {
+	cells := make([]*SectorResult, geometry.Blocks())
+	for i := range results {
+		if results[i].LBA < uint(len(cells)) {
+			cells[results[i].LBA] = &results[i]
+		}
+	}
+	return cells
+}
+
+func heat_rgb(r *SectorResult, scale heat_scale) color.RGBA {
+	switch {
+	case r == nil:
+		return HEAT_RGB_NOT_VERIFIED
+	case r.Status == STATUS_BAD:
+		return HEAT_RGB_BAD
+	default:
+		return HEAT_RGB[scale.bucket(sector_latency(*r))]
+	}
+}
+
+// Rings of the drawing of a disk: track 0 is the outer one, sector 1
+// starts at the top and sectors go clockwise
+type heat_disk struct {
+	geometry proto.Geometry
+	outer    float64
+	inner    float64
+}
+
+func new_heat_disk(geometry proto.Geometry) heat_disk {
+	outer := float64(HEAT_DISK_SIZE)/2 - 20
+	return heat_disk{geometry: geometry, outer: outer, inner: outer / 4}
+}
+
+func (d heat_disk) ring_width() float64 {
+	return (d.outer - d.inner) / float64(d.geometry.Tracks)
+}
+
+// Track and sector at distance radius from the center and angle from the
+// top, clockwise. false outside the tracks.
+func (d heat_disk) at(radius float64, angle float64) (byte, byte, bool) {
+	if radius >= d.outer || radius < d.inner {
+		return 0, 0, false
+	}
+
+	track := byte((d.outer - radius) / d.ring_width())
+	sector := byte(angle/(2*math.Pi)*float64(d.geometry.Sectors)) + 1
+
+	return track, min(sector, d.geometry.Sectors), true
+}
+
+// Write a PNG of the surface of each head, side by side, with the colours
+// of the buckets below
+func write_heatmap_png(w io.Writer, geometry proto.Geometry, results []SectorResult) error {
+
+	cells := heat_cells(geometry, results)
+	scale := new_heat_scale(results)
+	disk := new_heat_disk(geometry)
+
+	width := HEAT_DISK_SIZE * int(geometry.Heads)
+	img := image.NewRGBA(image.Rect(0, 0, width, HEAT_DISK_SIZE+HEAT_LEGEND_HEIGHT))
+
+	for y := 0; y < HEAT_DISK_SIZE+HEAT_LEGEND_HEIGHT; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, HEAT_RGB_BACKGROUND)
+		}
+	}
+
+	center := float64(HEAT_DISK_SIZE) / 2
+
+	for head := byte(0); head < geometry.Heads; head++ {
+		for y := 0; y < HEAT_DISK_SIZE; y++ {
+			for x := 0; x < HEAT_DISK_SIZE; x++ {
+				dx, dy := float64(x)+0.5-center, float64(y)+0.5-center
+
+				angle := math.Atan2(dx, -dy)
+				if angle < 0 {
+					angle += 2 * math.Pi
+				}
+
+				track, sector, ok := disk.at(math.Hypot(dx, dy), angle)
+				if !ok {
+					continue
+				}
+
+				img.SetRGBA(int(head)*HEAT_DISK_SIZE+x, y, heat_rgb(cells[geometry.CHSToLBA(track, head, sector)], scale))
+			}
+		}
+	}
+
+	// Legend
+	text := font.Drawer{Dst: img, Src: image.NewUniform(color.Black), Face: basicfont.Face7x13}
+
+	text.Dot = fixed.P(20, HEAT_DISK_SIZE+HEAT_LEGEND_LINE)
+	text.DrawString(scale.title())
+
+	for i, label := range scale.legend() {
+		top := HEAT_DISK_SIZE + (i+1)*HEAT_LEGEND_LINE + 6
+
+		for y := top; y < top+14; y++ {
+			for x := 20; x < 34; x++ {
+				img.SetRGBA(x, y, heat_swatches()[i])
+			}
+		}
+
+		text.Dot = fixed.P(40, top+11)
+		text.DrawString(label)
+	}
+
+	return png.Encode(w, img)
+}
+
+func svg_color(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// Point at radius and angle from the top, clockwise, around cx, cy
+func svg_point(cx, cy, radius, angle float64) string {
+	return fmt.Sprintf("%.2f,%.2f", cx+radius*math.Sin(angle), cy-radius*math.Cos(angle))
+}
+
+// Write an SVG of the surface of each head, side by side, with a legend.
+// Each sector has a tooltip with its address and timing.
+func write_heatmap_svg(w io.Writer, geometry proto.Geometry, results []SectorResult) error {
+
+	cells := heat_cells(geometry, results)
+	scale := new_heat_scale(results)
+	disk := new_heat_disk(geometry)
+
+	width := HEAT_DISK_SIZE * int(geometry.Heads)
+	height := HEAT_DISK_SIZE + HEAT_LEGEND_HEIGHT
+
+	out := bufio.NewWriter(w)
+
+	fmt.Fprintf(out, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\" font-family=\"sans-serif\" font-size=\"12\">\n", width, height)
+	fmt.Fprintf(out, "<rect width=\"%d\" height=\"%d\" fill=\"%s\"/>\n", width, height, svg_color(HEAT_RGB_BACKGROUND))
+
+	sector_angle := 2 * math.Pi / float64(geometry.Sectors)
+
+	for head := byte(0); head < geometry.Heads; head++ {
+		cx := float64(int(head)*HEAT_DISK_SIZE + HEAT_DISK_SIZE/2)
+		cy := float64(HEAT_DISK_SIZE / 2)
+
+		fmt.Fprintf(out, "<text x=\"%.0f\" y=\"14\" text-anchor=\"middle\" font-weight=\"bold\">HEAD %d</text>\n", cx, head)
+
+		for track := byte(0); track < geometry.Tracks; track++ {
+			r_out := disk.outer - float64(track)*disk.ring_width()
+			r_in := r_out - disk.ring_width()
+
+			for sector := byte(1); sector <= geometry.Sectors; sector++ {
+				lba := geometry.CHSToLBA(track, head, sector)
+				cell := cells[lba]
+
+				start := float64(sector-1) * sector_angle
+				end := start + sector_angle
+
+				fmt.Fprintf(out, "<path d=\"M%s A%.2f,%.2f 0 0 1 %s L%s A%.2f,%.2f 0 0 0 %s Z\" fill=\"%s\">",
+					svg_point(cx, cy, r_out, start), r_out, r_out, svg_point(cx, cy, r_out, end),
+					svg_point(cx, cy, r_in, end), r_in, r_in, svg_point(cx, cy, r_in, start),
+					svg_color(heat_rgb(cell, scale)))
+
+				fmt.Fprintf(out, "<title>%d/%d/%d LBA %d", track, head, sector, lba)
+				if cell != nil {
+					fmt.Fprintf(out, ": %s, %.1f ms", cell.Status, sector_latency(*cell))
+				}
+				fmt.Fprint(out, "</title></path>\n")
+			}
+		}
+	}
+
+	// Legend
+	fmt.Fprintf(out, "<text x=\"20\" y=\"%d\">%s</text>\n", HEAT_DISK_SIZE+HEAT_LEGEND_LINE, scale.title())
+
+	for i, label := range scale.legend() {
+		top := HEAT_DISK_SIZE + (i+1)*HEAT_LEGEND_LINE + 6
+
+		fmt.Fprintf(out, "<rect x=\"20\" y=\"%d\" width=\"14\" height=\"14\" fill=\"%s\"/>", top, svg_color(heat_swatches()[i]))
+		fmt.Fprintf(out, "<text x=\"40\" y=\"%d\">%s</text>\n", top+11, strings.ReplaceAll(label, "<", "&lt;"))
+	}
+
+	fmt.Fprintln(out, "</svg>")
+
+	return out.Flush()
+}
+
+// Write the heatmap of results to path, a PNG or an SVG by its extension
+func save_heatmap(path string, geometry proto.Geometry, results []SectorResult) error {
+
+	var write func(io.Writer, proto.Geometry, []SectorResult) error
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		write = write_heatmap_png
+	case ".svg":
+		write = write_heatmap_svg
+	default:
+		return fmt.Errorf("unknown image type, use .png or .svg")
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := write(file, geometry, results); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/color"
+	"image/png"
+	"math"
+	"strings"
+	"testing"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+func TestHeatScale(t *testing.T) {
+	var results []SectorResult
+	for _, ms := range []float64{190, 200, 210, 5000} {
+		results = append(results, SectorResult{Status: STATUS_GOOD, ReadMs: []float64{ms}, TimeMs: ms})
+	}
+
+	// Bad sectors don't count
+	results = append(results, SectorResult{Status: STATUS_BAD, ReadMs: []float64{1, 1}, TimeMs: 2})
+
+	scale := new_heat_scale(results)
+
+	if scale.median != 210 {
+		t.Errorf("median %g, want 210", scale.median)
+	}
+
+	tests := []struct {
+		ms     float64
+		bucket int
+	}{
+		{0, 0}, {262, 0}, {263, 1}, {400, 2}, {629, 3}, {630, 4}, {5000, 4},
+	}
+
+	for _, test := range tests {
+		if got := scale.bucket(test.ms); got != test.bucket {
+			t.Errorf("bucket(%g) = %d, want %d", test.ms, got, test.bucket)
+		}
+	}
+
+	if got := scale.label(2); got != "315-420 ms" {
+		t.Errorf("label(2) = %q", got)
+	}
+	if got := scale.label(4); got != ">= 630 ms" {
+		t.Errorf("label(4) = %q", got)
+	}
+}
+
+func TestReadTiming(t *testing.T) {
+	lba := uint(20)
+	client := emulatortest.StartClient(t, nil, proto.FORMAT_1440K, &emulator.Profile{
+		Sectors: []emulator.SectorFault{
+			{LBA: &lba, DelayMs: 60},
+			sector_error(0, 1, 5, emulator.CRC, 1),
+		},
+	})
+
+	start := byte(0)
+	results := do_verify(context.Background(), client, start, start, OptionalUint{value: 1}, nil, true)
+
+	for _, r := range results {
+		if r.LBA == lba {
+			// A slow sector still reads
+			if r.Status != STATUS_GOOD || len(r.ReadMs) != 1 || sector_latency(r) < 60 {
+				t.Errorf("slow sector: %s, reads %v", r.Status, r.ReadMs)
+			}
+		} else if sector_latency(r) >= 60 {
+			t.Errorf("sector %d: reads %v", r.LBA, r.ReadMs)
+		}
+	}
+
+	// One time per read
+	r := results[proto.FORMAT_1440K.CHSToLBA(0, 1, 5)]
+	if r.Status != STATUS_DEGRADED || len(r.ReadMs) != 2 || math.Abs(r.ReadMs[0]+r.ReadMs[1]-r.TimeMs) > 0.01 {
+		t.Errorf("degraded sector: %s, reads %v, time %.1f", r.Status, r.ReadMs, r.TimeMs)
+	}
+}
+
+func heat_results(geometry proto.Geometry) []SectorResult {
+	var results []SectorResult
+
+	for track := byte(0); track < 2; track++ {
+		for head := byte(0); head < geometry.Heads; head++ {
+			for sector := byte(1); sector <= geometry.Sectors; sector++ {
+				r := SectorResult{Track: track, Head: head, Sector: sector, LBA: geometry.CHSToLBA(track, head, sector), Status: STATUS_GOOD, ReadMs: []float64{10}, TimeMs: 10}
+				results = append(results, r)
+			}
+		}
+	}
+
+	// Top of the outer ring of head 1 is slow
+	results[geometry.CHSToLBA(0, 1, 1)].ReadMs = []float64{500}
+	results[geometry.CHSToLBA(0, 1, 1)].TimeMs = 500
+
+	return results
+}
+
+func TestHeatmapPNG(t *testing.T) {
+	geometry := proto.FORMAT_1440K
+
+	var buf bytes.Buffer
+	if err := write_heatmap_png(&buf, geometry, heat_results(geometry)); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := img.Bounds(); b.Dx() != 2*HEAT_DISK_SIZE || b.Dy() != HEAT_DISK_SIZE+HEAT_LEGEND_HEIGHT {
+		t.Fatalf("size = %v", b)
+	}
+
+	disk := new_heat_disk(geometry)
+	top := int(float64(HEAT_DISK_SIZE)/2 - disk.outer + 1)
+
+	// Just right of the top, in track 0 sector 1
+	pixel := func(head int, y int) color.RGBA {
+		return color.RGBAModel.Convert(img.At(head*HEAT_DISK_SIZE+HEAT_DISK_SIZE/2+1, y)).(color.RGBA)
+	}
+
+	if got := pixel(0, top); got != HEAT_RGB[0] {
+		t.Errorf("head 0 = %v, want fast", got)
+	}
+	if got := pixel(1, top); got != HEAT_RGB[4] {
+		t.Errorf("head 1 = %v, want slow", got)
+	}
+
+	// Inner tracks weren't verified
+	if got := pixel(0, int(float64(HEAT_DISK_SIZE)/2-disk.inner-1)); got != HEAT_RGB_NOT_VERIFIED {
+		t.Errorf("inner track = %v, want not verified", got)
+	}
+
+	// Each line of the legend has a label right of its colour
+	for i := range heat_swatches() {
+		top := HEAT_DISK_SIZE + (i+1)*HEAT_LEGEND_LINE + 6
+		text := 0
+
+		for y := top; y < top+14; y++ {
+			for x := 40; x < 200; x++ {
+				if c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA); c != HEAT_RGB_BACKGROUND {
+					text++
+				}
+			}
+		}
+
+		if text == 0 {
+			t.Errorf("no label for colour %d", i)
+		}
+	}
+}
+
+func TestHeatmapSVG(t *testing.T) {
+	geometry := proto.FORMAT_720K
+
+	var buf bytes.Buffer
+	if err := write_heatmap_svg(&buf, geometry, heat_results(geometry)); err != nil {
+		t.Fatal(err)
+	}
+
+	svg := buf.String()
+
+	if n := strings.Count(svg, "<path "); n != int(geometry.Blocks()) {
+		t.Errorf("%d sectors drawn, want %d", n, geometry.Blocks())
+	}
+	if !strings.Contains(svg, "<title>0/1/1 LBA 9: good, 500.0 ms</title>") {
+		t.Errorf("no tooltip for the slow sector")
+	}
+	for _, label := range []string{"Read time, median 10 ms", "&lt; 12.5 ms", ">= 30 ms", "not verified"} {
+		if !strings.Contains(svg, ">"+label+"</text>") {
+			t.Errorf("no legend %q", label)
+		}
+	}
+	if !strings.HasSuffix(svg, "</svg>\n") {
+		t.Errorf("svg not closed")
+	}
+}
+
+func TestSaveHeatmap(t *testing.T) {
+	if err := save_heatmap(t.TempDir()+"/map.gif", proto.FORMAT_360K, nil); err == nil {
+		t.Errorf("saved an unknown image type")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// History file, one JSON entry per line, in the user's config directory
+// unless given
+const HISTORY_FILE string = "verify_history.jsonl"
+
+// Subcommand showing the history of a disk
+const CMD_HISTORY string = "history"
+
+// Sector statuses in history entries, one character per LBA
+const HISTORY_GOOD byte = 'S'
+const HISTORY_DEGRADED byte = 'D'
+const HISTORY_BAD byte = 'E'
+const HISTORY_DIFFER byte = 'X'
+const HISTORY_NOT_VERIFIED byte = '.'
+
+// HistoryEntry is a verification of a disk
+type HistoryEntry struct {
+	Summary
+	Statuses string `json:"statuses"`
+}
+
+func default_history_path() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return HISTORY_FILE
+	}
+	return filepath.Join(dir, "floppy_arduino", HISTORY_FILE)
+}
+
+func new_history_entry(summary Summary, results []SectorResult, n_blocks uint) HistoryEntry {
+
+	statuses := []byte(strings.Repeat(string(HISTORY_NOT_VERIFIED), int(n_blocks)))
+
+	for _, r := range results {
+		switch r.Status {
+		case STATUS_GOOD:
+			statuses[r.LBA] = HISTORY_GOOD
+		case STATUS_DEGRADED:
+			statuses[r.LBA] = HISTORY_DEGRADED
+		case STATUS_BAD:
+			statuses[r.LBA] = HISTORY_BAD
+		case STATUS_DIFFER:
+			statuses[r.LBA] = HISTORY_DIFFER
+		}
+	}
+
+	return HistoryEntry{Summary: summary, Statuses: string(statuses)}
+}
+
+func append_history(path string, entry HistoryEntry) error {
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Entries of a disk, given by its id or label, oldest first
+func load_history(path string, disk string) ([]HistoryEntry, error) {
+
+	file, err := os.Open(path)
+
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []HistoryEntry
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	line_no := 0
+
+	for scanner.Scan() {
+		line_no++
+
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		var entry HistoryEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line_no, err)
+		}
+
+		if strings.EqualFold(entry.Disk, disk) || (entry.Label != "" && strings.EqualFold(entry.Label, disk)) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+// Worse statuses rank higher
+func status_rank(status byte) int {
+	switch status {
+	case HISTORY_DEGRADED:
+		return 1
+	case HISTORY_BAD:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// Sectors that changed between two verifications, by kind of change
+type HistoryChanges struct {
+	good_to_degraded []uint
+	degraded_to_bad  []uint
+	good_to_bad      []uint
+	better           []uint
+}
+
+func history_changes(prev HistoryEntry, cur HistoryEntry) HistoryChanges {
+
+	var c HistoryChanges
+
+	for lba := 0; lba < min(len(prev.Statuses), len(cur.Statuses)); lba++ {
+		p, n := prev.Statuses[lba], cur.Statuses[lba]
+
+		if p == HISTORY_NOT_VERIFIED || n == HISTORY_NOT_VERIFIED {
+			continue
+		}
+
+		switch {
+		case status_rank(p) == 0 && n == HISTORY_DEGRADED:
+			c.good_to_degraded = append(c.good_to_degraded, uint(lba))
+		case p == HISTORY_DEGRADED && n == HISTORY_BAD:
+			c.degraded_to_bad = append(c.degraded_to_bad, uint(lba))
+		case status_rank(p) == 0 && n == HISTORY_BAD:
+			c.good_to_bad = append(c.good_to_bad, uint(lba))
+		case status_rank(n) < status_rank(p):
+			c.better = append(c.better, uint(lba))
+		}
+	}
+
+	return c
+}
+
+func print_change(count_msg string, lbas []uint, color Color) {
+	if len(lbas) > 0 {
+		fmt.Printf("    %d %s: %s\n", len(lbas), FmtCol(count_msg, color), format_ranges(lbas))
+	}
+}
+
+func show_history(entries []HistoryEntry) {
+
+	fmt.Printf("History of disk %s", entries[0].Disk)
+	if entries[0].Label != "" {
+		fmt.Printf(" (%s)", entries[0].Label)
+	}
+	fmt.Printf(", %d verifications\n\n", len(entries))
+
+	PrtCol(fmt.Sprintf("%-16s  %-6s  %6s  %6s  %8s  %6s  %6s\n", "Date", "Format", "Score", "Good", "Degraded", "Bad", "Differ"), ColorWhiteBold)
+
+	for i, e := range entries {
+		fmt.Printf("%-16s  %-6s  %6.1f  %6d  %8d  %6d  %6d\n", e.Started.Local().Format("2006-01-02 15:04"), e.Format, e.Score, e.Good, e.Degraded, e.Bad, e.Differ)
+
+		if i == 0 {
+			continue
+		}
+
+		c := history_changes(entries[i-1], e)
+		print_change("good -> degraded", c.good_to_degraded, ColorYellowHI)
+		print_change("degraded -> bad", c.degraded_to_bad, ColorRedHI)
+		print_change("good -> bad", c.good_to_bad, ColorRedHI)
+		print_change("better", c.better, ColorGreenHI)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func test_entry(disk, label, statuses string, started time.Time) HistoryEntry {
+	return HistoryEntry{Summary: Summary{Disk: disk, Label: label, Format: "1.44M", Started: started}, Statuses: statuses}
+}
+
+func TestHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config", HISTORY_FILE)
+
+	// No history yet
+	entries, err := load_history(path, "1234-ABCD")
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("load_history = %v, %v", entries, err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	first := test_entry("1234-ABCD", "GAMES", "SSSS", now)
+	other := test_entry("0000-0042", "", "SSSS", now)
+	second := test_entry("1234-ABCD", "GAMES", "SDES", now.Add(time.Hour))
+
+	for _, e := range []HistoryEntry{first, other, second} {
+		if err := append_history(path, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// By id or label
+	for _, disk := range []string{"1234-abcd", "games"} {
+		entries, err := load_history(path, disk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || !reflect.DeepEqual(entries[0], first) || !reflect.DeepEqual(entries[1], second) {
+			t.Errorf("load_history(%s) = %+v", disk, entries)
+		}
+	}
+}
+
+func TestHistoryEntry(t *testing.T) {
+	results := []SectorResult{
+		{LBA: 1, Status: STATUS_GOOD},
+		{LBA: 2, Status: STATUS_DEGRADED},
+		{LBA: 3, Status: STATUS_BAD},
+		{LBA: 4, Status: STATUS_DIFFER},
+	}
+
+	entry := new_history_entry(Summary{}, results, 6)
+	if entry.Statuses != ".SDEX." {
+		t.Errorf("statuses = %q", entry.Statuses)
+	}
+}
+
+func TestHistoryChanges(t *testing.T) {
+	prev := test_entry("1", "", "SSSDDE.S", time.Time{})
+	cur := test_entry("1", "", "SDESES.S", time.Time{})
+
+	c := history_changes(prev, cur)
+
+	want := HistoryChanges{
+		good_to_degraded: []uint{1},
+		degraded_to_bad:  []uint{4},
+		good_to_bad:      []uint{2},
+		better:           []uint{3, 5},
+	}
+
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("history_changes = %+v, want %+v", c, want)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output formats
+const OUTPUT_JSON string = "json"
+const OUTPUT_CSV string = "csv"
+
+// Sector statuses
+const STATUS_GOOD string = "good"         // Read on the first try
+const STATUS_DEGRADED string = "degraded" // Read after retries
+const STATUS_BAD string = "bad"           // Not read
+const STATUS_DIFFER string = "differ"     // Read, but not as in the image
+
+// SectorResult is how a sector verified
+type SectorResult struct {
+	Track  byte    `json:"track"`
+	Head   byte    `json:"head"`
+	Sector byte    `json:"sector"`
+	LBA    uint    `json:"lba"`
+	Status string  `json:"status"`
+	Tries  uint    `json:"tries"` // Reads done
+	Error  string  `json:"error,omitempty"`
+	TimeMs float64 `json:"time_ms"` // Time taken by all the reads
+
+	// Time taken by each read
+	ReadMs []float64 `json:"read_ms"`
+}
+
+// Summary of a verification
+type Summary struct {
+	Disk       string    `json:"disk,omitempty"`
+	Label      string    `json:"label,omitempty"`
+	Format     string    `json:"format"`
+	StartTrack byte      `json:"start_track"`
+	EndTrack   byte      `json:"end_track"`
+	Retries    uint      `json:"retries"`
+	Sectors    uint      `json:"sectors"`
+	Good       uint      `json:"good"`
+	Degraded   uint      `json:"degraded"`
+	Bad        uint      `json:"bad"`
+	Differ     uint      `json:"differ"`
+	RetryCount []uint    `json:"retry_count"` // Sectors read after 0, 1, 2... retries
+	Score      float64   `json:"score"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+}
+
+// JSON output
+type Report struct {
+	Summary Summary        `json:"summary"`
+	Sectors []SectorResult `json:"sectors"`
+}
+
+// Count the results of a verification with max_retries retries
+func summarize(results []SectorResult, max_retries uint) Summary {
+
+	s := Summary{
+		Sectors:    uint(len(results)),
+		Retries:    max_retries,
+		RetryCount: make([]uint, max_retries+1),
+	}
+
+	for _, r := range results {
+		switch r.Status {
+		case STATUS_GOOD:
+			s.Good++
+		case STATUS_DEGRADED:
+			s.Degraded++
+		case STATUS_BAD:
+			s.Bad++
+		case STATUS_DIFFER:
+			s.Differ++
+		}
+
+		if r.Status != STATUS_BAD && r.Tries >= 1 && r.Tries <= max_retries+1 {
+			s.RetryCount[r.Tries-1]++
+		}
+	}
+
+	s.Score = health_score(results, max_retries)
+
+	return s
+}
+
+func write_json(w io.Writer, summary Summary, results []SectorResult) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(Report{Summary: summary, Sectors: results})
+}
+
+// One row per sector
+func write_csv(w io.Writer, results []SectorResult) error {
+
+	c := csv.NewWriter(w)
+	c.Write([]string{"track", "head", "sector", "lba", "status", "tries", "error", "time_ms", "read_ms"})
+
+	for _, r := range results {
+		reads := make([]string, len(r.ReadMs))
+		for i, ms := range r.ReadMs {
+			reads[i] = strconv.FormatFloat(ms, 'f', 1, 64)
+		}
+
+		c.Write([]string{
+			strconv.Itoa(int(r.Track)),
+			strconv.Itoa(int(r.Head)),
+			strconv.Itoa(int(r.Sector)),
+			strconv.FormatUint(uint64(r.LBA), 10),
+			r.Status,
+			strconv.FormatUint(uint64(r.Tries), 10),
+			r.Error,
+			strconv.FormatFloat(r.TimeMs, 'f', 1, 64),
+			strings.Join(reads, " "),
+		})
+	}
+
+	c.Flush()
+	return c.Error()
+}
+
+// Summary as a line of JSON, for CSV output which only holds the sectors
+func write_summary(w io.Writer, summary Summary) error {
+
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "Summary: %s\n", data)
+	return err
+}
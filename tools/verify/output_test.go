@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+func TestSummarize(t *testing.T) {
+	client := emulatortest.StartClient(t, nil, proto.FORMAT_1440K, test_profile())
+
+	start := byte(1)
+	end := byte(5)
+
+	results := do_verify(context.Background(), client, start, end, OptionalUint{value: 3}, nil, false)
+	s := summarize(results, 3)
+
+	if s.Sectors != 5*36 {
+		t.Errorf("sectors = %d, want %d", s.Sectors, 5*36)
+	}
+
+	// 2/1/1 needs 2 retries, 2/1/2 one
+	want := []uint{5*36 - 4, 1, 1, 0}
+	for i := range want {
+		if s.RetryCount[i] != want[i] {
+			t.Errorf("retry_count = %v, want %v", s.RetryCount, want)
+			break
+		}
+	}
+
+	for _, r := range results {
+		if r.Status == STATUS_BAD && (r.Tries != 4 || r.Error != proto.ERROR_KIND_CRC) {
+			t.Errorf("bad sector %d: %d tries, error %q", r.LBA, r.Tries, r.Error)
+		}
+		if r.Status == STATUS_GOOD && (r.Tries != 1 || r.Error != "") {
+			t.Errorf("good sector %d: %d tries, error %q", r.LBA, r.Tries, r.Error)
+		}
+	}
+
+	if s.Score >= 100 || s.Score < 98 {
+		t.Errorf("score = %.1f", s.Score)
+	}
+}
+
+func test_results() []SectorResult {
+	return []SectorResult{
+		{Track: 0, Head: 0, Sector: 1, LBA: 0, Status: STATUS_GOOD, Tries: 1, TimeMs: 12.5},
+		{Track: 0, Head: 0, Sector: 2, LBA: 1, Status: STATUS_DEGRADED, Tries: 3, TimeMs: 40},
+		{Track: 0, Head: 0, Sector: 3, LBA: 2, Status: STATUS_BAD, Tries: 4, Error: proto.ERROR_KIND_CRC, TimeMs: 60},
+		{Track: 0, Head: 0, Sector: 4, LBA: 3, Status: STATUS_DIFFER, Tries: 1, TimeMs: 12},
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	results := test_results()
+
+	var buf bytes.Buffer
+	if err := write_json(&buf, summarize(results, 3), results); err != nil {
+		t.Fatal(err)
+	}
+
+	var report Report
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	s := report.Summary
+	if s.Good != 1 || s.Degraded != 1 || s.Bad != 1 || s.Differ != 1 {
+		t.Errorf("summary = %+v", s)
+	}
+	if len(report.Sectors) != 4 || !reflect.DeepEqual(report.Sectors[2], results[2]) {
+		t.Errorf("sectors = %+v", report.Sectors)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	results := test_results()
+
+	var buf bytes.Buffer
+	if err := write_csv(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing but rows
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 5 {
+		t.Fatalf("%d rows, want 5", len(rows))
+	}
+	if got := strings.Join(rows[3], ","); got != "0,0,3,2,bad,4,crc,60.0," {
+		t.Errorf("row = %s", got)
+	}
+
+	buf.Reset()
+	if err := write_summary(&buf, summarize(results, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, found := strings.CutPrefix(strings.TrimSpace(buf.String()), "Summary: ")
+	if !found {
+		t.Fatalf("no summary: %s", buf.String())
+	}
+
+	var s Summary
+	if err := json.Unmarshal([]byte(summary), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Sectors != 4 || s.Bad != 1 {
+		t.Errorf("summary = %+v", s)
+	}
+}
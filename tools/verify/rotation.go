@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"floppy_arduino/proto"
+)
+
+// Sectors of a track in logical order
+func logical_order(sectors byte) []byte {
+	order := make([]byte, sectors)
+	for i := range order {
+		order[i] = byte(i + 1)
+	}
+	return order
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Print the result of the rotation analysis of a track
+func print_rotation(track byte, r proto.Rotation) {
+
+	n := byte(len(r.Order))
+	slot_time := r.Period / time.Duration(n)
+
+	fmt.Println()
+	PrtCol(fmt.Sprintf("Track %d, head 0\n", track), ColorWhiteBold)
+	fmt.Printf("Rotation: %.1f RPM, %.1f ms per revolution, %.1f ms per sector\n", r.RPM(), ms(r.Period), ms(slot_time))
+
+	fmt.Println()
+	PrtCol(fmt.Sprintf("%6s  %4s  %10s\n", "Sector", "Slot", "After 1"), ColorWhiteBold)
+
+	for sector := byte(1); sector <= n; sector++ {
+		fmt.Printf("%6d  %4d  %7.1f ms\n", sector, slices.Index(r.Order, sector), ms(r.Phases[sector-1]))
+	}
+
+	fmt.Println()
+	fmt.Printf("Physical order: %v\n", r.Order)
+	fmt.Printf("Interleave: %d\n", r.Interleave)
+	fmt.Printf("Next readable sector: %d slots after a read\n", r.Skip)
+
+	logical := r.TrackTime(logical_order(n))
+	fast := r.TrackTime(r.ReadOrder())
+
+	fmt.Printf("Track read in logical order: %.0f ms (%.1f revolutions)\n", ms(logical), float64(logical)/float64(r.Period))
+	fmt.Printf("Track read in order %v: %.0f ms (%.1f revolutions)\n", r.ReadOrder(), ms(fast), float64(fast)/float64(r.Period))
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+
+	"floppy_arduino/proto"
+)
+
+// Terminal control
+const TUI_ENTER string = "\033[?1049h\033[?25l" // Alternate screen, hide cursor
+const TUI_LEAVE string = "\033[?25h\033[?1049l"
+const TUI_HOME string = "\033[H"
+const TUI_CLEAR_LINE string = "\033[K"
+const TUI_CLEAR_BELOW string = "\033[J"
+const TUI_REVERSE string = "\033[7m"
+
+// Time between redraws
+const TUI_REFRESH time.Duration = 100 * time.Millisecond
+
+// Lines around the grid: title and head names above, status below
+const TUI_LINES_ABOVE int = 2
+const TUI_LINES_BELOW int = 5
+
+// Requests from the user to the verification
+const (
+	TUI_CMD_RETEST byte = iota
+	TUI_CMD_DUMP
+)
+
+type TuiCmd struct {
+	kind byte
+	lba  uint
+}
+
+// Sector shown in hex
+type TuiDump struct {
+	lba    uint
+	data   []byte
+	err    error
+	scroll int
+}
+
+// Tui is the state of the full screen verification, shared by the
+// verification and the screen
+type Tui struct {
+	mu sync.Mutex
+
+	geometry    proto.Geometry
+	title       string
+	start_track byte
+	end_track   byte
+
+	cells   []*SectorResult // By LBA, nil until verified
+	current int             // LBA being read, -1 if none
+	total   uint
+	done    uint
+
+	// Selected cell, the screen follows the verification unless the user
+	// moved it
+	cursor uint
+	follow bool
+	top    byte // First track on screen
+
+	paused   bool
+	finished bool
+	busy     time.Duration // Time spent verifying until the last pause
+	resumed  time.Time
+
+	dump    *TuiDump
+	message string
+
+	cmds chan TuiCmd
+	wake chan struct{}
+}
+
+func new_tui(geometry proto.Geometry, title string, start_track byte, end_track byte) *Tui {
+
+	first := geometry.CHSToLBA(start_track, 0, 1)
+
+	return &Tui{
+		geometry:    geometry,
+		title:       title,
+		start_track: start_track,
+		end_track:   end_track,
+		cells:       make([]*SectorResult, geometry.Blocks()),
+		current:     -1,
+		total:       uint(end_track-start_track+1) * uint(geometry.Heads) * uint(geometry.Sectors),
+		cursor:      first,
+		follow:      true,
+		top:         start_track,
+		resumed:     time.Now(),
+		cmds:        make(chan TuiCmd, 8),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Results in LBA order
+func (t *Tui) results() []SectorResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var results []SectorResult
+	for _, r := range t.cells {
+		if r != nil {
+			results = append(results, *r)
+		}
+	}
+	return results
+}
+
+// Time spent verifying, pauses excluded
+func (t *Tui) elapsed() time.Duration {
+	if t.paused || t.finished {
+		return t.busy
+	}
+	return t.busy + time.Since(t.resumed)
+}
+
+// Pause or resume, the lock must be held
+func (t *Tui) set_paused(paused bool) {
+
+	if paused == t.paused || t.finished {
+		return
+	}
+
+	if paused {
+		t.busy += time.Since(t.resumed)
+	} else {
+		t.resumed = time.Now()
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	t.paused = paused
+}
+
+// Pass a request to the verification, the lock must be held
+func (t *Tui) request(kind byte, verb string) {
+
+	track, head, sector := t.geometry.LBAToCHS(t.cursor)
+
+	select {
+	case t.cmds <- TuiCmd{kind: kind, lba: t.cursor}:
+		t.message = fmt.Sprintf("%s %d/%d/%d...", verb, track, head, sector)
+	default:
+		t.message = "Busy, try again"
+	}
+}
+
+// Run a request of the user
+func (t *Tui) run_cmd(ctx context.Context, client *proto.Client, retries uint, against []byte, cmd TuiCmd) {
+
+	track, head, sector := t.geometry.LBAToCHS(cmd.lba)
+
+	switch cmd.kind {
+	case TUI_CMD_RETEST:
+		r := verify_sector(ctx, client, track, head, sector, retries, against)
+		if ctx.Err() != nil {
+			return
+		}
+
+		t.mu.Lock()
+		if t.cells[cmd.lba] == nil {
+			t.done++
+		}
+		t.cells[cmd.lba] = &r
+		t.message = fmt.Sprintf("Re-tested %d/%d/%d: %s", track, head, sector, r.Status)
+		t.mu.Unlock()
+
+	case TUI_CMD_DUMP:
+		data, err := client.ReadSector(ctx, track, head, sector)
+		if ctx.Err() != nil {
+			return
+		}
+
+		t.mu.Lock()
+		t.dump = &TuiDump{lba: cmd.lba, data: data, err: err}
+		t.message = ""
+		t.mu.Unlock()
+	}
+}
+
+// Wait while paused, running requests meanwhile. false if canceled.
+func (t *Tui) wait_running(ctx context.Context, client *proto.Client, retries uint, against []byte) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case cmd := <-t.cmds:
+			t.run_cmd(ctx, client, retries, against, cmd)
+			continue
+		default:
+		}
+
+		t.mu.Lock()
+		paused := t.paused
+		t.mu.Unlock()
+
+		if !paused {
+			return true
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case cmd := <-t.cmds:
+			t.run_cmd(ctx, client, retries, against, cmd)
+		case <-t.wake:
+		}
+	}
+}
+
+// Verify the tracks, then run requests until canceled
+func tui_worker(ctx context.Context, client *proto.Client, t *Tui, retries uint, against []byte) {
+
+	for track := t.start_track; track <= t.end_track; track++ {
+		for head := byte(0); head < t.geometry.Heads; head++ {
+			for sector := byte(1); sector <= t.geometry.Sectors; sector++ {
+
+				if !t.wait_running(ctx, client, retries, against) {
+					return
+				}
+
+				lba := t.geometry.CHSToLBA(track, head, sector)
+
+				t.mu.Lock()
+				t.current = int(lba)
+				t.mu.Unlock()
+
+				r := verify_sector(ctx, client, track, head, sector, retries, against)
+				if ctx.Err() != nil {
+					return
+				}
+
+				t.mu.Lock()
+				if t.cells[lba] == nil {
+					t.done++
+				}
+				t.cells[lba] = &r
+				t.mu.Unlock()
+			}
+		}
+	}
+
+	t.mu.Lock()
+	if !t.paused {
+		t.busy += time.Since(t.resumed)
+	}
+	t.current = -1
+	t.finished = true
+	t.mu.Unlock()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case cmd := <-t.cmds:
+			t.run_cmd(ctx, client, retries, against, cmd)
+		}
+	}
+}
+
+// Split terminal input into keys: arrows and escape are named, other keys
+// are themselves
+func parse_keys(buf []byte) []string {
+
+	var keys []string
+
+	for i := 0; i < len(buf); i++ {
+		if buf[i] == 0x1B && i+2 < len(buf) && buf[i+1] == '[' {
+			switch buf[i+2] {
+			case 'A':
+				keys = append(keys, "up")
+			case 'B':
+				keys = append(keys, "down")
+			case 'C':
+				keys = append(keys, "right")
+			case 'D':
+				keys = append(keys, "left")
+			}
+			i += 2
+			continue
+		}
+
+		switch buf[i] {
+		case 0x1B:
+			keys = append(keys, "esc")
+		case '\r', '\n':
+			keys = append(keys, "enter")
+		default:
+			keys = append(keys, string(buf[i]))
+		}
+	}
+
+	return keys
+}
+
+// Act on a key, true to quit
+func (t *Tui) handle_key(key string) bool {
+
+	if key == "q" || key == "\x03" {
+		return true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Hex dump on screen
+	if t.dump != nil {
+		switch key {
+		case "up", "k":
+			t.dump.scroll = max(t.dump.scroll-1, 0)
+		case "down", "j":
+			t.dump.scroll++
+		case "esc", "enter", "d":
+			t.dump = nil
+		}
+		return false
+	}
+
+	track, head, sector := t.geometry.LBAToCHS(t.cursor)
+	column := int(head)*int(t.geometry.Sectors) + int(sector) - 1
+	columns := int(t.geometry.Heads) * int(t.geometry.Sectors)
+
+	switch key {
+	case "up", "k":
+		if track > t.start_track {
+			track--
+		}
+	case "down", "j":
+		if track < t.end_track {
+			track++
+		}
+	case "left", "h":
+		column = max(column-1, 0)
+	case "right", "l":
+		column = min(column+1, columns-1)
+	case "f":
+		t.follow = true
+	case " ", "p":
+		t.set_paused(!t.paused)
+	case "r":
+		t.request(TUI_CMD_RETEST, "Re-testing")
+	case "d", "enter":
+		t.request(TUI_CMD_DUMP, "Reading")
+	}
+
+	switch key {
+	case "up", "k", "down", "j", "left", "h", "right", "l":
+		t.follow = false
+		head = byte(column / int(t.geometry.Sectors))
+		sector = byte(column%int(t.geometry.Sectors)) + 1
+		t.cursor = t.geometry.CHSToLBA(track, head, sector)
+	}
+
+	return false
+}
+
+func tui_cell(r *SectorResult) string {
+	switch {
+	case r == nil:
+		return FmtCol(".", ColorBlackHI)
+	case r.Status == STATUS_GOOD:
+		return FmtCol("S", ColorGreenHI)
+	case r.Status == STATUS_BAD:
+		return FmtCol("E", ColorRedHI)
+	case r.Status == STATUS_DIFFER:
+		return FmtCol("X", ColorPurpleHI)
+	case r.Tries-1 > 9:
+		return FmtCol("+", ColorYellowHI)
+	default:
+		return FmtCol(fmt.Sprint(r.Tries-1), ColorYellowHI)
+	}
+}
+
+func format_eta(d time.Duration) string {
+	d = d.Round(time.Second)
+	return fmt.Sprintf("%d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
+
+// Draw the screen for a terminal of width by height
+func (t *Tui) render(width int, height int) string {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rows := height - TUI_LINES_ABOVE - TUI_LINES_BELOW
+	grid_width := 4 + int(t.geometry.Heads)*(int(t.geometry.Sectors)+1)
+
+	if rows < 1 || width < grid_width {
+		return TUI_HOME + fmt.Sprintf("Terminal too small, %dx%d needed", grid_width, TUI_LINES_ABOVE+TUI_LINES_BELOW+1) + TUI_CLEAR_LINE + TUI_CLEAR_BELOW
+	}
+
+	var lines []string
+
+	lines = append(lines, FmtCol(t.title, ColorWhiteBold))
+
+	if t.dump != nil {
+		lines = append(lines, t.render_dump(rows+1)...)
+	} else {
+		lines = append(lines, t.render_grid(rows)...)
+	}
+
+	for len(lines) < TUI_LINES_ABOVE+rows {
+		lines = append(lines, "")
+	}
+
+	lines = append(lines, "")
+	lines = append(lines, t.render_status()...)
+
+	return TUI_HOME + strings.Join(lines, TUI_CLEAR_LINE+"\r\n") + TUI_CLEAR_LINE + TUI_CLEAR_BELOW
+}
+
+func (t *Tui) render_grid(rows int) []string {
+
+	sectors := int(t.geometry.Sectors)
+
+	// Keep the cursor, or the sector being read, on screen
+	shown := t.cursor
+	if t.follow && t.current >= 0 {
+		shown = uint(t.current)
+	}
+	track, _, _ := t.geometry.LBAToCHS(shown)
+
+	if track < t.top {
+		t.top = track
+	}
+	if int(track) >= int(t.top)+rows {
+		t.top = byte(int(track) - rows + 1)
+	}
+	t.top = max(t.top, t.start_track)
+
+	header := "    "
+	for head := 0; head < int(t.geometry.Heads); head++ {
+		name := fmt.Sprintf("HEAD %d", head)
+		pad := max(sectors-len(name), 0)
+		header += strings.Repeat(" ", pad/2) + FmtCol(name, ColorWhiteBold) + strings.Repeat(" ", pad-pad/2+1)
+	}
+
+	lines := []string{header}
+
+	for row := 0; row < rows && int(t.top)+row <= int(t.end_track); row++ {
+		track := t.top + byte(row)
+
+		var line strings.Builder
+		fmt.Fprintf(&line, "%3d ", track)
+
+		for head := byte(0); head < t.geometry.Heads; head++ {
+			for sector := byte(1); sector <= t.geometry.Sectors; sector++ {
+				lba := t.geometry.CHSToLBA(track, head, sector)
+				cell := tui_cell(t.cells[lba])
+
+				if int(lba) == t.current {
+					cell = FmtCol("*", ColorCyanHI)
+				}
+				if lba == t.cursor {
+					cell = TUI_REVERSE + cell
+				}
+
+				line.WriteString(cell)
+			}
+			line.WriteByte(' ')
+		}
+
+		lines = append(lines, line.String())
+	}
+
+	return lines
+}
+
+func (t *Tui) render_dump(rows int) []string {
+
+	track, head, sector := t.geometry.LBAToCHS(t.dump.lba)
+	title := fmt.Sprintf("Sector %d/%d/%d, LBA %d", track, head, sector, t.dump.lba)
+
+	if t.dump.err != nil {
+		title += FmtCol(fmt.Sprintf(" (%s)", t.dump.err), ColorRedHI)
+	}
+
+	lines := []string{title}
+
+	dump := hex_dump(t.dump.data)
+	t.dump.scroll = max(min(t.dump.scroll, len(dump)-(rows-1)), 0)
+
+	for i := t.dump.scroll; i < len(dump) && len(lines) < rows; i++ {
+		lines = append(lines, dump[i])
+	}
+
+	return lines
+}
+
+func (t *Tui) render_status() []string {
+
+	var good, degraded, bad, differ uint
+	for _, r := range t.cells {
+		if r == nil {
+			continue
+		}
+		switch r.Status {
+		case STATUS_GOOD:
+			good++
+		case STATUS_DEGRADED:
+			degraded++
+		case STATUS_BAD:
+			bad++
+		case STATUS_DIFFER:
+			differ++
+		}
+	}
+
+	// Progress
+	elapsed := t.elapsed().Seconds()
+	progress := fmt.Sprintf("%d/%d sectors %5.1f%%", t.done, t.total, 100*float64(t.done)/float64(t.total))
+
+	if elapsed > 0 && t.done > 0 {
+		rate := float64(t.done) / elapsed
+		progress += fmt.Sprintf("  %.1f sectors/s  %.1f KB/s", rate, rate*float64(SECTOR_SIZE)/1024)
+
+		if !t.finished {
+			progress += "  ETA " + format_eta(time.Duration(float64(t.total-t.done)/rate*float64(time.Second)))
+		}
+	}
+
+	switch {
+	case t.finished:
+		progress += "  " + FmtCol("DONE", ColorGreenHI)
+	case t.paused:
+		progress += "  " + FmtCol("PAUSED", ColorYellowHI)
+	case t.current >= 0:
+		track, head, sector := t.geometry.LBAToCHS(uint(t.current))
+		progress = fmt.Sprintf("Reading %d/%d/%d  ", track, head, sector) + progress
+	}
+
+	counts := fmt.Sprintf("%s good %d  %s degraded %d  %s bad %d", FmtCol("S", ColorGreenHI), good, FmtCol("1", ColorYellowHI), degraded, FmtCol("E", ColorRedHI), bad)
+	if differ > 0 {
+		counts += fmt.Sprintf("  %s differ %d", FmtCol("X", ColorPurpleHI), differ)
+	}
+
+	// Selected cell
+	track, head, sector := t.geometry.LBAToCHS(t.cursor)
+	cursor := fmt.Sprintf("Cursor %d/%d/%d, LBA %d: ", track, head, sector, t.cursor)
+
+	if r := t.cells[t.cursor]; r != nil {
+		cursor += fmt.Sprintf("%s, %d reads, %.1f ms", r.Status, r.Tries, r.TimeMs)
+		if r.Error != "" {
+			cursor += ", error " + r.Error
+		}
+	} else {
+		cursor += "not verified"
+	}
+
+	help := t.message
+	if help == "" {
+		help = "arrows/hjkl move  f follow  space pause  r re-test  d dump  q quit"
+		if t.dump != nil {
+			help = "up/down scroll  esc close  q quit"
+		}
+	}
+
+	return []string{progress, counts, cursor, FmtCol(help, ColorBlackHI)}
+}
+
+// Verify tracks in a full screen interface until the user quits. Returns
+// the results so far.
+func run_tui(ctx context.Context, client *proto.Client, title string, first byte, last byte, max_retries OptionalUint, against []byte) ([]SectorResult, error) {
+
+	in, out := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+
+	if !term.IsTerminal(in) || !term.IsTerminal(out) {
+		return nil, fmt.Errorf("not a terminal")
+	}
+
+	state, err := term.MakeRaw(in)
+	if err != nil {
+		return nil, err
+	}
+	defer term.Restore(in, state)
+
+	fmt.Print(TUI_ENTER)
+	defer fmt.Print(TUI_LEAVE)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	t := new_tui(client.Geometry(), title, first, last)
+
+	done := make(chan struct{})
+	go func() {
+		tui_worker(ctx, client, t, max_retries.value, against)
+		close(done)
+	}()
+
+	keys := make(chan []byte)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- append([]byte{}, buf[:n]...)
+		}
+	}()
+
+	ticker := time.NewTicker(TUI_REFRESH)
+	defer ticker.Stop()
+
+	for {
+		width, height, err := term.GetSize(out)
+		if err != nil {
+			width, height = 80, 24
+		}
+		fmt.Print(t.render(width, height))
+
+		select {
+		case buf, ok := <-keys:
+			if !ok {
+				cancel()
+				<-done
+				return t.results(), nil
+			}
+			for _, key := range parse_keys(buf) {
+				if t.handle_key(key) {
+					cancel()
+					<-done
+					return t.results(), nil
+				}
+			}
+		case <-ticker.C:
+		case <-done:
+			return t.results(), ctx.Err()
+		}
+	}
+}
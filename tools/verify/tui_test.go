@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+func TestParseKeys(t *testing.T) {
+	keys := parse_keys([]byte("j\x1b[A\x1b[Dr \x1b\rq"))
+	want := []string{"j", "up", "left", "r", " ", "esc", "enter", "q"}
+
+	if !slices.Equal(keys, want) {
+		t.Errorf("parse_keys = %q, want %q", keys, want)
+	}
+}
+
+func TestTuiKeys(t *testing.T) {
+	ui := new_tui(proto.FORMAT_720K, "test", 2, 5)
+
+	// Cursor stays in the tracks verified and wraps to the other head
+	for _, key := range []string{"k", "left", "l", "l", "l", "l", "l", "l", "l", "l", "l", "down", "j"} {
+		if ui.handle_key(key) {
+			t.Fatalf("%s quits", key)
+		}
+	}
+
+	if c, h, s := ui.geometry.LBAToCHS(ui.cursor); c != 4 || h != 1 || s != 1 || ui.follow {
+		t.Errorf("cursor at %d/%d/%d, follow %t", c, h, s, ui.follow)
+	}
+
+	ui.handle_key(" ")
+	if !ui.paused {
+		t.Errorf("not paused")
+	}
+	ui.handle_key("r")
+	if cmd := <-ui.cmds; cmd.kind != TUI_CMD_RETEST || cmd.lba != ui.cursor {
+		t.Errorf("request %+v", cmd)
+	}
+
+	if !ui.handle_key("q") {
+		t.Errorf("q doesn't quit")
+	}
+}
+
+func TestTuiRender(t *testing.T) {
+	ui := new_tui(proto.FORMAT_1440K, "test title", 0, 79)
+
+	ui.cells[0] = &SectorResult{LBA: 0, Status: STATUS_GOOD, Tries: 1, TimeMs: 12}
+	ui.cells[1] = &SectorResult{LBA: 1, Status: STATUS_BAD, Tries: 1, Error: proto.ERROR_KIND_CRC, TimeMs: 30}
+	ui.done = 2
+	ui.current = 2
+
+	screen := ui.render(80, 24)
+	lines := strings.Split(screen, "\r\n")
+
+	if len(lines) != 24 {
+		t.Errorf("%d lines, want 24", len(lines))
+	}
+	for _, want := range []string{"test title", "HEAD 1", "2/2880 sectors", "Reading 0/0/3", "good 1", "bad 1", "Cursor 0/0/1, LBA 0: good, 1 reads"} {
+		if !strings.Contains(screen, want) {
+			t.Errorf("screen lacks %q", want)
+		}
+	}
+
+	// Grid scrolls to the sector being read
+	ui.current = int(proto.FORMAT_1440K.CHSToLBA(60, 0, 1))
+	if screen := ui.render(80, 24); !strings.Contains(screen, " 60 ") || strings.Contains(screen, "\r\n  0 ") {
+		t.Errorf("grid not scrolled")
+	}
+
+	if screen := ui.render(30, 24); !strings.Contains(screen, "Terminal too small") {
+		t.Errorf("no message on a small terminal")
+	}
+}
+
+func wait_for(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for start := time.Now(); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+func TestTuiWorker(t *testing.T) {
+	client := emulatortest.StartClient(t, nil, proto.FORMAT_1440K, test_profile())
+	ui := new_tui(client.Geometry(), "test", 1, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	// Nothing is read while paused
+	ui.set_paused(true)
+	go func() {
+		tui_worker(ctx, client, ui, 0, nil)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if len(ui.results()) != 0 {
+		t.Fatal("sectors verified while paused")
+	}
+
+	ui.mu.Lock()
+	ui.set_paused(false)
+	ui.mu.Unlock()
+
+	locked := func(f func() bool) func() bool {
+		return func() bool {
+			ui.mu.Lock()
+			defer ui.mu.Unlock()
+			return f()
+		}
+	}
+	wait_for(t, "verification", locked(func() bool { return ui.finished }))
+
+	// 2/1/1 fails twice, then reads
+	lba := client.Geometry().CHSToLBA(2, 1, 1)
+	if r := ui.cells[lba]; r == nil || r.Status != STATUS_BAD {
+		t.Fatalf("2/1/1 = %+v", r)
+	}
+	if ui.done != 72 || len(ui.results()) != 72 {
+		t.Errorf("%d sectors done", ui.done)
+	}
+
+	for i := 0; i < 2; i++ {
+		ui.cmds <- TuiCmd{kind: TUI_CMD_RETEST, lba: lba}
+	}
+	wait_for(t, "re-test", locked(func() bool { return ui.cells[lba].Status == STATUS_GOOD }))
+
+	// Sector with a CRC error is dumped anyway
+	ui.cmds <- TuiCmd{kind: TUI_CMD_DUMP, lba: client.Geometry().CHSToLBA(1, 0, 5)}
+	wait_for(t, "dump", locked(func() bool { return ui.dump != nil }))
+
+	if len(ui.dump.data) != int(SECTOR_SIZE) || ui.dump.err == nil {
+		t.Errorf("dump of %d bytes, error %v", len(ui.dump.data), ui.dump.err)
+	}
+
+	cancel()
+	<-done
+}
@@ -1,362 +1,227 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
-	"github.com/albenik/go-serial"
+	"floppy_arduino/proto"
 )
 
-const BAUD_RATE int = 115200
+const SECTOR_SIZE uint = proto.SECTOR_SIZE
 
-const READ_TIMEOUT time.Duration = 1000 * time.Millisecond
-const READ_TIMEOUT_OP time.Duration = 5000 * time.Millisecond
+func print_table_header(geometry proto.Geometry) {
 
-// Serial commands
-const CMD_ACK byte = 'A'
-const CMD_ERROR byte = 'E'
-const CMD_OK byte = 'O'
-const CMD_READ_SECTOR byte = 'R'
-const CMD_HANDSHAKE byte = 'H'
-const CMD_INITIALIZE byte = 'I'
+	sectorspace := int(geometry.Sectors) * 3
 
-const TRACKS byte = 80
-const HEADS byte = 2
-const SECTORS byte = 18
-const SECTOR_SIZE int = 512
-
-// Serial communication
-func write_byte(port serial.Port, data byte) error {
-	buf := []byte{data}
-
-	n := 0
-	var err error
-
-	for n == 0 {
-		n, err = port.Write(buf)
-
-		if err != nil {
-			return err
+	fmt.Println()
+	fmt.Print("   ")
+	for head := byte(0); head < geometry.Heads; head++ {
+		for space := 0; space < (sectorspace-6)/2; space++ {
+			fmt.Print(" ")
+		}
+		PrtCol(fmt.Sprintf("HEAD %d", head), ColorWhiteBold)
+		for space := 0; space < (sectorspace-6)/2; space++ {
+			fmt.Print(" ")
 		}
 	}
-
-	return nil
-}
-
-func read_byte(port serial.Port, timeout time.Duration) (byte, error) {
-	// Read buffer of 1 byte
-	buf := make([]byte, 1)
-
-	n := 0
-	// var err error
-
-	start := time.Now()
-
-	for n <= 0 {
-		port.SetReadTimeout(10)
-		n, _ = port.Read(buf)
-
-		// if err != nil {
-		// 	port.SetReadTimeout(-1)
-		// 	return 0, err
-		// }
-
-		if time.Since(start) > timeout {
-			port.SetReadTimeout(-1)
-			return 0, errors.New("timeout error")
+	fmt.Println()
+	fmt.Print("   ")
+	for head := byte(0); head < geometry.Heads; head++ {
+		for sector := byte(1); sector <= geometry.Sectors; sector++ {
+			fmt.Printf("%3d", sector)
 		}
 	}
-
-	port.SetReadTimeout(-1)
-	return buf[0], nil
+	fmt.Println()
 }
 
-func read_bytes(port serial.Port, n_bytes int, timeout time.Duration) ([]byte, error) {
-	// Read buffer of n bytes
-	buf := make([]byte, n_bytes)
-
-	n := 0
-	// var err error
-	var read int
+// Read a sector, retrying up to retries times. Also returns how long each
+// read took.
+func verify_sector_retries(ctx context.Context, client *proto.Client, cylinder byte, head byte, sector byte, retries uint) ([]byte, uint, []time.Duration, error) {
 
-	start := time.Now()
+	var data []byte
+	var err error
+	var times []time.Duration
 
-	for n < n_bytes {
-		port.SetReadTimeout(10)
-		read, _ = port.Read(buf[n:])
+	tries := uint(0)
 
-		// if err != nil {
-		// 	port.SetReadTimeout(-1)
-		// 	return []byte{}, err
-		// }
+	for tries <= retries {
+		started := time.Now()
+		data, err = client.ReadSector(ctx, cylinder, head, sector)
+		times = append(times, time.Since(started))
 
-		if time.Since(start) > timeout {
-			port.SetReadTimeout(-1)
-			return []byte{}, errors.New("timeout error")
+		if err == nil {
+			return data, tries, times, nil
 		}
 
-		n += read
-	}
-
-	port.SetReadTimeout(-1)
-	return buf, nil
-}
-
-func do_handshake(port serial.Port) error {
-
-	// Send handshake
-	write_byte(port, CMD_HANDSHAKE)
-
-	// Expect handshake back
-	res, err := read_byte(port, READ_TIMEOUT)
-
-	if err != nil {
-		// fmt.Printf("Read error: %s\n", err)
-		return err
-	}
-
-	if res != CMD_HANDSHAKE {
-		// fmt.Printf("Invalid handshake response: %c\n", res)
-		return errors.New("invalid handshake response")
+		tries++
 	}
 
-	return nil
+	return nil, tries, times, err
 }
 
-func connect_and_handshake(name string) (serial.Port, error) {
+// Tracks to verify, the whole disk by default. Both must be on the disk.
+func track_range(geometry proto.Geometry, start_track OptionalByte, end_track OptionalByte) (byte, byte, error) {
 
-	mode := &serial.Mode{
-		BaudRate: BAUD_RATE,
+	if !start_track.has_value {
+		start_track.value = 0
 	}
-
-	// Try to open port
-	port, err := serial.Open(name, mode)
-
-	if err != nil {
-		return nil, err
+	if !end_track.has_value {
+		end_track.value = geometry.Tracks - 1
 	}
 
-	// Wait for Arduino to reset
-	time.Sleep(2000 * time.Millisecond)
-
-	// Clear any stuff still in input buffer
-	port.ResetInputBuffer()
-
-	// Perform handshake on port
-	err = do_handshake(port)
-
-	if err != nil {
-		// fmt.Printf("Handshake failed: %s\n", err)
-		port.Close()
-		return nil, err
+	switch {
+	case start_track.value >= geometry.Tracks:
+		return 0, 0, fmt.Errorf("start track %d is past the last track %d of a %s disk", start_track.value, geometry.Tracks-1, geometry.Name)
+	case end_track.value >= geometry.Tracks:
+		return 0, 0, fmt.Errorf("end track %d is past the last track %d of a %s disk", end_track.value, geometry.Tracks-1, geometry.Name)
+	case start_track.value > end_track.value:
+		return 0, 0, fmt.Errorf("start track %d is after end track %d", start_track.value, end_track.value)
 	}
 
-	return port, nil
+	return start_track.value, end_track.value, nil
 }
 
-func find_arduino() (serial.Port, string, error) {
+// Verify a sector, comparing it with against if not nil
+func verify_sector(ctx context.Context, client *proto.Client, track byte, head byte, sector byte, retries uint, against []byte) SectorResult {
 
-	// Get serial ports list
-	port_names, err := serial.GetPortsList()
+	lba := client.Geometry().CHSToLBA(track, head, sector)
 
-	if err != nil {
-		return nil, "", err
-	}
+	data, tries, times, err := verify_sector_retries(ctx, client, track, head, sector, retries)
 
-	// If there are no ports available
-	if len(port_names) == 0 {
-		return nil, "", errors.New("no serial ports available")
+	r := SectorResult{
+		Track:  track,
+		Head:   head,
+		Sector: sector,
+		LBA:    lba,
+		Tries:  uint(len(times)),
 	}
 
-	// Repeat for each available port
-	for _, name := range port_names {
-
-		// Try to handhsake with device at this port
-		port, err := connect_and_handshake(name)
-
-		// If handshake succesful, use this port
-		if err == nil {
-			return port, name, nil
-		}
+	for _, t := range times {
+		ms := float64(t.Microseconds()) / 1000
+		r.ReadMs = append(r.ReadMs, ms)
+		r.TimeMs += ms
+	}
 
-		// fmt.Println(err)
+	switch {
+	case err != nil:
+		r.Status = STATUS_BAD
+		r.Error = proto.ErrorKind(err)
+	case against != nil && !bytes.Equal(data, against[lba*SECTOR_SIZE:(lba+1)*SECTOR_SIZE]):
+		r.Status = STATUS_DIFFER
+	case tries == 0:
+		r.Status = STATUS_GOOD
+	default:
+		r.Status = STATUS_DEGRADED
 	}
-	return nil, "", errors.New("unable to find Arduino")
 
+	return r
 }
 
-func do_initialize(port serial.Port) error {
-
-	// Send initialization command
-	write_byte(port, CMD_INITIALIZE)
-
-	var res byte
-	var err error
-
-	// Wait for acknowledgement
-	res, err = read_byte(port, READ_TIMEOUT)
-
-	if err != nil {
-		return err
-	}
+// Verify tracks start_track to end_track, printing a table of the sectors.
+// With an image, sectors are also compared to it: good and degraded
+// sectors match, readable ones that don't have status differ.
+// With heatmap, cells show how long reads took instead.
+func do_verify(ctx context.Context, client *proto.Client, first byte, last byte, max_retries OptionalUint, against []byte, heatmap bool) []SectorResult {
 
-	if res != CMD_ACK {
-		return errors.New("init no ACK")
-	}
+	var track byte
+	var head byte
+	var sector byte
 
-	// Wait for result
-	res, err = read_byte(port, READ_TIMEOUT_OP)
+	var results []SectorResult
 
-	if err != nil {
-		return err
-	}
+	geometry := client.Geometry()
 
-	if res != CMD_OK {
-		return errors.New("initialization error")
+	if !heatmap {
+		print_table_header(geometry)
 	}
 
-	return nil
-}
-
-func do_read_sector(port serial.Port, cylinder byte, head byte, sector byte) ([]byte, error) {
-
-	var res byte
-	var err error
-
-	// Send read sector command
-	write_byte(port, CMD_READ_SECTOR)
-	write_byte(port, cylinder)
-	write_byte(port, head)
-	write_byte(port, sector)
+	for track = first; track <= last; track++ {
 
-	// Expect ACK
-	res, err = read_byte(port, READ_TIMEOUT)
+		if heatmap {
+			// The colours need the median read time of the whole pass, so
+			// the map is only printed after it
+			fmt.Printf("\rReading track %d/%d", track, last)
+		} else {
+			fmt.Printf("%-2d ", track)
+		}
 
-	if err != nil {
-		return []byte{}, err
-	}
+		for head = 0; head < geometry.Heads; head++ {
+			for sector = 1; sector <= geometry.Sectors; sector++ {
 
-	if res != CMD_ACK {
-		return []byte{}, errors.New("no ACK")
-	}
+				r := verify_sector(ctx, client, track, head, sector, max_retries.value, against)
 
-	// Read result
-	res, err = read_byte(port, READ_TIMEOUT_OP)
+				results = append(results, r)
 
-	if err != nil {
-		return []byte{}, err
-	}
+				if !heatmap {
+					print_cell(r)
+				}
+			}
+		}
 
-	if res != CMD_OK {
-		return []byte{}, errors.New("floppy read error")
+		if !heatmap {
+			fmt.Println()
+		}
 	}
 
-	// If result is OK, read data
-	var buf []byte
-	buf, err = read_bytes(port, SECTOR_SIZE, READ_TIMEOUT)
-
-	if err != nil {
-		return []byte{}, err
+	if heatmap {
+		fmt.Println()
+		print_heat_table(geometry, results)
 	}
 
-	return buf, nil
+	return results
 }
 
-func print_table_header() {
-
-	sectorspace := int(SECTORS) * 3
-
-	fmt.Println()
-	fmt.Print("   ")
-	for head := byte(0); head < HEADS; head++ {
-		for space := 0; space < (sectorspace-6)/2; space++ {
-			fmt.Print(" ")
-		}
-		PrtCol(fmt.Sprintf("HEAD %d", head), ColorWhiteBold)
-		for space := 0; space < (sectorspace-6)/2; space++ {
-			fmt.Print(" ")
-		}
-	}
-	fmt.Println()
-	fmt.Print("   ")
-	for head := byte(0); head < HEADS; head++ {
-		for sector := byte(1); sector <= SECTORS; sector++ {
-			fmt.Printf("%3d", sector)
-		}
+func print_cell(r SectorResult) {
+	switch r.Status {
+	case STATUS_BAD:
+		PrtCol(" E ", ColorBgRed)
+	case STATUS_DIFFER:
+		PrtCol(" X ", ColorBgPurple)
+	case STATUS_GOOD:
+		PrtCol(" S ", ColorBgGreen)
+	default:
+		PrtCol(fmt.Sprintf("%3d", r.Tries-1), ColorBgYellow)
 	}
-	fmt.Println()
 }
 
-func verify_sector_retries(port serial.Port, cylinder byte, head byte, sector byte, retries uint) (uint, error) {
-
-	var err error
-
-	tries := uint(0)
-
-	for tries <= retries {
-		_, err = do_read_sector(port, cylinder, head, sector)
-
-		if err == nil {
-			return tries, nil
+// LBAs of the sectors with a status
+func sectors_with(results []SectorResult, status string) []uint {
+	var lbas []uint
+	for _, r := range results {
+		if r.Status == status {
+			lbas = append(lbas, r.LBA)
 		}
-
-		tries++
 	}
-
-	return tries, err
+	return lbas
 }
 
-func do_verify(port serial.Port, start_track OptionalByte, end_track OptionalByte, max_retries OptionalUint) (uint, uint, uint) {
-
-	var track byte
-	var head byte
-	var sector byte
-
-	good := uint(0)
-	bad := uint(0)
-	degraded := uint(0)
+// Join consecutive LBAs into ranges, e.g. "40-42, 100"
+func format_ranges(lbas []uint) string {
 
-	if !start_track.has_value {
-		start_track.value = 0
-	}
-	if !end_track.has_value {
-		end_track.value = TRACKS - 1
-	}
-
-	print_table_header()
-
-	for track = start_track.value; track <= end_track.value; track++ {
-
-		fmt.Printf("%-2d ", track)
+	var ranges []string
 
-		for head = 0; head < HEADS; head++ {
-			for sector = 1; sector <= SECTORS; sector++ {
-
-				tries, err := verify_sector_retries(port, track, head, sector, max_retries.value)
-
-				if err != nil {
-					PrtCol(" E ", ColorBgRed)
-					bad++
-				} else {
-					if tries == 0 {
-						PrtCol(" S ", ColorBgGreen)
-						good++
-					} else {
-						PrtCol(fmt.Sprintf("%3d", tries), ColorBgYellow)
-						degraded++
-					}
-				}
+	for i := 0; i < len(lbas); {
+		j := i
+		for j+1 < len(lbas) && lbas[j+1] == lbas[j]+1 {
+			j++
+		}
 
-			}
+		if i == j {
+			ranges = append(ranges, fmt.Sprint(lbas[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", lbas[i], lbas[j]))
 		}
 
-		fmt.Println()
+		i = j + 1
 	}
 
-	return good, bad, degraded
+	return strings.Join(ranges, ", ")
 }
 
 func main() {
@@ -372,14 +237,40 @@ func main() {
 		os.Exit(0)
 	}
 
+	// History of a disk, no drive needed
+	if conf.history_disk.has_value {
+		entries, err := load_history(conf.history.value, conf.history_disk.value)
+
+		if err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("unable to read history %s: %s\n", conf.history.value, err)
+			os.Exit(1)
+		}
+
+		if len(entries) == 0 {
+			fmt.Printf("No verification of disk %s in %s\n", conf.history_disk.value, conf.history.value)
+			os.Exit(1)
+		}
+
+		show_history(entries)
+		os.Exit(0)
+	}
+
+	// Records go to stdout, the table and messages to stderr
+	records := os.Stdout
+	if conf.output.has_value {
+		os.Stdout = os.Stderr
+	}
+
 	var err error
-	var port serial.Port
-	var name string
+	var client *proto.Client
+
+	ctx := context.Background()
 
 	// Find serial port
 	if !conf.device.has_value {
 		fmt.Println("Trying to find Arduino...")
-		port, name, err = find_arduino()
+		client, err = proto.Find(ctx, proto.RESET_DELAY)
 		if err != nil {
 			PrtCol("Error: ", ColorRedHI)
 			fmt.Println("unable to find Arduino")
@@ -387,17 +278,16 @@ func main() {
 		}
 	} else {
 		fmt.Println("Connecting to Arduino...")
-		port, err = connect_and_handshake(conf.device.value)
+		client, err = proto.Open(ctx, conf.device.value, proto.RESET_DELAY)
 		if err != nil {
 			PrtCol("Error: ", ColorRedHI)
 			fmt.Printf("unable to connect to Arduino on port %s: %s\n", conf.device.value, err)
 			os.Exit(1)
 		}
-		name = conf.device.value
 	}
 
 	PrtCol("Connected ", ColorGreenHI)
-	fmt.Printf("on port %s\n", name)
+	fmt.Printf("on port %s\n", client.Name())
 
 	// CTRL-C handler
 	c := make(chan os.Signal, 1)
@@ -405,7 +295,7 @@ func main() {
 	go func() {
 		for sig := range c {
 			if sig != nil {
-				port.Close()
+				client.Close()
 				fmt.Println("Exiting...")
 				os.Exit(0)
 			}
@@ -413,31 +303,232 @@ func main() {
 	}()
 
 	// Initialize drive
-	err = do_initialize(port)
+	err = client.Initialize(ctx)
 
 	if err != nil {
 		PrtCol("Error: ", ColorRedHI)
 		fmt.Println("drive initalization failed!")
-		port.Close()
+		client.Close()
 		os.Exit(2)
 	}
 
+	// Disk format, detected unless given
+	if conf.format.has_value {
+		client.SetGeometry(conf.format.value)
+	} else {
+		geometry, from_bpb, err := client.DetectFormat(ctx)
+
+		if err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("unable to detect disk format: %s, try --format\n", err)
+			client.Close()
+			os.Exit(2)
+		}
+
+		client.SetGeometry(geometry)
+
+		if from_bpb {
+			fmt.Printf("Detected %s disk from boot sector\n", geometry)
+		} else {
+			fmt.Printf("Detected %s disk from sectors on track 0\n", geometry)
+		}
+	}
+
+	// Sectors in hex instead of verification
+	if conf.dump.has_value {
+		first, last, err := conf.dump.value.resolve(client.Geometry())
+
+		if err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("unable to dump: %s\n", err)
+			client.Close()
+			os.Exit(1)
+		}
+
+		ok, err := do_dump(ctx, client, first, last, conf.max_retries.value, conf.decode.value)
+		client.Close()
+
+		if err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("unable to decode sectors as %s: %s\n", conf.decode.value, err)
+			os.Exit(1)
+		}
+
+		if !ok {
+			os.Exit(3)
+		}
+		os.Exit(0)
+	}
+
+	// Tracks to verify, or to analyze the rotation of
+	first, last, err := track_range(client.Geometry(), conf.start_track, conf.end_track)
+
+	if err != nil {
+		PrtCol("Error: ", ColorRedHI)
+		fmt.Println(err)
+		client.Close()
+		os.Exit(1)
+	}
+
+	// Disk rotation instead of verification
+	if conf.analyze_rotation {
+		track := first
+
+		fmt.Println("Analyzing rotation...")
+		rotation, err := client.AnalyzeRotation(ctx, track, 0)
+		client.Close()
+
+		if err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("rotation analysis of track %d failed: %s\n", track, err)
+			os.Exit(3)
+		}
+
+		print_rotation(track, rotation)
+		os.Exit(0)
+	}
+
+	// Image to compare the disk with
+	var against []byte
+
+	if conf.against.has_value {
+		against, err = os.ReadFile(conf.against.value)
+
+		if err == nil && uint(len(against)) != client.Geometry().Size() {
+			err = fmt.Errorf("%d bytes, a %s disk holds %d", len(against), client.Geometry().Name, client.Geometry().Size())
+		}
+
+		if err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("unable to use image %s: %s\n", conf.against.value, err)
+			client.Close()
+			os.Exit(1)
+		}
+	}
+
+	// Disk identity, for the history
+	disk, label := conf.disk_id.value, ""
+
+	if !conf.disk_id.has_value {
+		boot, _, _, err := verify_sector_retries(ctx, client, 0, 0, 1, conf.max_retries.value)
+
+		if err == nil {
+			disk, label = disk_identity(boot)
+			fmt.Printf("Disk %s", disk)
+			if label != "" {
+				fmt.Printf(" (%s)", label)
+			}
+			fmt.Println()
+		}
+	}
+
 	// Do disk verification
 	fmt.Println("Veifying disk...")
-	good, bad, degraded := do_verify(port, conf.start_track, conf.end_track, conf.max_retries)
+	started := time.Now()
+
+	var results []SectorResult
+
+	if conf.tui {
+		title := fmt.Sprintf("verify  %s disk", client.Geometry().Name)
+		if disk != "" {
+			title += " " + disk
+		}
+		if label != "" {
+			title += fmt.Sprintf(" (%s)", label)
+		}
+		title += " on " + client.Name()
+
+		results, err = run_tui(ctx, client, title, first, last, conf.max_retries, against)
+
+		if err != nil && !errors.Is(err, context.Canceled) {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("unable to start the full screen interface: %s\n", err)
+			client.Close()
+			os.Exit(1)
+		}
+	} else {
+		results = do_verify(ctx, client, first, last, conf.max_retries, against, conf.heatmap)
+	}
+
+	summary := summarize(results, conf.max_retries.value)
+	summary.Disk = disk
+	summary.Label = label
+	summary.Format = client.Geometry().Name
+	summary.Started = started
+	summary.Finished = time.Now()
+
+	if len(results) > 0 {
+		summary.StartTrack = results[0].Track
+		summary.EndTrack = results[len(results)-1].Track
+	}
+
+	client.Close()
 
 	PrtCol("Done!\n", ColorGreenHI)
-	fmt.Printf("%d sectors ", good)
+	fmt.Printf("%d sectors ", summary.Good)
 	PrtCol("good", ColorGreenHI)
-	fmt.Printf(", %d sectors ", bad)
+	fmt.Printf(", %d sectors ", summary.Bad)
 	PrtCol("bad", ColorRedHI)
 
 	if conf.max_retries.value > 0 {
-		fmt.Printf(", %d sectors ", degraded)
+		fmt.Printf(", %d sectors ", summary.Degraded)
 		PrtCol("degraded", ColorYellowHI)
 	}
 
+	if against != nil {
+		fmt.Printf(", %d sectors ", summary.Differ)
+		PrtCol("differ", ColorPurpleHI)
+	}
+
 	fmt.Println()
+	fmt.Printf("Health score: %.1f\n", summary.Score)
+
+	if against != nil && summary.Differ > 0 {
+		fmt.Printf("Sectors differing from %s: %s\n", conf.against.value, format_ranges(sectors_with(results, STATUS_DIFFER)))
+	}
 
-	port.Close()
+	// Keep track of the disk over time
+	if disk == "" {
+		fmt.Println("Disk not identified, not added to the history: use --disk-id")
+	} else if !conf.no_history {
+		if err := append_history(conf.history.value, new_history_entry(summary, results, client.Geometry().Blocks())); err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("unable to write history %s: %s\n", conf.history.value, err)
+		}
+	}
+
+	if conf.heatmap_out.has_value {
+		if err := save_heatmap(conf.heatmap_out.value, client.Geometry(), results); err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("unable to write heatmap %s: %s\n", conf.heatmap_out.value, err)
+		} else {
+			fmt.Printf("Heatmap written to %s\n", conf.heatmap_out.value)
+		}
+	}
+
+	if conf.output.has_value {
+		var err error
+
+		switch conf.output.value {
+		case OUTPUT_JSON:
+			err = write_json(records, summary, results)
+		case OUTPUT_CSV:
+			// Anything after the rows would break CSV readers, the summary
+			// goes with the messages
+			if err = write_csv(records, results); err == nil {
+				err = write_summary(os.Stdout, summary)
+			}
+		}
+
+		if err != nil {
+			PrtCol("Error: ", ColorRedHI)
+			fmt.Printf("unable to write results: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Not a faithful copy
+	if against != nil && (summary.Differ > 0 || summary.Bad > 0) {
+		os.Exit(3)
+	}
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	"floppy_arduino/proto"
+	"floppy_arduino/proto/emulator"
+	"floppy_arduino/proto/emulator/emulatortest"
+)
+
+func sector_error(c, h, s byte, ec emulator.FloppyError, fail_count uint) emulator.SectorFault {
+	return emulator.SectorFault{CHS: &[3]byte{c, h, s}, Error: &ec, FailCount: fail_count}
+}
+
+func test_profile() *emulator.Profile {
+	return &emulator.Profile{
+		Sectors: []emulator.SectorFault{
+			sector_error(1, 0, 5, emulator.CRC, 0),
+			sector_error(2, 1, 1, emulator.SECTOR_NOT_FOUND, 2),
+			sector_error(2, 1, 2, emulator.CRC, 1),
+			sector_error(5, 0, 1, emulator.CRC, 0),
+		},
+	}
+}
+
+func check_counts(t *testing.T, good, bad, degraded, want_good, want_bad, want_degraded uint) {
+	t.Helper()
+
+	if good != want_good || bad != want_bad || degraded != want_degraded {
+		t.Errorf("good/bad/degraded = %d/%d/%d, want %d/%d/%d", good, bad, degraded, want_good, want_bad, want_degraded)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	client := emulatortest.StartClient(t, nil, proto.FORMAT_1440K, nil)
+
+	results := do_verify(context.Background(), client, 0, client.Geometry().Tracks-1, OptionalUint{value: 0}, nil, false)
+	s := summarize(results, 0)
+
+	check_counts(t, s.Good, s.Bad, s.Degraded, proto.FORMAT_1440K.Blocks(), 0, 0)
+}
+
+func TestVerifyFormat(t *testing.T) {
+	for _, format := range []proto.Geometry{proto.FORMAT_360K, proto.FORMAT_2880K} {
+		client := emulatortest.StartClient(t, nil, format, nil)
+
+		results := do_verify(context.Background(), client, 0, client.Geometry().Tracks-1, OptionalUint{value: 0}, nil, false)
+		s := summarize(results, 0)
+
+		check_counts(t, s.Good, s.Bad, s.Degraded, format.Blocks(), 0, 0)
+	}
+}
+
+func TestTrackRange(t *testing.T) {
+	track := func(value byte) OptionalByte { return OptionalByte{value: value, has_value: true} }
+
+	tests := []struct {
+		start, end  OptionalByte
+		first, last byte
+	}{
+		{OptionalByte{}, OptionalByte{}, 0, 39},
+		{track(10), OptionalByte{}, 10, 39},
+		{OptionalByte{}, track(5), 0, 5},
+		{track(39), track(39), 39, 39},
+	}
+
+	for _, test := range tests {
+		first, last, err := track_range(proto.FORMAT_360K, test.start, test.end)
+		if err != nil || first != test.first || last != test.last {
+			t.Errorf("%v-%v = %d-%d, %v, want %d-%d", test.start, test.end, first, last, err, test.first, test.last)
+		}
+	}
+
+	// Past the end of a 360K disk, or backwards
+	for _, bad := range [][2]OptionalByte{{track(50), OptionalByte{}}, {track(40), track(45)}, {OptionalByte{}, track(79)}, {track(6), track(5)}, {track(255), OptionalByte{}}} {
+		if _, _, err := track_range(proto.FORMAT_360K, bad[0], bad[1]); err == nil {
+			t.Errorf("%v-%v accepted", bad[0], bad[1])
+		}
+	}
+}
+
+func TestVerifyTrackRange(t *testing.T) {
+	client := emulatortest.StartClient(t, nil, proto.FORMAT_1440K, test_profile())
+
+	start := byte(0)
+	end := byte(2)
+
+	results := do_verify(context.Background(), client, start, end, OptionalUint{value: 0}, nil, false)
+	s := summarize(results, 0)
+
+	// Without retries every failing sector is bad
+	check_counts(t, s.Good, s.Bad, s.Degraded, 3*36-3, 3, 0)
+}
+
+func TestVerifyRetries(t *testing.T) {
+	client := emulatortest.StartClient(t, nil, proto.FORMAT_1440K, test_profile())
+
+	start := byte(1)
+	end := byte(5)
+
+	results := do_verify(context.Background(), client, start, end, OptionalUint{value: 3}, nil, false)
+	s := summarize(results, 3)
+
+	check_counts(t, s.Good, s.Bad, s.Degraded, 5*36-4, 2, 2)
+}
+
+func TestVerifySectorRetries(t *testing.T) {
+	client := emulatortest.StartClient(t, nil, proto.FORMAT_1440K, test_profile())
+
+	_, tries, _, err := verify_sector_retries(context.Background(), client, 2, 1, 1, 1)
+
+	if err == nil || tries != 2 {
+		t.Errorf("tries = %d, err = %v, want 2 tries and an error", tries, err)
+	}
+
+	// Third read succeeds
+	_, tries, _, err = verify_sector_retries(context.Background(), client, 2, 1, 1, 1)
+
+	if err != nil || tries != 0 {
+		t.Errorf("tries = %d, err = %v, want 0 tries and no error", tries, err)
+	}
+}
+
+func TestVerifyAgainst(t *testing.T) {
+	image := make([]byte, proto.FORMAT_1440K.Size())
+	rand.New(rand.NewSource(1)).Read(image)
+
+	client := emulatortest.StartClient(t, image, proto.FORMAT_1440K, test_profile())
+
+	// Copy with two sectors changed
+	against := bytes.Clone(image)
+	against[10*SECTOR_SIZE+7] ^= 1
+	against[11*SECTOR_SIZE] ^= 1
+
+	start := byte(0)
+	end := byte(1)
+
+	results := do_verify(context.Background(), client, start, end, OptionalUint{value: 0}, against, false)
+	s := summarize(results, 0)
+
+	// 1/0/5 is unreadable
+	check_counts(t, s.Good, s.Bad, s.Degraded, 2*36-3, 1, 0)
+
+	differ := sectors_with(results, STATUS_DIFFER)
+	if len(differ) != 2 || differ[0] != 10 || differ[1] != 11 {
+		t.Errorf("differ = %v, want [10 11]", differ)
+	}
+}
+
+func TestFormatRanges(t *testing.T) {
+	if got := format_ranges([]uint{3, 10, 11, 12, 40, 42, 43}); got != "3, 10-12, 40, 42-43" {
+		t.Errorf("format_ranges = %q", got)
+	}
+	if got := format_ranges(nil); got != "" {
+		t.Errorf("format_ranges(nil) = %q", got)
+	}
+}